@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/highload-service/internal/analytics"
+)
+
+// adminOptions configures the admin listener
+type adminOptions struct {
+	// Addr is the listen address of the admin listener (empty disables it)
+	Addr string
+	// Token must be sent as "Authorization: Bearer <token>"
+	Token string
+}
+
+// placeholderAdminToken is the value the admin secret used to ship with;
+// a deployment still using it has a publicly known token
+const placeholderAdminToken = "change-me"
+
+func adminOptionsFromEnv() (adminOptions, error) {
+	port := os.Getenv("ADMIN_PORT")
+	if port == "" {
+		return adminOptions{}, nil
+	}
+	opts := adminOptions{Addr: ":" + port, Token: os.Getenv("ADMIN_TOKEN")}
+	if opts.Token == "" {
+		return adminOptions{}, fmt.Errorf("ADMIN_TOKEN is required when ADMIN_PORT is set")
+	}
+	if opts.Token == placeholderAdminToken {
+		return adminOptions{}, fmt.Errorf("ADMIN_TOKEN is the placeholder %q, set a real token", placeholderAdminToken)
+	}
+	return opts, nil
+}
+
+// newAdminServer creates the admin listener. It has no write timeout: CPU
+// profiles and execution traces stream for as long as requested.
+func newAdminServer(opts adminOptions, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              opts.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// adminRoutes serves pprof, expvar, the service internals and the runtime
+// configuration API behind the admin token
+func (s *Service) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/admin/config", s.handleAdminConfig)
+	mux.HandleFunc("/admin/runtime", s.handleAdminRuntime)
+	mux.HandleFunc("/admin/detector", s.handleAdminDetector)
+	s.configRoutes(mux)
+	return s.requireAdminToken(mux)
+}
+
+func (s *Service) requireAdminToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + s.admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if s.admin.Token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// handleAdminConfig reports the settings the service is running with, after
+// defaults were applied. Secrets (passwords, tokens) are never included.
+func (s *Service) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	mode := DetectorModeLocal
+	if s.shared != nil {
+		mode = DetectorModeShared
+	}
+	detector := s.anomalyDetector.Config()
+	cfg := map[string]interface{}{
+		"version": ServiceVersion,
+		"detector": map[string]interface{}{
+			"mode":        mode,
+			"type":        detector.Method,
+			"window_size": detector.WindowSize,
+			"threshold":   detector.Threshold,
+			"overrides":   s.streams.Overrides(),
+			"revision":    s.configRevision.Load(),
+			"sync":        s.configSync.String(),
+		},
+		"cache": map[string]interface{}{
+			"type":               fmt.Sprintf("%T", s.cache),
+			"write_timeout":      s.writeTimeout.String(),
+			"read_timeout":       s.readTimeout.String(),
+			"history_max_points": s.historyMaxPoints,
+			"raw_retention":      s.rawRetention.String(),
+		},
+		"server": map[string]interface{}{
+			"read_header_timeout": s.server.ReadHeaderTimeout.String(),
+			"read_timeout":        s.server.ReadTimeout.String(),
+			"write_timeout":       s.server.WriteTimeout.String(),
+			"idle_timeout":        s.server.IdleTimeout.String(),
+			"max_header_bytes":    s.server.MaxHeaderBytes,
+			"max_metric_bytes":    s.server.MaxMetricBytes,
+		},
+		"readiness": map[string]interface{}{
+			"redis_timeout":  s.probes.RedisTimeout.String(),
+			"require_redis":  s.probes.RequireRedis,
+			"warmup_points":  s.probes.WarmupPoints,
+			"warmup_timeout": s.probes.WarmupTimeout.String(),
+		},
+		"rates": map[string]interface{}{
+			"ingest_window":  s.ingestRate.Window().String(),
+			"anomaly_window": s.anomalyRate.Window().String(),
+		},
+		"streams": map[string]interface{}{
+			"idle_timeout": s.streamIdle.String(),
+		},
+	}
+	if s.snapshots != nil {
+		cfg["snapshots"] = map[string]interface{}{
+			"store":    fmt.Sprintf("%T", s.snapshots),
+			"interval": s.snapshotOpts.Interval.String(),
+			"max_age":  s.snapshotOpts.MaxAge.String(),
+			"timeout":  s.snapshotOpts.Timeout.String(),
+		}
+	}
+	if s.shards != nil {
+		cfg["sharding"] = map[string]interface{}{
+			"self":  s.shards.Self(),
+			"peers": s.shards.Peers(),
+		}
+	}
+	writeAdminJSON(w, cfg)
+}
+
+func (s *Service) handleAdminRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeAdminJSON(w, map[string]interface{}{
+		"goroutines":     runtime.NumGoroutine(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"num_cpu":        runtime.NumCPU(),
+		"go_version":     runtime.Version(),
+		"uptime":         s.clock.Now().Sub(s.startedAt).Round(time.Second).String(),
+		"heap_alloc":     mem.HeapAlloc,
+		"heap_objects":   mem.HeapObjects,
+		"num_gc":         mem.NumGC,
+		"gc_pause_total": time.Duration(mem.PauseTotalNs).String(),
+		"draining":       s.Draining(),
+	})
+}
+
+// handleAdminDetector dumps the detector windows, which /analyze only
+// summarises
+func (s *Service) handleAdminDetector(w http.ResponseWriter, r *http.Request) {
+	mean, std, count := s.anomalyDetector.GetStats()
+	z, isAnomaly := s.anomalyDetector.GetLastDecision()
+	out := map[string]interface{}{
+		"local": map[string]interface{}{
+			"mean":            mean,
+			"std_dev":         std,
+			"count":           count,
+			"last_zscore":     z,
+			"last_is_anomaly": isAnomaly,
+			"window":          s.anomalyDetector.Snapshot().Values,
+			"rolling_average": s.rollingAvg.Snapshot().Values,
+		},
+		"streams":              s.streams.Len(),
+		"stream_sources":       s.streams.Sources(),
+		"stream_series":        s.metrics.Streams.Sources(),
+		"ingest_per_second":    s.ingestRate.Rate(time.Second),
+		"anomalies_per_minute": s.anomalyRate.Rate(time.Minute),
+	}
+	if s.shared != nil {
+		var stats analytics.WindowStats
+		err := s.cacheOp(r, "detector_window", s.readTimeout, func(ctx context.Context) error {
+			var err error
+			stats, err = s.shared.Stats(ctx)
+			return err
+		})
+		if err != nil {
+			out["shared"] = map[string]string{"error": err.Error()}
+		} else {
+			out["shared"] = map[string]interface{}{
+				"average":         stats.Average,
+				"std_dev":         stats.StdDev,
+				"count":           stats.Count,
+				"last_zscore":     stats.LastZ,
+				"last_is_anomaly": stats.LastIsAnomaly,
+			}
+		}
+	}
+	writeAdminJSON(w, out)
+}
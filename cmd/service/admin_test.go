@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminGet(t *testing.T, h http.Handler, path, token string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Addr: ":0", Token: "secret"}
+	h := s.adminRoutes()
+
+	for _, token := range []string{"", "wrong", "secre"} {
+		if code, _ := adminGet(t, h, "/admin/runtime", token); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for token %q, got %d", token, code)
+		}
+	}
+	if code, body := adminGet(t, h, "/debug/pprof/", "secret"); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Fatalf("expected the pprof index, got %d", code)
+	}
+	if code, body := adminGet(t, h, "/debug/vars", "secret"); code != http.StatusOK || !strings.Contains(body, "memstats") {
+		t.Fatalf("expected expvar output, got %d", code)
+	}
+
+	// без токена админка закрыта целиком
+	s.admin.Token = ""
+	if code, _ := adminGet(t, s.adminRoutes(), "/admin/runtime", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a configured token, got %d", code)
+	}
+}
+
+func TestAdminOptionsFromEnv(t *testing.T) {
+	t.Setenv("ADMIN_PORT", "")
+	if opts, err := adminOptionsFromEnv(); err != nil || opts.Addr != "" {
+		t.Fatalf("expected the admin listener to be off, got %+v (%v)", opts, err)
+	}
+	t.Setenv("ADMIN_PORT", "6060")
+	t.Setenv("ADMIN_TOKEN", "")
+	if _, err := adminOptionsFromEnv(); err == nil {
+		t.Fatal("expected an error without ADMIN_TOKEN")
+	}
+	t.Setenv("ADMIN_TOKEN", placeholderAdminToken)
+	if _, err := adminOptionsFromEnv(); err == nil {
+		t.Fatal("expected the placeholder token to be refused")
+	}
+	t.Setenv("ADMIN_TOKEN", "secret")
+	if opts, err := adminOptionsFromEnv(); err != nil || opts.Addr != ":6060" {
+		t.Fatalf("unexpected options %+v (%v)", opts, err)
+	}
+}
+
+func TestAdminInternals(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Token: "secret"}
+	h := s.adminRoutes()
+	warmUp(s, 5)
+
+	code, body := adminGet(t, h, "/admin/detector", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	var detector struct {
+		Local struct {
+			Count  int       `json:"count"`
+			Window []float64 `json:"window"`
+		} `json:"local"`
+	}
+	if err := json.Unmarshal([]byte(body), &detector); err != nil {
+		t.Fatal(err)
+	}
+	if detector.Local.Count != 5 || len(detector.Local.Window) != 5 {
+		t.Fatalf("expected the 5-value window, got %+v", detector.Local)
+	}
+
+	_, body = adminGet(t, h, "/admin/config", "secret")
+	var cfg map[string]map[string]interface{}
+	json.Unmarshal([]byte(body), &cfg)
+	if cfg["detector"]["window_size"] != float64(50) || cfg["detector"]["mode"] != DetectorModeLocal {
+		t.Fatalf("unexpected detector config %v", cfg["detector"])
+	}
+	if strings.Contains(body, "secret") {
+		t.Fatal("the admin token must not appear in the config")
+	}
+
+	_, body = adminGet(t, h, "/admin/runtime", "secret")
+	var rt map[string]interface{}
+	json.Unmarshal([]byte(body), &rt)
+	if n, _ := rt["goroutines"].(float64); n < 1 {
+		t.Fatalf("expected a goroutine count, got %v", rt["goroutines"])
+	}
+}
+
+func TestAdminNotOnPublicPort(t *testing.T) {
+	s := newTestService()
+	routes := s.setupRoutes()
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/admin/config", "/config/analytics"} {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected %s to be absent from the public port, got %d", path, rec.Code)
+		}
+	}
+}
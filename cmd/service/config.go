@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/cache"
+)
+
+// maxConfigBytes limits the body of the configuration API
+const maxConfigBytes = 4 << 10
+
+// analyticsConfigPatch is the body of PUT /config/analytics: omitted
+// fields keep their current value
+type analyticsConfigPatch struct {
+	Detector   *string  `json:"detector"`
+	WindowSize *int     `json:"window_size"`
+	Threshold  *float64 `json:"threshold"`
+}
+
+func (p analyticsConfigPatch) apply(c analytics.DetectorConfig) analytics.DetectorConfig {
+	if p.Detector != nil {
+		c.Method = analytics.Method(*p.Detector)
+	}
+	if p.WindowSize != nil {
+		c.WindowSize = *p.WindowSize
+	}
+	if p.Threshold != nil {
+		c.Threshold = *p.Threshold
+	}
+	return c
+}
+
+// decodeConfigPatch reads the patch of r and applies it to current
+func decodeConfigPatch(r *http.Request, current analytics.DetectorConfig) (analytics.DetectorConfig, error) {
+	var p analyticsConfigPatch
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return current, err
+		}
+		return current, errors.New("invalid JSON")
+	}
+	c := p.apply(current)
+	return c, c.Validate()
+}
+
+// configAttr renders c as a log group
+func configAttr(name string, c analytics.DetectorConfig) slog.Attr {
+	return slog.Group(name, "detector", c.Method, "window_size", c.WindowSize, "threshold", c.Threshold)
+}
+
+// auditConfig logs who changed which configuration from what to what
+func (s *Service) auditConfig(r *http.Request, scope string, old, c analytics.DetectorConfig) {
+	s.log(r).Info("Analytics configuration changed",
+		"audit", true,
+		"scope", scope,
+		"remote_addr", r.RemoteAddr,
+		configAttr("old", old),
+		configAttr("new", c),
+	)
+}
+
+// ConfigKey is the cache key of the detector configuration shared by all
+// replicas
+const ConfigKey = "config:analytics"
+
+// errNoOverride is returned when deleting an override that does not exist
+var errNoOverride = errors.New("no override for source")
+
+// analyticsSettings is the detector configuration of the service. It is
+// kept under ConfigKey so that a change made through one replica reaches
+// every replica and survives restarts.
+type analyticsSettings struct {
+	Revision  int64                               `json:"revision"`
+	UpdatedAt time.Time                           `json:"updated_at"`
+	Default   analytics.DetectorConfig            `json:"default"`
+	Overrides map[string]analytics.DetectorConfig `json:"overrides"`
+}
+
+// analyticsConfig is the configuration of the service-wide detectors
+func (s *Service) analyticsConfig() analytics.DetectorConfig {
+	return s.anomalyDetector.Config()
+}
+
+// currentSettings returns the settings applied on this replica
+func (s *Service) currentSettings() analyticsSettings {
+	return analyticsSettings{
+		Revision:  s.configRevision.Load(),
+		Default:   s.analyticsConfig(),
+		Overrides: s.streams.Overrides(),
+	}
+}
+
+// configureAnalytics applies c to the service-wide detectors and to every
+// source without an override. The windows are resized in place, so that
+// retained values keep counting towards the new statistics.
+func (s *Service) configureAnalytics(c analytics.DetectorConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.anomalyDetector.Configure(c)
+	s.rollingAvg.Resize(c.WindowSize)
+	if s.shared != nil {
+		s.shared.Configure(c)
+	}
+	return s.streams.SetDefault(c)
+}
+
+// applySettings makes st the configuration of this replica; the caller
+// holds configMu
+func (s *Service) applySettings(st analyticsSettings) error {
+	if err := s.configureAnalytics(st.Default); err != nil {
+		return err
+	}
+	if err := s.streams.SetOverrides(st.Overrides); err != nil {
+		return err
+	}
+	s.configRevision.Store(st.Revision)
+	return nil
+}
+
+// settingsCache is a cache that can hold the shared settings
+type settingsCache interface {
+	cache.Getter
+	cache.RevisionSetter
+}
+
+// settingsStore returns the cache holding the shared settings, if the
+// cache can be read back and replaced conditionally
+func (s *Service) settingsStore() (settingsCache, bool) {
+	sc, ok := s.cache.(settingsCache)
+	return sc, ok
+}
+
+// syncSettings applies the shared settings if another replica stored a
+// newer revision; the caller holds configMu
+func (s *Service) syncSettings(ctx context.Context) error {
+	g, ok := s.settingsStore()
+	if !ok {
+		return nil
+	}
+	var st analyticsSettings
+	err := g.Get(ctx, ConfigKey, &st)
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.Revision <= s.configRevision.Load() {
+		return nil
+	}
+	if err := s.applySettings(st); err != nil {
+		return fmt.Errorf("invalid shared configuration revision %d: %w", st.Revision, err)
+	}
+	s.logger.Info("Applied shared analytics configuration", "revision", st.Revision, "updated_at", st.UpdatedAt,
+		configAttr("default", st.Default), "overrides", len(st.Overrides))
+	return nil
+}
+
+// syncSettingsPeriodically is run every CONFIG_SYNC_INTERVAL
+func (s *Service) syncSettingsPeriodically() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.readTimeout)
+	defer cancel()
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	if err := s.syncSettings(ctx); err != nil {
+		s.logger.Warn("Failed to sync analytics configuration", "error", err)
+	}
+}
+
+// updateSettings applies change to the latest shared settings, stores the
+// result for the other replicas and applies it here. It answers the request
+// itself when it fails.
+func (s *Service) updateSettings(w http.ResponseWriter, r *http.Request, change func(*analyticsSettings) error) (old, next analyticsSettings, ok bool) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	// изменение накладывается на последнюю ревизию, а не на возможно устаревшую локальную
+	err := s.cacheOp(r, "get_config", s.readTimeout, s.syncSettings)
+	if err != nil {
+		writeCacheError(w, r, "/config/analytics", err)
+		return old, next, false
+	}
+	old = s.currentSettings()
+	next = old
+	next.Overrides = s.streams.Overrides()
+	if err := change(&next); err != nil {
+		writeConfigError(w, err)
+		return old, next, false
+	}
+	next.Revision = old.Revision + 1
+	next.UpdatedAt = s.clock.Now()
+
+	if store, shared := s.settingsStore(); shared {
+		// ревизия сохраняется, только если её не заменила другая реплика
+		err = s.cacheOp(r, "set_config", s.writeTimeout, func(ctx context.Context) error {
+			return store.SetIfRevision(ctx, ConfigKey, old.Revision, next)
+		})
+		if errors.Is(err, cache.ErrConflict) {
+			http.Error(w, "configuration was changed concurrently, retry", http.StatusConflict)
+			return old, next, false
+		}
+		if err != nil {
+			writeCacheError(w, r, "/config/analytics", err)
+			return old, next, false
+		}
+	}
+	if err := s.applySettings(next); err != nil {
+		writeBadRequest(w, err.Error())
+		return old, next, false
+	}
+	return old, next, true
+}
+
+func (s *Service) writeAnalyticsConfig(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revision":  s.configRevision.Load(),
+		"default":   s.analyticsConfig(),
+		"overrides": s.streams.Overrides(),
+	})
+}
+
+func (s *Service) handleGetAnalyticsConfig(w http.ResponseWriter, r *http.Request) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.writeAnalyticsConfig(w)
+}
+
+// handlePutAnalyticsConfig changes the detector configuration at runtime,
+// without the rollout a WINDOW_SIZE or ANOMALY_THRESHOLD change needs. The
+// other replicas pick the change up within CONFIG_SYNC_INTERVAL.
+func (s *Service) handlePutAnalyticsConfig(w http.ResponseWriter, r *http.Request) {
+	old, next, ok := s.updateSettings(w, r, func(st *analyticsSettings) error {
+		c, err := decodeConfigPatch(r, st.Default)
+		st.Default = c
+		return err
+	})
+	if !ok {
+		return
+	}
+	s.auditConfig(r, "default", old.Default, next.Default)
+	s.writeAnalyticsConfig(w)
+}
+
+// handlePutSourceConfig overrides the configuration of one source; the
+// patch applies on top of its current configuration
+func (s *Service) handlePutSourceConfig(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+	var before, after analytics.DetectorConfig
+	_, _, ok := s.updateSettings(w, r, func(st *analyticsSettings) error {
+		before = st.configFor(source)
+		c, err := decodeConfigPatch(r, before)
+		if err != nil {
+			return err
+		}
+		st.Overrides[source], after = c, c
+		return nil
+	})
+	if !ok {
+		return
+	}
+	s.auditConfig(r, "source:"+source, before, after)
+	s.writeAnalyticsConfig(w)
+}
+
+// handleDeleteSourceConfig returns a source to the default configuration
+func (s *Service) handleDeleteSourceConfig(w http.ResponseWriter, r *http.Request) {
+	source := r.PathValue("source")
+	var before analytics.DetectorConfig
+	_, next, ok := s.updateSettings(w, r, func(st *analyticsSettings) error {
+		if _, ok := st.Overrides[source]; !ok {
+			return errNoOverride
+		}
+		before = st.Overrides[source]
+		delete(st.Overrides, source)
+		return nil
+	})
+	if !ok {
+		return
+	}
+	s.auditConfig(r, "source:"+source, before, next.Default)
+	s.writeAnalyticsConfig(w)
+}
+
+// configFor returns the configuration source is judged with under st
+func (st analyticsSettings) configFor(source string) analytics.DetectorConfig {
+	if c, ok := st.Overrides[source]; ok {
+		return c
+	}
+	return st.Default
+}
+
+// writeConfigError answers a rejected configuration change
+func writeConfigError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errNoOverride) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeBadRequest(w, err.Error())
+}
+
+// configRoutes registers the configuration API on the admin mux
+func (s *Service) configRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /config/analytics", s.handleGetAnalyticsConfig)
+	mux.HandleFunc("PUT /config/analytics", limitBody(maxConfigBytes, s.handlePutAnalyticsConfig))
+	mux.HandleFunc("PUT /config/analytics/sources/{source}", limitBody(maxConfigBytes, s.handlePutSourceConfig))
+	mux.HandleFunc("DELETE /config/analytics/sources/{source}", s.handleDeleteSourceConfig)
+}
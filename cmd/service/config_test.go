@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/cache"
+)
+
+func configRequest(t *testing.T, h http.Handler, method, path, token, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func analyzeStats(t *testing.T, h http.Handler) map[string]interface{} {
+	t.Helper()
+	_, body := configRequest(t, h, "GET", "/analyze", "", "")
+	var resp struct {
+		Stats map[string]interface{} `json:"anomaly_stats"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Stats
+}
+
+func TestConfigRequiresToken(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Token: "secret"}
+	h := s.adminRoutes()
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := configRequest(t, h, "PUT", "/config/analytics", token, `{"threshold":3}`); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for token %q, got %d", token, code)
+		}
+	}
+	if s.anomalyDetector.GetThreshold() != 2.0 {
+		t.Fatal("an unauthenticated request must not change the config")
+	}
+
+	// без ADMIN_TOKEN API выключено
+	s.admin.Token = ""
+	if code, _ := configRequest(t, s.adminRoutes(), "GET", "/config/analytics", "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a configured token, got %d", code)
+	}
+}
+
+func TestConfigChangesDetectors(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Token: "secret"}
+	logs := captureLogs(s)
+	h, public := s.adminRoutes(), s.setupRoutes()
+	warmUp(s, 10)
+
+	code, body := configRequest(t, h, "PUT", "/config/analytics", "secret", `{"detector":"mad","window_size":5,"threshold":3.5}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", code, body)
+	}
+	stats := analyzeStats(t, public)
+	if stats["threshold"] != 3.5 || stats["window_size"] != float64(5) || stats["detector"] != "mad" {
+		t.Fatalf("expected /analyze to report the new config, got %v", stats)
+	}
+	if stats["data_points"] != float64(5) || s.rollingAvg.GetCount() != 5 {
+		t.Fatalf("expected stats over the newest 5 values, got %v", stats["data_points"])
+	}
+
+	// частичное изменение не трогает остальные поля, а рост окна возвращает
+	// значения, отложенные при уменьшении
+	if code, _ := configRequest(t, h, "PUT", "/config/analytics", "secret", `{"window_size":50}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	warmUp(s, 3)
+	if c := s.anomalyDetector.Config(); c.Method != analytics.MethodMAD || c.Threshold != 3.5 || c.WindowSize != 50 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	if _, _, count := s.anomalyDetector.GetStats(); count != 13 {
+		t.Fatalf("expected all 13 values after growing the window, got %d", count)
+	}
+	if s.rollingAvg.GetCount() != 13 {
+		t.Fatalf("expected the rolling average over 13 values, got %d", s.rollingAvg.GetCount())
+	}
+	if c, _ := s.streams.Config("web"); c.WindowSize != 50 {
+		t.Fatalf("expected streams to follow the default, got %+v", c)
+	}
+
+	var audit []map[string]interface{}
+	for _, line := range logs(t) {
+		if line["audit"] == true {
+			audit = append(audit, line)
+		}
+	}
+	if len(audit) != 2 || audit[0]["scope"] != "default" {
+		t.Fatalf("expected 2 audit lines, got %v", audit)
+	}
+	old, _ := audit[0]["old"].(map[string]interface{})
+	updated, _ := audit[0]["new"].(map[string]interface{})
+	if old["window_size"] != float64(50) || updated["window_size"] != float64(5) || updated["detector"] != "mad" {
+		t.Fatalf("unexpected audit line %v", audit[0])
+	}
+}
+
+func TestConfigRejectsInvalid(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Token: "secret"}
+	h := s.adminRoutes()
+
+	for _, body := range []string{
+		`{"threshold":-1}`,
+		`{"window_size":1}`,
+		`{"detector":"ewma"}`,
+		`{"treshold":3}`,
+		`not json`,
+	} {
+		if code, _ := configRequest(t, h, "PUT", "/config/analytics", "secret", body); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, code)
+		}
+	}
+	if code, _ := configRequest(t, h, "PUT", "/config/analytics", "secret", `{"detector":"`+strings.Repeat("x", maxConfigBytes)+`"}`); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", code)
+	}
+	if c := s.anomalyDetector.Config(); c.WindowSize != 50 || c.Threshold != 2.0 || c.Method != analytics.MethodZScore {
+		t.Fatalf("a rejected request must not change the config, got %+v", c)
+	}
+}
+
+func TestConfigSourceOverrides(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Token: "secret"}
+	h, public := s.adminRoutes(), s.setupRoutes()
+
+	code, body := configRequest(t, h, "PUT", "/config/analytics/sources/web", "secret", `{"threshold":4}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", code, body)
+	}
+	var cfg struct {
+		Default   analytics.DetectorConfig            `json:"default"`
+		Overrides map[string]analytics.DetectorConfig `json:"overrides"`
+	}
+	if err := json.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := analytics.DetectorConfig{Method: analytics.MethodZScore, WindowSize: 50, Threshold: 4}
+	if cfg.Overrides["web"] != want || cfg.Default.Threshold != 2.0 {
+		t.Fatalf("expected an override for web only, got %+v", cfg)
+	}
+	if s.anomalyDetector.GetThreshold() != 2.0 {
+		t.Fatal("a source override must not change the service-wide detector")
+	}
+
+	_, body = configRequest(t, public, "GET", "/analyze", "", "")
+	if !strings.Contains(body, `"source_overrides":{"web"`) {
+		t.Fatalf("expected /analyze to list the override, got %s", body)
+	}
+
+	if code, _ := configRequest(t, h, "DELETE", "/config/analytics/sources/web", "secret", ""); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code, _ := configRequest(t, h, "DELETE", "/config/analytics/sources/web", "secret", ""); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing override, got %d", code)
+	}
+	if _, ok := s.streams.Config("web"); ok {
+		t.Fatal("expected web to be back on the defaults")
+	}
+}
+
+func TestConfigSourceOverrideChangesVerdict(t *testing.T) {
+	s := newTestService()
+	s.admin = adminOptions{Token: "secret"}
+	h, public := s.adminRoutes(), s.setupRoutes()
+	warmUpSource(s, "web", 30)
+	warmUpSource(s, "api", 30)
+
+	post := func(source string) bool {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		public.ServeHTTP(rec, httptest.NewRequest("POST", "/metrics", strings.NewReader(`{"timestamp":1,"source":"`+source+`","rps":103}`)))
+		var resp map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp["is_anomaly"] == true
+	}
+	// 103 отстоит от окна 100..102 больше чем на 2 сигмы
+	if !post("web") || !post("api") {
+		t.Fatal("expected 103 to be an anomaly with the default threshold")
+	}
+
+	if code, _ := configRequest(t, h, "PUT", "/config/analytics/sources/web", "secret", `{"threshold":10}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if post("web") {
+		t.Fatal("expected the threshold override to clear the verdict for web")
+	}
+	if !post("api") {
+		t.Fatal("expected api to keep the default threshold")
+	}
+
+	_, body := configRequest(t, public, "GET", "/analyze?source=web", "", "")
+	var out struct {
+		Stats map[string]interface{} `json:"anomaly_stats"`
+	}
+	json.Unmarshal([]byte(body), &out)
+	if out.Stats["threshold"] != float64(10) || out.Stats["overridden"] != true || out.Stats["is_anomaly"] != false {
+		t.Fatalf("expected /analyze?source=web to report the override, got %s", body)
+	}
+	if code, _ := configRequest(t, public, "GET", "/analyze?source=nope", "", ""); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown source, got %d", code)
+	}
+}
+
+func TestConfigSharedBetweenReplicas(t *testing.T) {
+	a, b := newTestService(), newTestService()
+	b.cache = a.cache
+	a.admin = adminOptions{Token: "secret"}
+	b.admin = adminOptions{Token: "secret"}
+
+	if code, _ := configRequest(t, a.adminRoutes(), "PUT", "/config/analytics", "secret", `{"threshold":4}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code, _ := configRequest(t, a.adminRoutes(), "PUT", "/config/analytics/sources/web", "secret", `{"detector":"mad"}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	// вторая реплика подхватывает изменение при следующей синхронизации
+	b.syncSettingsPeriodically()
+	if c := b.anomalyDetector.Config(); c.Threshold != 4 {
+		t.Fatalf("expected the other replica to apply the threshold, got %+v", c)
+	}
+	if c, ok := b.streams.Config("web"); !ok || c.Method != analytics.MethodMAD || c.Threshold != 4 {
+		t.Fatalf("expected the other replica to apply the override, got %+v", c)
+	}
+
+	// изменение через вторую реплику накладывается на последнюю ревизию
+	if code, _ := configRequest(t, b.adminRoutes(), "DELETE", "/config/analytics/sources/web", "secret", ""); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	a.syncSettingsPeriodically()
+	if len(a.streams.Overrides()) != 0 || a.configRevision.Load() != 3 || b.configRevision.Load() != 3 {
+		t.Fatalf("expected both replicas at revision 3 without overrides, got %d/%d %v", a.configRevision.Load(), b.configRevision.Load(), a.streams.Overrides())
+	}
+
+	// перезапущенная реплика стартует с общей конфигурацией
+	c := newTestService()
+	c.cache = a.cache
+	c.syncSettingsPeriodically()
+	if c.anomalyDetector.GetThreshold() != 4 {
+		t.Fatalf("expected a restarted replica to apply the stored config, got %v", c.anomalyDetector.GetThreshold())
+	}
+}
+
+// racingCache lets both replicas read the shared settings before either of
+// them stores its change
+type racingCache struct {
+	*cache.MemoryCache
+	reads atomic.Int32
+	read  sync.WaitGroup
+}
+
+func (c *racingCache) Get(ctx context.Context, key string, dest interface{}) error {
+	err := c.MemoryCache.Get(ctx, key, dest)
+	if key == ConfigKey && c.reads.Add(1) <= 2 {
+		c.read.Done()
+		c.read.Wait()
+	}
+	return err
+}
+
+func TestConfigConcurrentUpdatesAcrossReplicas(t *testing.T) {
+	shared := &racingCache{MemoryCache: cache.NewMemoryCache(100)}
+	shared.read.Add(2)
+	a, b := newTestService(), newTestService()
+	a.cache, b.cache = shared, shared
+	a.admin = adminOptions{Token: "secret"}
+	b.admin = adminOptions{Token: "secret"}
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i, s := range []*Service{a, b} {
+		wg.Add(1)
+		go func(i int, s *Service) {
+			defer wg.Done()
+			codes[i], _ = configRequest(t, s.adminRoutes(), "PUT", "/config/analytics", "secret", fmt.Sprintf(`{"threshold":%d}`, 3+i))
+		}(i, s)
+	}
+	wg.Wait()
+
+	// одна из реплик проигрывает гонку и не применяет своё изменение
+	if codes[0]+codes[1] != http.StatusOK+http.StatusConflict {
+		t.Fatalf("expected one 200 and one 409, got %v", codes)
+	}
+	a.syncSettingsPeriodically()
+	b.syncSettingsPeriodically()
+	if a.configRevision.Load() != 1 || b.configRevision.Load() != 1 {
+		t.Fatalf("expected both replicas at revision 1, got %d/%d", a.configRevision.Load(), b.configRevision.Load())
+	}
+	if ta, tb := a.anomalyDetector.GetThreshold(), b.anomalyDetector.GetThreshold(); ta != tb {
+		t.Fatalf("expected the replicas to agree on the threshold, got %v/%v", ta, tb)
+	}
+
+	// повтор проигравшего запроса накладывается на сохранённую ревизию
+	loser := a
+	if codes[0] == http.StatusOK {
+		loser = b
+	}
+	if code, _ := configRequest(t, loser.adminRoutes(), "PUT", "/config/analytics", "secret", `{"threshold":5}`); code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d", code)
+	}
+	if loser.configRevision.Load() != 2 {
+		t.Fatalf("expected revision 2 after the retry, got %d", loser.configRevision.Load())
+	}
+}
@@ -1,6 +1,11 @@
-package cache
+package main
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"github.com/highload-service/internal/cache"
+)
 
 type testCache struct{}
 
@@ -8,10 +13,34 @@ func newTestCache() *testCache {
 	return &testCache{}
 }
 
-func (c *testCache) Set(key string, value interface{}, ttl time.Duration) error {
+func (c *testCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return nil
+}
+
+func (c *testCache) Append(ctx context.Context, key string, score float64, value interface{}, maxLen int64) error {
+	return nil
+}
+
+func (c *testCache) Range(ctx context.Context, key string, min, max float64) ([][]byte, error) {
+	return nil, nil
+}
+
+func (c *testCache) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	return nil
+}
+
+func (c *testCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]cache.Point, error) {
+	return nil, nil
+}
+
+func (c *testCache) Observe(ctx context.Context, source string, ts time.Time, values map[string]float64) error {
 	return nil
 }
 
+func (c *testCache) RangeRollup(ctx context.Context, source string, res cache.Resolution, from, to time.Time) ([]cache.Bucket, error) {
+	return nil, nil
+}
+
 func (c *testCache) Close() error {
 	return nil
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/highload-service/internal/cache"
+)
+
+const (
+	// HistoryTargetPoints is the maximum number of buckets per source the
+	// automatic resolution selection aims for
+	HistoryTargetPoints = 1000
+	ResolutionRaw       = "raw"
+	ResolutionAuto      = "auto"
+)
+
+// HistoryPoint is a single (possibly aggregated) point of metric history
+type HistoryPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Source    string  `json:"source"`
+	CPU       float64 `json:"cpu"`
+	RPS       float64 `json:"rps"`
+	Count     int     `json:"count"`
+
+	Stats map[string]cache.Aggregate `json:"stats,omitempty"`
+}
+
+// readHistory loads at most limit stored metrics within [from, to] for
+// source ("" = all)
+func (s *Service) readHistory(ctx context.Context, from, to int64, source string, limit int64) ([]Metric, error) {
+	var fromTime, toTime time.Time
+	if from != 0 {
+		fromTime = time.Unix(from, 0)
+	}
+	if to != 0 {
+		// включаем всю последнюю секунду
+		toTime = time.Unix(to, int64(time.Second-1))
+	}
+
+	points, err := cache.RangePointsLimit(ctx, s.cache, source, fromTime, toTime, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Metric, 0, len(points))
+	for _, p := range points {
+		var m Metric
+		if err := json.Unmarshal(p.Data, &m); err != nil {
+			continue
+		}
+		m.Source = p.Source
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// downsample averages points into step-second buckets per source; step <= 0
+// returns the raw points unchanged
+func downsample(points []Metric, step int64) []HistoryPoint {
+	if step <= 0 {
+		out := make([]HistoryPoint, len(points))
+		for i, m := range points {
+			out[i] = HistoryPoint{Timestamp: m.Timestamp, Source: m.Source, CPU: m.CPU, RPS: m.RPS, Count: 1}
+		}
+		return out
+	}
+
+	type bucketKey struct {
+		ts     int64
+		source string
+	}
+	buckets := make(map[bucketKey]*HistoryPoint)
+	for _, m := range points {
+		ts := m.Timestamp - m.Timestamp%step
+		if m.Timestamp < 0 && m.Timestamp%step != 0 {
+			ts -= step
+		}
+		k := bucketKey{ts: ts, source: m.Source}
+		b, ok := buckets[k]
+		if !ok {
+			b = &HistoryPoint{Timestamp: ts, Source: m.Source}
+			buckets[k] = b
+		}
+		b.CPU += m.CPU
+		b.RPS += m.RPS
+		b.Count++
+	}
+
+	out := make([]HistoryPoint, 0, len(buckets))
+	for _, b := range buckets {
+		b.CPU /= float64(b.Count)
+		b.RPS /= float64(b.Count)
+		out = append(out, *b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Timestamp != out[j].Timestamp {
+			return out[i].Timestamp < out[j].Timestamp
+		}
+		return out[i].Source < out[j].Source
+	})
+	return out
+}
+
+// chooseResolution picks the data to serve a history query from: raw points
+// when the range is still covered by raw retention and the step is finer
+// than any rollup, otherwise the finest rollup that covers the range in at
+// most HistoryTargetPoints buckets
+func (s *Service) chooseResolution(name string, from, to time.Time, step time.Duration) (cache.Resolution, bool, error) {
+	if name == ResolutionRaw {
+		return cache.Resolution{}, true, nil
+	}
+	if name != "" && name != ResolutionAuto {
+		for _, res := range s.resolutions {
+			if res.Name == name {
+				return res, false, nil
+			}
+		}
+		return cache.Resolution{}, false, fmt.Errorf("unknown resolution %q", name)
+	}
+
+	if s.rollups == nil || len(s.resolutions) == 0 || from.IsZero() {
+		return cache.Resolution{}, true, nil
+	}
+
+	now := s.clock.Now()
+	if to.IsZero() {
+		to = now
+	}
+	inRaw := s.rawRetention == 0 || !from.Before(now.Add(-s.rawRetention))
+	if inRaw && step < s.resolutions[0].Step {
+		return cache.Resolution{}, true, nil
+	}
+
+	span := to.Sub(from)
+	for _, res := range s.resolutions {
+		if res.Step < step || span/res.Step > HistoryTargetPoints {
+			continue
+		}
+		if from.Before(now.Add(-res.Retention)) {
+			continue
+		}
+		return res, false, nil
+	}
+	return s.resolutions[len(s.resolutions)-1], false, nil
+}
+
+// rollupPoints converts rollup buckets into history points, merging them
+// into step-second buckets when the step is coarser than the resolution
+func rollupPoints(buckets []cache.Bucket, res cache.Resolution, step int64) []HistoryPoint {
+	if stepDur := time.Duration(step) * time.Second; stepDur < res.Step {
+		step = int64(res.Step / time.Second)
+	}
+
+	type bucketKey struct {
+		ts     int64
+		source string
+	}
+	merged := make(map[bucketKey]map[string]cache.Aggregate)
+	var order []bucketKey
+	for _, b := range buckets {
+		ts := b.Start.Unix()
+		ts -= ts % step
+		k := bucketKey{ts: ts, source: b.Source}
+		values, ok := merged[k]
+		if !ok {
+			values = make(map[string]cache.Aggregate)
+			merged[k] = values
+			order = append(order, k)
+		}
+		for f, agg := range b.Values {
+			values[f] = values[f].Merge(agg)
+		}
+	}
+
+	out := make([]HistoryPoint, 0, len(order))
+	for _, k := range order {
+		values := merged[k]
+		out = append(out, HistoryPoint{
+			Timestamp: k.ts,
+			Source:    k.source,
+			CPU:       values["cpu"].Avg,
+			RPS:       values["rps"].Avg,
+			Count:     int(values["rps"].Count),
+			Stats:     values,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Timestamp != out[j].Timestamp {
+			return out[i].Timestamp < out[j].Timestamp
+		}
+		return out[i].Source < out[j].Source
+	})
+	return out
+}
+
+func (s *Service) handleHistory(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	from, err := parseInt64Param(params.Get("from"))
+	if err != nil {
+		writeBadRequest(w, "invalid from")
+		return
+	}
+	to, err := parseInt64Param(params.Get("to"))
+	if err != nil {
+		writeBadRequest(w, "invalid to")
+		return
+	}
+	if to != 0 && from > to {
+		writeBadRequest(w, "from must not exceed to")
+		return
+	}
+	step, err := parseInt64Param(params.Get("step"))
+	if err != nil || step < 0 {
+		writeBadRequest(w, "invalid step")
+		return
+	}
+	if from == 0 && s.historyLookback > 0 {
+		// без from история читается за последний historyLookback, а не целиком
+		end := s.clock.Now()
+		if to != 0 {
+			end = time.Unix(to, 0)
+		}
+		from = end.Add(-s.historyLookback).Unix()
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeBadRequest(w, "invalid format")
+		return
+	}
+
+	var fromTime, toTime time.Time
+	if from != 0 {
+		fromTime = time.Unix(from, 0)
+	}
+	if to != 0 {
+		toTime = time.Unix(to, 0)
+	}
+	res, raw, err := s.chooseResolution(params.Get("resolution"), fromTime, toTime, time.Duration(step)*time.Second)
+	if err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	var points []HistoryPoint
+	var truncated bool
+	resolution := ResolutionRaw
+	if raw {
+		err = s.cacheOp(r, "range_points", s.readTimeout, func(ctx context.Context) error {
+			// лишняя точка показывает, что в диапазоне есть ещё
+			var limit int64
+			if s.historyMaxPoints > 0 {
+				limit = s.historyMaxPoints + 1
+			}
+			stored, err := s.readHistory(ctx, from, to, params.Get("source"), limit)
+			if limit > 0 && int64(len(stored)) > s.historyMaxPoints {
+				stored, truncated = stored[:s.historyMaxPoints], true
+			}
+			points = downsample(stored, step)
+			return err
+		})
+	} else {
+		err = s.cacheOp(r, "range_rollup", s.readTimeout, func(ctx context.Context) error {
+			buckets, err := s.rollups.RangeRollup(ctx, params.Get("source"), res, fromTime, toTime)
+			points = rollupPoints(buckets, res, step)
+			return err
+		})
+		resolution = res.Name
+	}
+	if err != nil {
+		writeCacheError(w, r, "/metrics/history", err)
+		return
+	}
+
+	if truncated {
+		w.Header().Set("X-History-Truncated", "true")
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"timestamp", "source", "cpu", "rps", "count"})
+		for _, p := range points {
+			cw.Write([]string{
+				strconv.FormatInt(p.Timestamp, 10),
+				p.Source,
+				strconv.FormatFloat(p.CPU, 'f', -1, 64),
+				strconv.FormatFloat(p.RPS, 'f', -1, 64),
+				strconv.Itoa(p.Count),
+			})
+		}
+		cw.Flush()
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":       from,
+			"to":         to,
+			"step":       step,
+			"resolution": resolution,
+			"truncated":  truncated,
+			"points":     points,
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramCount returns the number of observations of one histogram series
+func histogramCount(t *testing.T, h prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentRecordsEveryRoute(t *testing.T) {
+	s := newTestService()
+	m := s.metrics
+	routes := s.setupRoutes()
+	routes.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if got := testutil.ToFloat64(m.RequestsInFlight.WithLabelValues(r.Method, "/items/{id}")); got != 1 {
+			t.Errorf("expected 1 request in flight, got %v", got)
+		}
+		w.Write([]byte("hello"))
+	})
+	routes.HandleFunc("/crash", func(w http.ResponseWriter, r *http.Request) { panic("crash") })
+
+	serve := func(method, target, body string) {
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, strings.NewReader(body)))
+	}
+	serve("POST", "/metrics", `{"timestamp":1,"rps":100}`)
+	serve("POST", "/metrics", `not json`)
+	serve("GET", "/metrics/history?from=abc", "")
+	serve("GET", "/items/1", "")
+	serve("GET", "/items/2", "")
+	serve("GET", "/crash", "")
+
+	checks := []struct {
+		method, route, status string
+		want                  float64
+	}{
+		{"POST", "/metrics", "200", 1},
+		{"POST", "/metrics", "400", 1},
+		{"GET", "/metrics/history", "400", 1},
+		{"GET", "/items/{id}", "200", 2},
+		{"GET", "/crash", "500", 1},
+	}
+	for _, c := range checks {
+		if got := testutil.ToFloat64(m.RequestTotal.WithLabelValues(c.method, c.route, c.status)); got != c.want {
+			t.Errorf("%s %s %s: expected %v requests, got %v", c.method, c.route, c.status, c.want, got)
+		}
+	}
+	if got := histogramCount(t, m.ResponseSize.WithLabelValues("GET", "/items/{id}")); got != 2 {
+		t.Errorf("expected 2 response sizes, got %d", got)
+	}
+	if got := histogramCount(t, m.RequestDuration.WithLabelValues("POST", "/metrics")); got != 2 {
+		t.Errorf("expected 2 latencies, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.RequestsInFlight.WithLabelValues("GET", "/items/{id}")); got != 0 {
+		t.Errorf("expected no requests in flight, got %v", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the request id; an incoming value is kept so that
+// a request can be followed across replicas
+const RequestIDHeader = "X-Request-ID"
+
+// newLogger builds the process logger from LOG_FORMAT (json or text) and
+// LOG_LEVEL (debug, info, warn or error)
+func newLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q: must be json or text", format)
+	}
+}
+
+// requestLog is the logger of one request; handlers add fields to it (e.g.
+// the source) and the access log line carries them too
+type requestLog struct {
+	logger *slog.Logger
+}
+
+type requestLogKey struct{}
+
+// requestLogger returns the request-scoped logger of ctx, or fallback
+// outside a request
+func requestLogger(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.logger
+	}
+	return fallback
+}
+
+// addLogFields adds fields to the rest of the request's log lines
+func addLogFields(r *http.Request, args ...any) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.logger = rl.logger.With(args...)
+	}
+}
+
+// log returns the logger of the request r
+func (s *Service) log(r *http.Request) *slog.Logger {
+	return requestLogger(r.Context(), s.logger)
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// quietRoutes are polled by probes and scrapers; their access log is
+// written at debug level
+var quietRoutes = map[string]bool{
+	"/livez": true, "/readyz": true, "/ready": true, "/health": true,
+}
+
+// accessLog attaches a request-scoped logger (request id, method, route) to
+// every request and logs one line per request once it completes
+func (s *Service) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		route := routeTemplate(r)
+		logger := s.logger.With("request_id", id, "method", r.Method, "route", route)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+		}
+		rl := &requestLog{logger: logger}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+
+		rec := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if quietRoutes[route] || (route == "/metrics" && r.Method == http.MethodGet) {
+			level = slog.LevelDebug
+		}
+		rl.logger.LogAttrs(r.Context(), level, "request",
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.size),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
+
+// logSampler lets through at most limit events per interval and counts the
+// rest, so that an anomaly storm does not flood the logs
+type logSampler struct {
+	clock    clock.Clock
+	limit    int
+	interval time.Duration
+
+	mu         sync.Mutex
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLogSampler(limit int, interval time.Duration, clk clock.Clock) *logSampler {
+	return &logSampler{clock: clock.Or(clk), limit: limit, interval: interval}
+}
+
+// Allow reports whether the event should be logged, with the number of
+// events suppressed since the last one let through. A non-positive limit
+// lets everything through.
+func (ls *logSampler) Allow() (bool, int) {
+	if ls == nil || ls.limit <= 0 {
+		return true, 0
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	now := ls.clock.Now()
+	if now.Sub(ls.start) >= ls.interval {
+		ls.start, ls.count = now, 0
+	}
+	if ls.count >= ls.limit {
+		ls.suppressed++
+		return false, 0
+	}
+	ls.count++
+	suppressed := ls.suppressed
+	ls.suppressed = 0
+	return true, suppressed
+}
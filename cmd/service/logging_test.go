@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+// captureLogs points the service logger at a buffer and returns a function
+// decoding the JSON lines written so far
+func captureLogs(s *Service) func(t *testing.T) []map[string]interface{} {
+	var buf bytes.Buffer
+	s.logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return func(t *testing.T) []map[string]interface{} {
+		t.Helper()
+		var lines []map[string]interface{}
+		sc := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+		for sc.Scan() {
+			var line map[string]interface{}
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				t.Fatalf("log line is not JSON: %q", sc.Text())
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_FORMAT", "text")
+	var buf bytes.Buffer
+	l, err := newLogger(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("shown", "k", "v")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "msg=shown k=v") {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	t.Setenv("LOG_LEVEL", "loud")
+	if _, err := newLogger(&buf); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "xml")
+	if _, err := newLogger(&buf); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestAccessLogCarriesRequestFields(t *testing.T) {
+	s := newTestService()
+	logs := captureLogs(s)
+	routes := s.setupRoutes()
+
+	req := httptest.NewRequest("POST", "/metrics", strings.NewReader(`{"timestamp":1,"source":"web","rps":100}`))
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if got := rec.Header().Get(RequestIDHeader); got != "abc-123" {
+		t.Fatalf("expected the request id to be echoed, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest("GET", "/livez", nil))
+	generated := rec.Header().Get(RequestIDHeader)
+	if len(generated) != 16 {
+		t.Fatalf("expected a generated request id, got %q", generated)
+	}
+
+	lines := logs(t)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log lines, got %v", lines)
+	}
+	first := lines[0]
+	for k, want := range map[string]interface{}{
+		"msg": "request", "level": "INFO", "request_id": "abc-123", "method": "POST",
+		"route": "/metrics", "source": "web", "status": float64(200),
+	} {
+		if first[k] != want {
+			t.Errorf("expected %s=%v, got %v", k, want, first[k])
+		}
+	}
+	// пробы пишутся на уровне debug, чтобы не засорять лог
+	if lines[1]["level"] != "DEBUG" || lines[1]["request_id"] != generated {
+		t.Fatalf("unexpected probe log line %v", lines[1])
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	ls := newLogSampler(2, time.Minute, clk)
+
+	var allowed int
+	for i := 0; i < 5; i++ {
+		if ok, _ := ls.Allow(); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("expected 2 events per interval, got %d", allowed)
+	}
+
+	clk.Advance(time.Minute)
+	if ok, suppressed := ls.Allow(); !ok || suppressed != 3 {
+		t.Fatalf("expected the next event to report 3 suppressed, got %v/%d", ok, suppressed)
+	}
+}
+
+func TestAnomalyLogsAreSampled(t *testing.T) {
+	s := newTestService()
+	clk := useFakeClock(s, time.Unix(1000, 0))
+	s.anomalyLogs = newLogSampler(1, time.Minute, clk)
+	routes := s.setupRoutes()
+	warmUpSource(s, "web", 20)
+	logs := captureLogs(s)
+
+	for i := 0; i < 3; i++ {
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/metrics", strings.NewReader(`{"timestamp":1,"source":"web","rps":100000}`)))
+	}
+
+	var anomalies []map[string]interface{}
+	for _, l := range logs(t) {
+		if l["msg"] == "Anomaly detected" {
+			anomalies = append(anomalies, l)
+		}
+	}
+	if len(anomalies) != 1 {
+		t.Fatalf("expected 1 anomaly line, got %d", len(anomalies))
+	}
+	if a := anomalies[0]; a["source"] != "web" || a["request_id"] == nil || a["zscore"] == nil {
+		t.Fatalf("expected request fields on the anomaly line, got %v", a)
+	}
+}
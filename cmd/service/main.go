@@ -1,26 +1,44 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/anomalies"
 	"github.com/highload-service/internal/cache"
+	"github.com/highload-service/internal/clock"
 	"github.com/highload-service/internal/metrics"
+	"github.com/highload-service/internal/sharding"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	ServiceVersion       = "v1.0.0"
-	RPSUpdateIntervalSec = 1.0
-	RedisTTL             = 5 * time.Minute
+	ServiceVersion     = "v1.0.0"
+	RedisTTL           = 5 * time.Minute
+	DefaultSource      = "default"
+	DetectorZScore     = "zscore"
+	DetectorModeLocal  = "local"
+	DetectorModeShared = "shared"
 )
 
 func getenvInt(name string, def int) int {
@@ -35,6 +53,30 @@ func getenvInt(name string, def int) int {
 	return i
 }
 
+func getenvBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+func getenvDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
 func getenvFloat(name string, def float64) float64 {
 	v := os.Getenv(name)
 	if v == "" {
@@ -47,27 +89,70 @@ func getenvFloat(name string, def float64) float64 {
 	return f
 }
 
+// splitList splits a comma-separated env value, dropping empty items
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 type Metric struct {
 	Timestamp int64   `json:"timestamp"`
+	Source    string  `json:"source,omitempty"`
 	CPU       float64 `json:"cpu"`
 	RPS       float64 `json:"rps"`
 }
 
 type Service struct {
-	cache             cache.Cache
-	rollingAvg        *analytics.RollingAverage
-	anomalyDetector   *analytics.AnomalyDetector
-	rpsCounter        int64
-	anomalyCounter    int64
-	lastRPSUpdate     time.Time
-	lastAnomalyUpdate time.Time
-	statsMu           sync.Mutex
+	metrics          *metrics.Metrics
+	gatherer         prometheus.Gatherer
+	cache            cache.Cache
+	rollingAvg       *analytics.RollingAverage
+	anomalyDetector  *analytics.AnomalyDetector
+	shared           *analytics.SharedDetector
+	snapshots        snapshotStore
+	snapshotOpts     snapshotOptions
+	streams          *analytics.Streams
+	streamIdle       time.Duration
+	stop             chan struct{} // closed by Close to end background loops
+	background       sync.WaitGroup
+	shards           *sharding.Sharder
+	forwardClient    *http.Client
+	shardSecret      []byte
+	draining         atomic.Bool
+	clock            clock.Clock
+	logger           *slog.Logger
+	tracer           trace.Tracer
+	anomalyLogs      *logSampler // ограничивает строки лога об аномалиях
+	startedAt        time.Time
+	probes           probeOptions
+	server           serverOptions
+	admin            adminOptions
+	configMu         sync.Mutex   // сериализует изменения конфигурации детекторов
+	configRevision   atomic.Int64 // применённая ревизия общей конфигурации
+	configSync       time.Duration
+	anomalies        *anomalies.Store
+	historyMaxPoints int64
+	historyLookback  time.Duration
+	rollups          cache.Rollups
+	resolutions      []cache.Resolution
+	rawRetention     time.Duration
+	writeTimeout     time.Duration
+	readTimeout      time.Duration
+	ingestRate       *analytics.RateCounter
+	anomalyRate      *analytics.RateCounter
 }
 
 func NewService() (*Service, error) {
 	windowSize := getenvInt("WINDOW_SIZE", 50)
 	anomalyThreshold := getenvFloat("ANOMALY_THRESHOLD", 2.0)
 	redisDB := getenvInt("REDIS_DB", 0)
+	anomalyHistorySize := getenvInt("ANOMALY_HISTORY_SIZE", 1000)
+	historyMaxPoints := getenvInt("HISTORY_MAX_POINTS", 100000)
 
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
@@ -79,78 +164,407 @@ func NewService() (*Service, error) {
 		redisPassword = ""
 	}
 
-	redisCache, err := cache.NewRedisCache(redisAddr, redisPassword, redisDB)
+	reg := metrics.NewRegistry()
+	m := metrics.New(reg, ServiceVersion)
+
+	redisOpts := cache.RedisOptions{
+		Mode:             os.Getenv("REDIS_MODE"),
+		Addrs:            splitList(redisAddr),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		Username:         os.Getenv("REDIS_USERNAME"),
+		Password:         redisPassword,
+		DB:               redisDB,
+		TLS: cache.TLSOptions{
+			Enabled:            getenvBool("REDIS_TLS", false),
+			CAFile:             os.Getenv("REDIS_TLS_CA_FILE"),
+			CertFile:           os.Getenv("REDIS_TLS_CERT_FILE"),
+			KeyFile:            os.Getenv("REDIS_TLS_KEY_FILE"),
+			ServerName:         os.Getenv("REDIS_TLS_SERVER_NAME"),
+			InsecureSkipVerify: getenvBool("REDIS_TLS_INSECURE_SKIP_VERIFY", false),
+		},
+		Pool: cache.PoolOptions{
+			Size:         getenvInt("REDIS_POOL_SIZE", 0),
+			MinIdleConns: getenvInt("REDIS_MIN_IDLE_CONNS", 0),
+			DialTimeout:  getenvDuration("REDIS_DIAL_TIMEOUT", 0),
+			ReadTimeout:  getenvDuration("REDIS_READ_TIMEOUT", 0),
+			WriteTimeout: getenvDuration("REDIS_WRITE_TIMEOUT", 0),
+			PoolTimeout:  getenvDuration("REDIS_POOL_TIMEOUT", 0),
+			IdleTimeout:  getenvDuration("REDIS_IDLE_TIMEOUT", 0),
+			MaxConnAge:   getenvDuration("REDIS_MAX_CONN_AGE", 0),
+		},
+	}
+	switch redisOpts.Mode {
+	case "", cache.ModeStandalone, cache.ModeSentinel, cache.ModeCluster:
+	default:
+		return nil, fmt.Errorf("unknown REDIS_MODE %q", redisOpts.Mode)
+	}
+	// bad certificate paths would otherwise only show up in the reconnect loop
+	if _, err := redisOpts.TLS.Config(); err != nil {
+		return nil, fmt.Errorf("invalid Redis TLS settings: %w", err)
+	}
+
+	detectorMode := os.Getenv("DETECTOR_MODE")
+	switch detectorMode {
+	case "", DetectorModeLocal, DetectorModeShared:
+	default:
+		return nil, fmt.Errorf("unknown DETECTOR_MODE %q", detectorMode)
+	}
+
+	snapshotBackend := os.Getenv("DETECTOR_SNAPSHOT")
+	if snapshotBackend == "" {
+		snapshotBackend = SnapshotBackendRedis
+	}
+	switch snapshotBackend {
+	case SnapshotBackendRedis, SnapshotBackendFile, SnapshotBackendOff:
+	default:
+		return nil, fmt.Errorf("unknown DETECTOR_SNAPSHOT %q", snapshotBackend)
+	}
+
+	rawRetention := getenvDuration("RAW_RETENTION", RedisTTL)
+
+	var resolutions []cache.Resolution
+	if getenvBool("ROLLUPS_ENABLED", true) {
+		for _, res := range cache.DefaultResolutions {
+			res.Retention = getenvDuration("ROLLUP_RETENTION_"+strings.ToUpper(res.Name), res.Retention)
+			resolutions = append(resolutions, res)
+		}
+	}
+
+	backend := os.Getenv("CACHE_BACKEND")
+	if backend != "" && backend != "zset" && backend != "stream" {
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q", backend)
+	}
+	migrate := getenvBool("REDIS_MIGRATE_LEGACY", false)
+
+	// connect builds the Redis-backed cache; FallbackCache calls it again
+	// from its reconnect loop if Redis is down at startup
+	connect := func() (cache.Cache, error) {
+		redisCache, err := cache.NewRedisCacheWithOptions(redisOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Redis: %w", err)
+		}
+		redisCache.SetRawRetention(rawRetention)
+		redisCache.SetResolutions(resolutions)
+
+		var store cache.Cache = redisCache
+		if backend == "stream" {
+			store = cache.NewStreamCache(redisCache, cache.StreamOptions{
+				Retention:     getenvDuration("STREAM_RETENTION", rawRetention),
+				ConsumerGroup: os.Getenv("STREAM_CONSUMER_GROUP"),
+			})
+		}
+		slog.Info("Metric history store selected", "store", fmt.Sprintf("%T", store))
+
+		if m, ok := store.(cache.Migrator); ok && migrate {
+			n, err := m.MigrateLegacy(context.Background(), DefaultSource, int64(historyMaxPoints))
+			if errors.Is(err, cache.ErrMigrationLocked) {
+				slog.Info("Legacy key migration skipped, another replica is running it")
+			} else if err != nil {
+				slog.Warn("Legacy key migration stopped", "migrated", n, "error", err)
+			} else {
+				slog.Info("Migrated legacy metric points", "migrated", n)
+			}
+		}
+		return store, nil
+	}
+
+	var policy cache.OverflowPolicy
+	if p := os.Getenv("CACHE_QUEUE_POLICY"); p != "" {
+		var err error
+		if policy, err = cache.ParseOverflowPolicy(p); err != nil {
+			return nil, fmt.Errorf("invalid CACHE_QUEUE_POLICY: %w", err)
+		}
+	}
+
+	fallback := cache.NewFallbackCache(connect, cache.FallbackOptions{
+		BufferSize:    getenvInt("CACHE_BUFFER_SIZE", 10000),
+		MinBackoff:    getenvDuration("CACHE_RECONNECT_MIN_BACKOFF", 500*time.Millisecond),
+		MaxBackoff:    getenvDuration("CACHE_RECONNECT_MAX_BACKOFF", 30*time.Second),
+		ReplayBatch:   getenvInt("CACHE_REPLAY_BATCH", 500),
+		ReplayTimeout: getenvDuration("CACHE_REPLAY_TIMEOUT", 5*time.Second),
+		TimeoutLimit:  getenvInt("CACHE_TIMEOUT_LIMIT", 3),
+		OnStateChange: func(degraded bool) {
+			if degraded {
+				m.CacheDegraded.Set(1)
+			} else {
+				m.CacheDegraded.Set(0)
+			}
+		},
+	})
+
+	var store interface {
+		cache.Cache
+		cache.Rollups
+		cache.Windows
+		cache.Getter
+	} = fallback
+	if getenvBool("CACHE_ASYNC_WRITES", true) {
+		store = cache.NewWriteBehindCache(fallback, cache.WriteBehindOptions{
+			QueueSize:     getenvInt("CACHE_QUEUE_SIZE", 10000),
+			BatchSize:     getenvInt("CACHE_BATCH_SIZE", 100),
+			FlushInterval: getenvDuration("CACHE_FLUSH_INTERVAL", 50*time.Millisecond),
+			FlushTimeout:  getenvDuration("CACHE_FLUSH_TIMEOUT", 0),
+			Policy:        policy,
+			Hooks: cache.WriteBehindHooks{
+				QueueDepth: func(n int) { m.CacheQueueDepth.Set(float64(n)) },
+				Flushed: func(batch int, elapsed time.Duration, err error) {
+					status := cacheOutcome(context.Background(), err)
+					m.CacheOperations.WithLabelValues("flush", status).Inc()
+					m.CacheFlushDuration.WithLabelValues(status).Observe(elapsed.Seconds())
+					m.CacheFlushBatchSize.Observe(float64(batch))
+				},
+				Dropped: func(p cache.OverflowPolicy) {
+					m.CacheWritesDropped.WithLabelValues(string(p)).Inc()
+				},
+			},
+		})
+	}
+
+	svc := &Service{
+		metrics:          m,
+		gatherer:         reg,
+		cache:            store,
+		rollingAvg:       analytics.NewRollingAverage(windowSize),
+		anomalyDetector:  analytics.NewAnomalyDetector(windowSize, anomalyThreshold),
+		anomalies:        anomalies.NewStore(anomalyHistorySize, store, clock.Real),
+		historyMaxPoints: int64(historyMaxPoints),
+		rollups:          store,
+		resolutions:      resolutions,
+		rawRetention:     rawRetention,
+		historyLookback:  getenvDuration("HISTORY_DEFAULT_LOOKBACK", rawRetention),
+		writeTimeout:     getenvDuration("CACHE_WRITE_TIMEOUT", 500*time.Millisecond),
+		readTimeout:      getenvDuration("CACHE_READ_TIMEOUT", 2*time.Second),
+		clock:            clock.Real,
+		logger:           slog.Default(),
+		tracer:           defaultTracer(),
+		streams:          analytics.NewStreams(windowSize, anomalyThreshold),
+		streamIdle:       getenvDuration("METRICS_SOURCE_IDLE_TIMEOUT", 10*time.Minute),
+		stop:             make(chan struct{}),
+		server:           serverOptionsFromEnv(),
+		probes: probeOptions{
+			RedisTimeout:  getenvDuration("READYZ_REDIS_TIMEOUT", 500*time.Millisecond),
+			RequireRedis:  getenvBool("READYZ_REQUIRE_REDIS", true),
+			WarmupPoints:  getenvInt("READYZ_WARMUP_POINTS", windowSize),
+			WarmupTimeout: getenvDuration("READYZ_WARMUP_TIMEOUT", time.Minute),
+		},
+	}
+	// аптайм и прогрев отсчитываются по часам сервиса
+	svc.startedAt = svc.clock.Now()
+	sourceLimit := getenvInt("METRICS_SOURCE_LIMIT", 100)
+	m.Streams.SetLimit(sourceLimit)
+	svc.streams.SetLimit(sourceLimit)
+	svc.anomalyLogs = newLogSampler(getenvInt("LOG_ANOMALY_LIMIT", 10), getenvDuration("LOG_ANOMALY_INTERVAL", time.Minute), svc.clock)
+	if detectorMode == DetectorModeShared {
+		key := os.Getenv("DETECTOR_KEY")
+		if key == "" {
+			key = "rps"
+		}
+		svc.shared = analytics.NewSharedDetector(store, key, windowSize, anomalyThreshold)
+		slog.Info("Sharing detector window through Redis", "key", key)
+	}
+
+	admin, err := adminOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	svc.admin = admin
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	shards, err := newSharder(port, m)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Redis: %w", err)
+		return nil, fmt.Errorf("invalid sharding settings: %w", err)
+	}
+	if shards != nil {
+		if svc.shardSecret, err = shardSecretFromEnv(); err != nil {
+			shards.Close()
+			return nil, err
+		}
+		svc.shards = shards
+		svc.forwardClient = &http.Client{Timeout: getenvDuration("SHARD_FORWARD_TIMEOUT", 2*time.Second)}
+		slog.Info("Sharding sources", "self", shards.Self(), "peers", len(shards.Peers()))
 	}
 
-	return &Service{
-		cache:             redisCache,
-		rollingAvg:        analytics.NewRollingAverage(windowSize),
-		anomalyDetector:   analytics.NewAnomalyDetector(windowSize, anomalyThreshold),
-		lastRPSUpdate:     time.Now(),
-		lastAnomalyUpdate: time.Now(),
-	}, nil
+	// конфигурация, изменённая через любую реплику, переживает рестарт; она
+	// применяется до снапшота, чтобы окна восстанавливались в своём размере
+	svc.syncSettingsPeriodically()
+
+	svc.snapshotOpts = snapshotOptions{
+		Interval: getenvDuration("DETECTOR_SNAPSHOT_INTERVAL", 30*time.Second),
+		MaxAge:   getenvDuration("DETECTOR_SNAPSHOT_MAX_AGE", time.Hour),
+		Timeout:  getenvDuration("DETECTOR_SNAPSHOT_TIMEOUT", 5*time.Second),
+	}
+	switch snapshotBackend {
+	case SnapshotBackendRedis:
+		key := os.Getenv("DETECTOR_SNAPSHOT_KEY")
+		if key == "" {
+			key = SnapshotKey
+		}
+		svc.snapshots = svc.newCacheSnapshots(store, key)
+	case SnapshotBackendFile:
+		path := os.Getenv("DETECTOR_SNAPSHOT_PATH")
+		if path == "" {
+			path = "detector-snapshot.json"
+		}
+		svc.snapshots = &fileSnapshots{path: path}
+	}
+	if svc.snapshots != nil {
+		if err := svc.restoreSnapshot(context.Background()); errors.Is(err, errNoSnapshot) {
+			slog.Info("No detector snapshot found, starting cold")
+		} else if err != nil {
+			slog.Warn("Detector snapshot not restored", "error", err)
+		}
+		if svc.snapshotOpts.Interval > 0 {
+			svc.every(svc.snapshotOpts.Interval, svc.saveSnapshotPeriodically)
+		}
+	}
+	if svc.streamIdle > 0 {
+		svc.every(svc.streamIdle/4, svc.pruneIdleStreams)
+	}
+	if _, ok := svc.cache.(cache.SourcePruner); ok {
+		svc.every(time.Hour, svc.pruneSources)
+	}
+	if svc.configSync = getenvDuration("CONFIG_SYNC_INTERVAL", 5*time.Second); svc.configSync > 0 {
+		svc.every(svc.configSync, svc.syncSettingsPeriodically)
+	}
+	svc.ingestRate, svc.anomalyRate = newRateCounters(svc.clock)
+	svc.every(rateUpdateInterval(), svc.updateRates)
+	return svc, nil
 }
 
 func (s *Service) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	var metric Metric
-	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+	_, span := s.startSpan(r, "decode")
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		endSpan(span, err)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &metric)
+	}
+	span.SetAttributes(attribute.Int("body.size", len(body)))
+	endSpan(span, err)
+	if err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		metrics.RequestTotal.WithLabelValues(r.Method, "/metrics", "400").Inc()
 		return
 	}
 
 	// Update timestamp if not provided
 	if metric.Timestamp == 0 {
-		metric.Timestamp = time.Now().Unix()
+		metric.Timestamp = s.clock.Now().Unix()
+	}
+	if metric.Source == "" {
+		metric.Source = DefaultSource
 	}
+	addLogFields(r, "source", metric.Source)
 
-	// Store in Redis cache
-	cacheKey := fmt.Sprintf("metric:%d", metric.Timestamp)
-	if err := s.cache.Set(cacheKey, metric, RedisTTL); err != nil {
-		log.Printf("Failed to cache metric: %v", err)
+	// Each source is analysed by the replica owning it
+	if s.shards != nil && !s.forwardedByPeer(r, body) {
+		if owner, local := s.shards.Owner(metric.Source); !local && s.forwardMetric(w, r, owner, body) {
+			return
+		}
+	}
+
+	// Store in Redis history
+	err = s.cacheOp(r, "add_point", s.writeTimeout, func(ctx context.Context) error {
+		return s.cache.AddPoint(ctx, metric.Source, time.Unix(metric.Timestamp, 0), metric, s.historyMaxPoints)
+	})
+	if err != nil {
+		s.log(r).Warn("Failed to cache metric", "error", err)
+	}
+	if s.rollups != nil && len(s.resolutions) > 0 {
+		values := map[string]float64{"cpu": metric.CPU, "rps": metric.RPS}
+		err := s.cacheOp(r, "observe", s.writeTimeout, func(ctx context.Context) error {
+			return s.rollups.Observe(ctx, metric.Source, time.Unix(metric.Timestamp, 0), values)
+		})
+		if err != nil {
+			s.log(r).Warn("Failed to update rollups", "error", err)
+		}
 	}
 
 	// Update rolling average with RPS
+	_, span = s.startSpan(r, "analytics.rolling_average")
 	s.rollingAvg.Add(metric.RPS)
 	avg := s.rollingAvg.GetAverage()
-	metrics.RollingAverageValue.Set(avg)
+	span.End()
 
 	// Update CPU metric
-	metrics.CPUMetric.Set(metric.CPU)
-
-	// Detect anomalies
-	isAnomaly := s.anomalyDetector.Add(metric.RPS)
-	if isAnomaly {
-		s.anomalyCounter++
-		metrics.AnomalyCount.Inc()
-		log.Printf("Anomaly detected: RPS=%.2f, Timestamp=%d", metric.RPS, metric.Timestamp)
+	s.metrics.CPUMetric.Set(metric.CPU)
+	_, span = s.startSpan(r, "analytics.streams")
+	decisions := s.observeStreams(metric)
+	span.End()
+
+	// Detect anomalies. Each source is judged against its own window with
+	// its own configuration; the service-wide detector only summarises all
+	// sources for /analyze. In shared mode the window of every source is
+	// the shared one, judged with the default configuration, so it decides
+	// only for sources without an override. The source windows keep
+	// deciding while the shared one is unreachable.
+	_, span = s.startSpan(r, "analytics.detector")
+	s.anomalyDetector.Evaluate(metric.RPS)
+	decision := decisions["rps"]
+	span.SetAttributes(attribute.Float64("detector.zscore", decision.ZScore), attribute.Bool("detector.anomaly", decision.IsAnomaly))
+	span.End()
+	if s.shared != nil {
+		var shared analytics.Decision
+		var stats analytics.WindowStats
+		err := s.cacheOp(r, "detector_window", s.writeTimeout, func(ctx context.Context) error {
+			var err error
+			shared, stats, err = s.shared.Evaluate(ctx, metric.RPS)
+			return err
+		})
+		if err != nil {
+			s.log(r).Warn("Shared detector unavailable, using local window", "error", err)
+		} else {
+			avg = stats.Average
+			if _, overridden := s.streams.Config(metric.Source); !overridden {
+				decision = shared
+			}
+		}
 	}
-
-	now := time.Now()
-
-	s.statsMu.Lock()
-	defer s.statsMu.Unlock()
-
-	// Update RPS counter
-	s.rpsCounter++
-	elapsed := now.Sub(s.lastRPSUpdate).Seconds()
-	if elapsed >= RPSUpdateIntervalSec {
-		currentRPS := float64(s.rpsCounter) / elapsed
-		metrics.RPSRate.Set(currentRPS)
-		s.rpsCounter = 0
-		s.lastRPSUpdate = now
+	s.metrics.RollingAverageValue.Set(avg)
+	isAnomaly := decision.IsAnomaly
+	if isAnomaly {
+		s.anomalyRate.Inc()
+		s.metrics.AnomalyCount.Inc()
+		err := s.cacheOp(r, "append_anomaly", s.writeTimeout, func(ctx context.Context) error {
+			_, err := s.anomalies.Add(ctx, anomalies.Event{
+				Timestamp: metric.Timestamp,
+				Source:    metric.Source,
+				Metric:    "rps",
+				Value:     decision.Value,
+				ZScore:    decision.ZScore,
+				Mean:      decision.Mean,
+				StdDev:    decision.StdDev,
+				Threshold: decision.Threshold,
+				Detector:  string(decision.Method),
+			})
+			return err
+		})
+		if err != nil {
+			s.log(r).Warn("Failed to record anomaly", "error", err)
+		}
+		if ok, suppressed := s.anomalyLogs.Allow(); ok {
+			s.log(r).Info("Anomaly detected",
+				"metric", "rps",
+				"value", decision.Value,
+				"zscore", decision.ZScore,
+				"mean", decision.Mean,
+				"std_dev", decision.StdDev,
+				"threshold", decision.Threshold,
+				"timestamp", metric.Timestamp,
+				"suppressed", suppressed,
+			)
+		}
 	}
 
-	// Update anomaly rate per minute
-	anomalyElapsed := now.Sub(s.lastAnomalyUpdate).Minutes()
-	if anomalyElapsed >= RPSUpdateIntervalSec {
-		anomalyRate := float64(s.anomalyCounter) / anomalyElapsed
-		metrics.AnomalyRate.Set(anomalyRate)
-		s.anomalyCounter = 0
-		s.lastAnomalyUpdate = now
-	}
+	s.ingestRate.Inc()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -160,64 +574,229 @@ func (s *Service) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		"rolling_average": avg,
 		"is_anomaly":      isAnomaly,
 	})
-
-	metrics.RequestTotal.WithLabelValues(r.Method, "/metrics", "200").Inc()
 }
 
 func (s *Service) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	if source := r.URL.Query().Get("source"); source != "" {
+		s.analyzeSource(w, source)
+		return
+	}
 	avg := s.rollingAvg.GetAverage()
 	mean, std, count := s.anomalyDetector.GetStats()
 	z, isAnomaly := s.anomalyDetector.GetLastDecision()
+	mode := DetectorModeLocal
+
+	if s.shared != nil {
+		var stats analytics.WindowStats
+		err := s.cacheOp(r, "detector_window", s.readTimeout, func(ctx context.Context) error {
+			var err error
+			stats, err = s.shared.Stats(ctx)
+			return err
+		})
+		if err != nil {
+			s.log(r).Warn("Shared detector unavailable, reporting local window", "error", err)
+		} else {
+			avg, mean, std, count = stats.Average, stats.Average, stats.StdDev, stats.Count
+			z, isAnomaly = stats.LastZ, stats.LastIsAnomaly
+			mode = DetectorModeShared
+		}
+	}
 
+	cfg := s.anomalyDetector.Config()
 	response := map[string]interface{}{
 		"rolling_average": avg,
 		"anomaly_stats": map[string]interface{}{
 			"mean":        mean,
 			"std_dev":     std,
-			"threshold":   s.anomalyDetector.GetThreshold(),
-			"window_size": s.anomalyDetector.GetWindowSize(),
+			"threshold":   cfg.Threshold,
+			"window_size": cfg.WindowSize,
+			"detector":    cfg.Method,
 			"data_points": count,
 			"last_zscore": z,
 			"is_anomaly":  isAnomaly,
+			"mode":        mode,
 		},
 	}
+	if overrides := s.streams.Overrides(); len(overrides) > 0 {
+		response["source_overrides"] = overrides
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Service) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := anomalies.Query{
+		Source:   params.Get("source"),
+		Severity: params.Get("severity"),
+		Cursor:   params.Get("cursor"),
+	}
+
+	var err error
+	if q.From, err = parseInt64Param(params.Get("from")); err != nil {
+		writeBadRequest(w, "invalid from")
+		return
+	}
+	if q.To, err = parseInt64Param(params.Get("to")); err != nil {
+		writeBadRequest(w, "invalid to")
+		return
+	}
+	limit, err := parseInt64Param(params.Get("limit"))
+	if err != nil || limit < 0 {
+		writeBadRequest(w, "invalid limit")
+		return
+	}
+	q.Limit = int(limit)
+	if q.Limit == 0 {
+		q.Limit = 100
+	}
+	if q.Severity != "" && !anomalies.ValidSeverity(q.Severity) {
+		writeBadRequest(w, "invalid severity")
+		return
+	}
+
+	var page anomalies.Page
+	err = s.cacheOp(r, "query_anomalies", s.readTimeout, func(ctx context.Context) error {
+		var err error
+		page, err = s.anomalies.Query(ctx, q)
+		return err
+	})
+	if errors.Is(err, anomalies.ErrInvalidCursor) {
+		writeBadRequest(w, err.Error())
+		return
+	}
+	if err != nil {
+		writeCacheError(w, r, "/anomalies", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseInt64Param(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func writeBadRequest(w http.ResponseWriter, msg string) {
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+// cacheOp runs one cache operation under the request context, bounded by
+// timeout (0 = no deadline), and counts its outcome
+func (s *Service) cacheOp(r *http.Request, op string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	spanCtx, span := s.startSpan(r, "cache."+op, attribute.String("cache.operation", op))
+	ctx, cancel := context.WithCancel(spanCtx)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(spanCtx, timeout)
+	}
+	defer cancel()
+
+	err := fn(ctx)
+	outcome := cacheOutcome(ctx, err)
+	s.metrics.CacheOperations.WithLabelValues(op, outcome).Inc()
+	span.SetAttributes(attribute.String("cache.outcome", outcome))
+	endSpan(span, err)
+	return err
+}
 
-	metrics.RequestTotal.WithLabelValues(r.Method, "/analyze", "200").Inc()
+// cacheOutcome classifies the result of a cache operation as ok, timeout,
+// canceled (the client went away) or error
+func cacheOutcome(ctx context.Context, err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled) {
+		return "canceled"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	return "error"
+}
+
+// writeCacheError answers a request whose cache read failed: 504 when the
+// deadline ran out, 503 otherwise
+func writeCacheError(w http.ResponseWriter, r *http.Request, endpoint string, err error) {
+	requestLogger(r.Context(), slog.Default()).Warn("Cache read failed", "endpoint", endpoint, "error", err)
+	status, msg := http.StatusServiceUnavailable, "cache unavailable"
+	if cacheOutcome(r.Context(), err) == "timeout" {
+		status, msg = http.StatusGatewayTimeout, "cache timeout"
+	}
+	http.Error(w, msg, status)
 }
 
 func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status, cacheStatus := "ok", "ok"
+	if d, ok := s.cache.(interface{ Degraded() bool }); ok && d.Degraded() {
+		status, cacheStatus = "degraded", "degraded"
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "ok",
+		"status":  status,
+		"cache":   cacheStatus,
 		"version": ServiceVersion,
 	})
-	metrics.RequestTotal.WithLabelValues(r.Method, "/health", "200").Inc()
 }
 
 func (s *Service) setupRoutes() *mux.Router {
 	r := mux.NewRouter()
+	// trace comes first so that logs and exemplars carry the trace id;
+	// instrument and accessLog wrap recoverPanics so that recovered panics
+	// count and are logged as 500
+	r.Use(s.trace, s.accessLog, s.instrument, s.recoverPanics)
 
 	// Metrics endpoint for Prometheus
-	r.Path("/metrics").Methods("GET").Handler(promhttp.Handler())
+	r.Path("/metrics").Methods("GET").Handler(promhttp.HandlerFor(s.gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
 
 	// API endpoints
-	r.HandleFunc("/metrics", s.handleMetrics).Methods("POST")
+	r.HandleFunc("/metrics", limitBody(s.server.MaxMetricBytes, s.handleMetrics)).Methods("POST")
+	r.HandleFunc("/metrics/history", s.handleHistory).Methods("GET")
 	r.HandleFunc("/analyze", s.handleAnalyze).Methods("GET")
+	r.HandleFunc("/anomalies", s.handleAnomalies).Methods("GET")
 	r.HandleFunc("/health", s.handleHealth).Methods("GET")
+	r.HandleFunc("/livez", s.handleLivez).Methods("GET")
+	r.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	r.HandleFunc("/ready", s.handleReadyz).Methods("GET")
 
 	return r
 }
 
 func main() {
-	service, err := NewService()
+	logger, err := newLogger(os.Stderr)
 	if err != nil {
-		log.Fatalf("Failed to initialize service: %v", err)
+		fmt.Fprintf(os.Stderr, "Failed to configure logging: %v\n", err)
+		os.Exit(1)
 	}
-	defer service.cache.Close()
+	// log.Printf сторонних библиотек тоже идёт через этот логгер
+	slog.SetDefault(logger)
 
+	tp, err := newTracerProvider(context.Background())
+	if err != nil {
+		slog.Error("Failed to configure tracing", "error", err)
+		os.Exit(1)
+	}
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+		slog.Info("Exporting traces over OTLP")
+	}
+	otel.SetTextMapPropagator(propagator)
+
+	service, err := NewService()
+	if err != nil {
+		slog.Error("Failed to initialize service", "error", err)
+		os.Exit(1)
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -225,18 +804,77 @@ func main() {
 
 	router := service.setupRoutes()
 
-	log.Printf("Starting server on port %s", port)
-	if err := http.ListenAndServe(":"+port, router); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	srv := newHTTPServer(":"+port, router, service.server)
+	shutdown := shutdownOptions{
+		DrainPeriod: getenvDuration("SHUTDOWN_DRAIN_PERIOD", 5*time.Second),
+		Timeout:     getenvDuration("SHUTDOWN_TIMEOUT", 25*time.Second),
+	}
+
+	slog.Info("Starting server", "port", port, "version", ServiceVersion)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	// админский листенер не выходит за пределы пода и работает до конца остановки
+	var adminSrv *http.Server
+	if service.admin.Addr != "" {
+		adminSrv = newAdminServer(service.admin, service.adminRoutes())
+		slog.Info("Starting admin server", "addr", service.admin.Addr)
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Admin server failed", "error", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		service.Close()
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
+	case s := <-sig:
+		slog.Info("Shutting down", "signal", s.String())
+	}
+	// второй сигнал завершает процесс сразу
+	signal.Stop(sig)
+
+	err = service.Shutdown(srv, shutdown)
+	if adminSrv != nil {
+		adminSrv.Close()
+	}
+	if tp != nil {
+		// оставшиеся спаны отправляются после остановки сервиса
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+		cancel()
+	}
+	if err != nil {
+		slog.Error("Shutdown incomplete", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("Shutdown complete")
 }
 
 func NewTestService() *Service {
-	return &Service{
-		rollingAvg:        analytics.NewRollingAverage(50),
-		anomalyDetector:   analytics.NewAnomalyDetector(50, 2.0),
-		cache:             newTestCache(),
-		lastRPSUpdate:     time.Now(),
-		lastAnomalyUpdate: time.Now(),
+	reg := prometheus.NewRegistry()
+	s := &Service{
+		metrics:          metrics.New(reg, ServiceVersion),
+		gatherer:         reg,
+		rollingAvg:       analytics.NewRollingAverage(50),
+		anomalyDetector:  analytics.NewAnomalyDetector(50, 2.0),
+		anomalies:        anomalies.NewStore(1000, nil, clock.Real),
+		historyMaxPoints: 100000,
+		cache:            newTestCache(),
+		logger:           slog.Default(),
+		tracer:           defaultTracer(),
+		clock:            clock.Real,
+		ingestRate:       analytics.NewRateCounter(10*time.Second, time.Second, nil),
+		anomalyRate:      analytics.NewRateCounter(5*time.Minute, time.Second, nil),
+		streams:          analytics.NewStreams(50, 2.0),
 	}
+	s.startedAt = s.clock.Now()
+	return s
 }
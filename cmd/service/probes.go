@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/highload-service/internal/cache"
+)
+
+// probeOptions configures the readiness checks
+type probeOptions struct {
+	RedisTimeout time.Duration // deadline of the Redis ping (default 500ms)
+	// RequireRedis makes an unreachable Redis fail readiness; otherwise the
+	// replica stays in rotation and serves from the in-memory fallback
+	RequireRedis bool
+	// WarmupPoints is how many values the detector needs before the replica
+	// is ready (0 disables the check)
+	WarmupPoints int
+	// WarmupTimeout ends the warm-up wait after start, so that a cold replica
+	// which gets traffic only once ready does not stay unready forever
+	WarmupTimeout time.Duration
+}
+
+// probeCheck is the outcome of a single readiness check
+type probeCheck struct {
+	Status  string                 `json:"status"` // ok, fail or degraded
+	Error   string                 `json:"error,omitempty"`
+	Latency string                 `json:"latency,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (s *Service) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"version": ServiceVersion,
+		"uptime":  s.clock.Now().Sub(s.startedAt).Round(time.Second).String(),
+	})
+}
+
+// handleReadyz reports whether the replica should receive traffic, with the
+// outcome of every check
+func (s *Service) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]probeCheck{
+		"redis":    s.checkRedis(r.Context()),
+		"detector": s.checkDetector(),
+		"draining": s.checkDraining(),
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, c := range checks {
+		if c.Status == "fail" {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func (s *Service) checkRedis(ctx context.Context) probeCheck {
+	p, ok := s.cache.(cache.Pinger)
+	if !ok {
+		return probeCheck{Status: "ok", Details: map[string]interface{}{"ping": "not supported"}}
+	}
+	timeout := s.probes.RedisTimeout
+	if timeout <= 0 {
+		timeout = 500 * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := p.Ping(ctx)
+	c := probeCheck{Status: "ok", Latency: time.Since(start).String()}
+	if err != nil {
+		c.Status, c.Error = "degraded", err.Error()
+		if s.probes.RequireRedis {
+			c.Status = "fail"
+		}
+	}
+	return c
+}
+
+func (s *Service) checkDetector() probeCheck {
+	_, _, count := s.anomalyDetector.GetStats()
+	c := probeCheck{Status: "ok", Details: map[string]interface{}{
+		"data_points": count,
+		"required":    s.probes.WarmupPoints,
+	}}
+	if count >= s.probes.WarmupPoints {
+		return c
+	}
+	if s.probes.WarmupTimeout > 0 && s.clock.Now().Sub(s.startedAt) >= s.probes.WarmupTimeout {
+		c.Details["warmup_timeout"] = "expired"
+		return c
+	}
+	c.Status, c.Error = "fail", "detector window is warming up"
+	return c
+}
+
+func (s *Service) checkDraining() probeCheck {
+	if s.Draining() {
+		return probeCheck{Status: "fail", Error: "shutting down"}
+	}
+	return probeCheck{Status: "ok"}
+}
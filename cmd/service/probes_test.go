@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/highload-service/internal/cache"
+)
+
+type readyzResponse struct {
+	Status string                `json:"status"`
+	Checks map[string]probeCheck `json:"checks"`
+}
+
+func getReadyz(t *testing.T, h http.Handler) (int, readyzResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var out readyzResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("failed to decode /readyz: %v", err)
+	}
+	return rec.Code, out
+}
+
+func TestReadyzRedisCheck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	fallback := cache.NewFallbackCache(func() (cache.Cache, error) {
+		return cache.NewRedisCache(mr.Addr(), "", 0)
+	}, cache.FallbackOptions{MinBackoff: time.Hour})
+	defer fallback.Close()
+
+	s := newTestService()
+	s.cache = fallback
+	s.probes = probeOptions{RedisTimeout: 200 * time.Millisecond, RequireRedis: true}
+	routes := s.setupRoutes()
+
+	code, out := getReadyz(t, routes)
+	if code != http.StatusOK || out.Checks["redis"].Status != "ok" {
+		t.Fatalf("expected ready with Redis up, got %d %+v", code, out)
+	}
+
+	mr.Close()
+	code, out = getReadyz(t, routes)
+	if code != http.StatusServiceUnavailable || out.Status != "fail" || out.Checks["redis"].Error == "" {
+		t.Fatalf("expected unready with Redis down, got %d %+v", code, out)
+	}
+	if out.Checks["detector"].Status != "ok" || out.Checks["draining"].Status != "ok" {
+		t.Fatalf("expected only the Redis check to fail, got %+v", out.Checks)
+	}
+
+	// без обязательного Redis под остаётся в ротации и работает из памяти
+	s.probes.RequireRedis = false
+	code, out = getReadyz(t, routes)
+	if code != http.StatusOK || out.Checks["redis"].Status != "degraded" {
+		t.Fatalf("expected ready and degraded, got %d %+v", code, out)
+	}
+}
+
+func TestReadyzDetectorWarmup(t *testing.T) {
+	s := newTestService()
+	s.probes = probeOptions{WarmupPoints: 5, WarmupTimeout: time.Hour}
+	routes := s.setupRoutes()
+
+	if code, out := getReadyz(t, routes); code != http.StatusServiceUnavailable || out.Checks["detector"].Status != "fail" {
+		t.Fatalf("expected a cold detector to be unready, got %d %+v", code, out)
+	}
+	warmUp(s, 5)
+	if code, _ := getReadyz(t, routes); code != http.StatusOK {
+		t.Fatalf("expected a warm detector to be ready, got %d", code)
+	}
+
+	cold := newTestService()
+	clk := useFakeClock(cold, time.Unix(1000, 0))
+	cold.probes = probeOptions{WarmupPoints: 5, WarmupTimeout: time.Minute}
+	coldRoutes := cold.setupRoutes()
+	clk.Advance(time.Minute - time.Second)
+	if code, _ := getReadyz(t, coldRoutes); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a cold detector to be unready before the timeout, got %d", code)
+	}
+	clk.Advance(time.Second)
+	if code, out := getReadyz(t, coldRoutes); code != http.StatusOK || out.Checks["detector"].Details["warmup_timeout"] != "expired" {
+		t.Fatalf("expected the warm-up wait to end, got %d %+v", code, out)
+	}
+}
+
+func TestReadyzDraining(t *testing.T) {
+	s := newTestService()
+	s.draining.Store(true)
+	code, out := getReadyz(t, s.setupRoutes())
+	if code != http.StatusServiceUnavailable || out.Checks["draining"].Status != "fail" {
+		t.Fatalf("expected unready while draining, got %d %+v", code, out)
+	}
+}
+
+func TestLivez(t *testing.T) {
+	s := newTestService()
+	s.draining.Store(true)
+	rec := httptest.NewRecorder()
+	s.setupRoutes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the process to be live while draining, got %d", rec.Code)
+	}
+}
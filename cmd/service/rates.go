@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/clock"
+)
+
+// newRateCounters creates the ingest and anomaly rate counters from
+// INGEST_RATE_WINDOW, ANOMALY_RATE_WINDOW and RATE_BUCKET
+func newRateCounters(clk clock.Clock) (ingest, anomaly *analytics.RateCounter) {
+	bucket := getenvDuration("RATE_BUCKET", time.Second)
+	ingest = analytics.NewRateCounter(getenvDuration("INGEST_RATE_WINDOW", 10*time.Second), bucket, clk)
+	anomaly = analytics.NewRateCounter(getenvDuration("ANOMALY_RATE_WINDOW", 5*time.Minute), bucket, clk)
+	return ingest, anomaly
+}
+
+// rateUpdateInterval returns RATE_UPDATE_INTERVAL. The rates cannot be
+// switched off, so a value that is not positive falls back to the default.
+func rateUpdateInterval() time.Duration {
+	d := getenvDuration("RATE_UPDATE_INTERVAL", time.Second)
+	if d <= 0 {
+		slog.Warn("RATE_UPDATE_INTERVAL must be positive, using the default", "value", d)
+		return time.Second
+	}
+	return d
+}
+
+// updateRates publishes the current rates; it runs on a ticker, so the
+// gauges decay to zero when traffic stops
+func (s *Service) updateRates() {
+	s.metrics.RPSRate.Set(s.ingestRate.Rate(time.Second))
+	s.metrics.AnomalyRate.Set(s.anomalyRate.Rate(time.Minute))
+}
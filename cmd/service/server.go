@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// serverOptions configures the HTTP server
+type serverOptions struct {
+	// ReadHeaderTimeout bounds reading the request headers, which is what a
+	// slowloris client stretches out
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// MaxMetricBytes limits the body of POST /metrics
+	MaxMetricBytes int64
+}
+
+func serverOptionsFromEnv() serverOptions {
+	return serverOptions{
+		ReadHeaderTimeout: getenvDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       getenvDuration("HTTP_READ_TIMEOUT", 10*time.Second),
+		WriteTimeout:      getenvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       getenvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    getenvInt("HTTP_MAX_HEADER_BYTES", 64<<10),
+		MaxMetricBytes:    int64(getenvInt("HTTP_MAX_METRIC_BYTES", 64<<10)),
+	}
+}
+
+// newHTTPServer creates a server for handler with the configured timeouts
+func newHTTPServer(addr string, handler http.Handler, opts serverOptions) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+}
+
+// limitBody caps the request body of h at n bytes (n <= 0 disables the
+// limit); reading past it fails with *http.MaxBytesError
+func limitBody(n int64, h http.HandlerFunc) http.HandlerFunc {
+	if n <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h(w, r)
+	}
+}
+
+// recoverPanics turns a panicking handler into a JSON 500 and counts it,
+// instead of dropping the connection
+func (s *Service) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// net/http прерывает ответ этим значением намеренно
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			s.log(r).Error("Panic serving request", "path", r.URL.Path, "panic", p, "stack", string(debug.Stack()))
+			s.metrics.HTTPPanics.WithLabelValues(routeTemplate(r)).Inc()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRejectsOversizedBody(t *testing.T) {
+	s := newTestService()
+	s.server.MaxMetricBytes = 1024
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	body := `{"timestamp":1,"rps":100,"source":"` + strings.Repeat("x", 2048) + `"}`
+	resp, err := http.Post(ts.URL+"/metrics", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", resp.StatusCode)
+	}
+	if _, _, count := s.anomalyDetector.GetStats(); count != 0 {
+		t.Fatalf("expected the oversized metric to be dropped")
+	}
+
+	resp, err = http.Post(ts.URL+"/metrics", "application/json", strings.NewReader(`{"timestamp":1,"rps":100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a small metric to pass, got %d", resp.StatusCode)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	s := newTestService()
+	routes := s.setupRoutes()
+	routes.HandleFunc("/boom/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom/1", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	var out map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil || out["error"] == "" {
+		t.Fatalf("expected a JSON error body, got %q (%v)", rec.Body.String(), err)
+	}
+	if got := testutil.ToFloat64(s.metrics.HTTPPanics.WithLabelValues("/boom/{id}")); got != 1 {
+		t.Fatalf("expected the panic to be counted by route template")
+	}
+}
+
+// startHardenedServer serves the service routes with the given timeouts
+func startHardenedServer(t *testing.T, opts serverOptions) string {
+	t.Helper()
+	s := newTestService()
+	s.server = opts
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer("", s.setupRoutes(), opts)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// waitClosed reads from conn until the server closes it and returns how long
+// that took
+func waitClosed(t *testing.T, conn net.Conn) time.Duration {
+	t.Helper()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("server kept a slow connection open")
+	}
+	return time.Since(start)
+}
+
+func TestSlowlorisHeadersAreCutOff(t *testing.T) {
+	addr := startHardenedServer(t, serverOptions{ReadHeaderTimeout: 100 * time.Millisecond, ReadTimeout: time.Second})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// заголовки приходят по кусочку и никогда не заканчиваются
+	conn.Write([]byte("POST /metrics HTTP/1.1\r\nHost: test\r\n"))
+	go func() {
+		for i := 0; i < 20; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := conn.Write([]byte("X-Slow: 1\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	if took := waitClosed(t, conn); took > time.Second {
+		t.Fatalf("expected the connection to be closed at the header deadline, took %v", took)
+	}
+}
+
+func TestSlowBodyIsCutOff(t *testing.T) {
+	addr := startHardenedServer(t, serverOptions{ReadHeaderTimeout: time.Second, ReadTimeout: 200 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST /metrics HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: 1000\r\n\r\n{"))
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("expected an incomplete body to be rejected")
+		}
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("server kept waiting for a slow body")
+	}
+}
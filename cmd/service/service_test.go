@@ -2,49 +2,61 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"sync"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/anomalies"
 	"github.com/highload-service/internal/cache"
+	"github.com/highload-service/internal/clock"
+	"github.com/highload-service/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
-type memCache struct {
-	mu sync.Mutex
-	m  map[string][]byte
-}
-
-func newMemCache() *memCache {
-	return &memCache{m: make(map[string][]byte)}
-}
-
-func (c *memCache) Set(key string, value interface{}, ttl time.Duration) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	b, err := json.Marshal(value)
-	if err != nil {
-		return err
+func newTestService() *Service {
+	reg := prometheus.NewRegistry()
+	s := &Service{
+		metrics:          metrics.New(reg, ServiceVersion),
+		gatherer:         reg,
+		cache:            cache.NewMemoryCache(100000),
+		rollingAvg:       analytics.NewRollingAverage(50),
+		anomalyDetector:  analytics.NewAnomalyDetector(50, 2.0),
+		anomalies:        anomalies.NewStore(1000, nil, clock.Real),
+		historyMaxPoints: 100000,
+		clock:            clock.Real,
+		logger:           slog.Default(),
+		tracer:           defaultTracer(),
+		ingestRate:       analytics.NewRateCounter(10*time.Second, time.Second, nil),
+		anomalyRate:      analytics.NewRateCounter(5*time.Minute, time.Second, nil),
+		streams:          analytics.NewStreams(50, 2.0),
 	}
-	c.m[key] = b
-	return nil
+	s.startedAt = s.clock.Now()
+	return s
 }
 
-func (c *memCache) Close() error { return nil }
-
-var _ cache.Cache = (*memCache)(nil)
-
-func newTestService() *Service {
-	return &Service{
-		cache:             newMemCache(),
-		rollingAvg:        analytics.NewRollingAverage(50),
-		anomalyDetector:   analytics.NewAnomalyDetector(50, 2.0),
-		lastRPSUpdate:     time.Now(),
-		lastAnomalyUpdate: time.Now(),
-	}
+// useFakeClock switches s to a fake clock set to now, as if the service
+// had started on it
+func useFakeClock(s *Service, now time.Time) *clock.Fake {
+	clk := clock.NewFake(now)
+	s.clock = clk
+	s.startedAt = clk.Now()
+	s.anomalies = anomalies.NewStore(1000, nil, clk)
+	s.ingestRate = analytics.NewRateCounter(10*time.Second, time.Second, clk)
+	s.anomalyRate = analytics.NewRateCounter(time.Minute, time.Second, clk)
+	return clk
 }
 
 func TestHealth(t *testing.T) {
@@ -130,3 +142,521 @@ func itoa(x int64) string {
 	}
 	return sign + string(buf[i:])
 }
+
+func TestAnomaliesHistory(t *testing.T) {
+	s := newTestService()
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	for i := 1; i <= 50; i++ {
+		body := []byte(`{"timestamp":` + itoa(int64(i)) + `,"source":"web-1","cpu":20,"rps":100}`)
+		resp, err := http.Post(ts.URL+"/metrics", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Post(ts.URL+"/metrics", "application/json",
+		bytes.NewReader([]byte(`{"timestamp":999,"source":"web-1","cpu":95,"rps":2000}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/anomalies?source=web-1&from=900&to=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var page anomalies.Page
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 1 {
+		t.Fatalf("expected 1 anomaly event, got %d", len(page.Events))
+	}
+	e := page.Events[0]
+	if e.Timestamp != 999 || e.Value != 2000 || e.Metric != "rps" || e.Detector != DetectorZScore {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	resp2, err := http.Get(ts.URL + "/anomalies?severity=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid severity, got %d", resp2.StatusCode)
+	}
+}
+
+func TestMetricsHistory(t *testing.T) {
+	s := newTestService()
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	for i := int64(100); i < 106; i++ {
+		for _, src := range []string{"web-1", "web-2"} {
+			body := []byte(`{"timestamp":` + itoa(i) + `,"source":"` + src + `","cpu":` + itoa(i-90) + `,"rps":` + itoa(i) + `}`)
+			resp, err := http.Post(ts.URL+"/metrics", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics/history?from=101&to=104&source=web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Points []HistoryPoint `json:"points"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Points) != 4 || out.Points[0].Timestamp != 101 || out.Points[3].Timestamp != 104 {
+		t.Fatalf("expected points 101..104, got %+v", out.Points)
+	}
+	for _, p := range out.Points {
+		if p.Source != "web-1" {
+			t.Fatalf("expected only web-1 points, got %+v", p)
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics/history?from=100&to=105&source=web-2&step=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// бакеты [99..101] и [102..104] и [105]
+	if len(out.Points) != 3 || out.Points[0].Count != 2 || out.Points[0].RPS != 100.5 || out.Points[1].Timestamp != 102 {
+		t.Fatalf("unexpected downsampled points: %+v", out.Points)
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics/history?from=100&to=100&format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("expected text/csv, got %q", ct)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	want := "timestamp,source,cpu,rps,count\n100,web-1,10,100,1\n100,web-2,10,100,1\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected csv:\n%s", buf.String())
+	}
+}
+
+func TestChooseResolution(t *testing.T) {
+	s := newTestService()
+	s.rollups = newTestCache()
+	s.resolutions = cache.DefaultResolutions
+	s.rawRetention = 5 * time.Minute
+	now := time.Unix(1_700_000_000, 0)
+	useFakeClock(s, now)
+
+	cases := []struct {
+		name     string
+		from     time.Time
+		step     time.Duration
+		wantRaw  bool
+		wantName string
+	}{
+		{"recent range is served raw", now.Add(-2 * time.Minute), 0, true, ""},
+		{"coarse step uses rollups", now.Add(-2 * time.Minute), time.Minute, false, "1m"},
+		{"at the raw retention edge", now.Add(-5 * time.Minute), 0, true, ""},
+		{"just past raw retention", now.Add(-5*time.Minute - time.Second), 0, false, "1m"},
+		{"older than raw retention", now.Add(-3 * time.Hour), 0, false, "1m"},
+		{"too many minute buckets", now.Add(-20 * time.Hour), 0, false, "5m"},
+		{"beyond 5m retention", now.Add(-10 * 24 * time.Hour), 0, false, "1h"},
+	}
+	for _, tc := range cases {
+		res, raw, err := s.chooseResolution("", tc.from, time.Time{}, tc.step)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if raw != tc.wantRaw || (!raw && res.Name != tc.wantName) {
+			t.Fatalf("%s: expected raw=%v res=%q, got raw=%v res=%q", tc.name, tc.wantRaw, tc.wantName, raw, res.Name)
+		}
+	}
+
+	if _, _, err := s.chooseResolution("2m", now, time.Time{}, 0); err == nil {
+		t.Fatalf("expected error for unknown resolution")
+	}
+}
+
+func TestHealthReportsDegradedCache(t *testing.T) {
+	s := newTestService()
+	fallback := cache.NewFallbackCache(func() (cache.Cache, error) {
+		return nil, errors.New("connection refused")
+	}, cache.FallbackOptions{MinBackoff: time.Hour})
+	defer fallback.Close()
+	s.cache = fallback
+
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/metrics", "application/json",
+		bytes.NewReader([]byte(`{"timestamp":1,"cpu":20,"rps":100}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected ingest to keep working in degraded mode, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out["status"] != "degraded" || out["cache"] != "degraded" {
+		t.Fatalf("expected degraded health, got %v", out)
+	}
+}
+
+func TestMetricsHistoryBoundsTheRead(t *testing.T) {
+	s := newTestService()
+	mem := cache.NewMemoryCache(100)
+	s.cache = mem
+	s.historyMaxPoints = 3
+	s.historyLookback = time.Minute
+	now := time.Unix(10000, 0)
+	s.clock = clock.NewFake(now)
+
+	ctx := context.Background()
+	for _, ts := range []time.Time{now.Add(-time.Hour), now.Add(-40 * time.Second), now.Add(-30 * time.Second), now.Add(-20 * time.Second), now.Add(-10 * time.Second)} {
+		mem.AddPoint(ctx, "web-1", ts, Metric{Timestamp: ts.Unix(), RPS: 1}, 0)
+	}
+
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		From      int64          `json:"from"`
+		Truncated bool           `json:"truncated"`
+		Points    []HistoryPoint `json:"points"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// без from читается последняя минута, и не больше historyMaxPoints точек
+	if out.From != now.Add(-time.Minute).Unix() || !out.Truncated || resp.Header.Get("X-History-Truncated") != "true" {
+		t.Fatalf("expected a truncated read of the last minute, got from=%d truncated=%v", out.From, out.Truncated)
+	}
+	if len(out.Points) != 3 || out.Points[0].Timestamp != now.Add(-40*time.Second).Unix() {
+		t.Fatalf("expected the first 3 points of the last minute, got %+v", out.Points)
+	}
+}
+
+// slowCache blocks point reads until the caller gives up
+type slowCache struct {
+	*cache.MemoryCache
+}
+
+func (c slowCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]cache.Point, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c slowCache) RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]cache.Point, error) {
+	return c.RangePoints(ctx, source, from, to)
+}
+
+func TestHistoryTimesOutOnSlowCache(t *testing.T) {
+	s := newTestService()
+	s.cache = slowCache{cache.NewMemoryCache(10)}
+	s.readTimeout = 20 * time.Millisecond
+
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/metrics/history?resolution=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("request should end at the read deadline, took %v", elapsed)
+	}
+	if got := testutil.ToFloat64(s.metrics.CacheOperations.WithLabelValues("range_points", "timeout")); got != 1 {
+		t.Fatalf("expected the timeout to be counted, got %v", got)
+	}
+}
+
+func TestCacheOutcome(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{context.Background(), nil, "ok"},
+		{context.Background(), errors.New("connection refused"), "error"},
+		{context.Background(), context.DeadlineExceeded, "timeout"},
+		{context.Background(), &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{canceled, errors.New("redis: connection closed"), "canceled"},
+	}
+	for _, tc := range cases {
+		if got := cacheOutcome(tc.ctx, tc.err); got != tc.want {
+			t.Errorf("cacheOutcome(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestSharedDetectorAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var replicas []*httptest.Server
+	for i := 0; i < 2; i++ {
+		rc, err := cache.NewRedisCache(mr.Addr(), "", 0)
+		if err != nil {
+			t.Fatalf("failed to connect to miniredis: %v", err)
+		}
+		defer rc.Close()
+		s := newTestService()
+		s.shared = analytics.NewSharedDetector(rc, "rps", 50, 2.0)
+		ts := httptest.NewServer(s.setupRoutes())
+		defer ts.Close()
+		replicas = append(replicas, ts)
+	}
+
+	// балансировщик раскидывает поток по репликам поровну
+	for i := 1; i <= 50; i++ {
+		body := []byte(`{"timestamp":` + itoa(int64(i)) + `,"cpu":20,"rps":100}`)
+		resp, err := http.Post(replicas[i%2].URL+"/metrics", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Post(replicas[0].URL+"/metrics", "application/json",
+		bytes.NewReader([]byte(`{"timestamp":999,"cpu":95,"rps":2000}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var posted map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&posted)
+	resp.Body.Close()
+	if posted["is_anomaly"] != true {
+		t.Fatalf("expected the spike to be an anomaly, got %v", posted)
+	}
+
+	resp, err = http.Get(replicas[1].URL + "/analyze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Stats map[string]interface{} `json:"anomaly_stats"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	if out.Stats["mode"] != DetectorModeShared || out.Stats["data_points"] != float64(50) || out.Stats["is_anomaly"] != true {
+		t.Fatalf("expected the other replica to report the shared window, got %v", out.Stats)
+	}
+}
+
+func TestSharedDetectorKeepsOverridesLocal(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rc, err := cache.NewRedisCache(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	defer rc.Close()
+	s := newTestService()
+	s.shared = analytics.NewSharedDetector(rc, "rps", 50, 2.0)
+	h := s.setupRoutes()
+
+	post := func(source string, rps float64) bool {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"timestamp":1,"source":%q,"rps":%v}`, source, rps)
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/metrics", strings.NewReader(body)))
+		var resp map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp["is_anomaly"] == true
+	}
+	for i := 0; i < 30; i++ {
+		post("api", 1000+float64(i%3))
+	}
+	// окно web ведётся только локально и лежит далеко от общего
+	warmUpSource(s, "web", 30)
+	s.streams.SetOverrides(map[string]analytics.DetectorConfig{"web": {Method: analytics.MethodZScore, WindowSize: 50, Threshold: 3}})
+
+	if post("web", 101) {
+		t.Fatal("expected web with an override to be judged by its own window")
+	}
+	if !post("api", 2000) {
+		t.Fatal("expected sources without an override to be judged by the shared window")
+	}
+}
+
+func TestPrometheusEndpointServesServiceRegistry(t *testing.T) {
+	a, b := newTestService(), newTestService()
+	ts := httptest.NewServer(a.setupRoutes())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/metrics", "application/json", bytes.NewReader([]byte(`{"timestamp":1,"rps":100}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := testutil.ToFloat64(b.metrics.RequestTotal.WithLabelValues("POST", "/metrics", "200")); got != 0 {
+		t.Fatalf("expected services in one process to keep separate metrics, got %v", got)
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	for _, want := range []string{`http_requests_total{endpoint="/metrics",method="POST",status="200"} 1`, "build_info{"} {
+		if !bytes.Contains(body.Bytes(), []byte(want)) {
+			t.Fatalf("expected %q in /metrics output", want)
+		}
+	}
+}
+
+func TestStreamSeriesPerSource(t *testing.T) {
+	s := newTestService()
+	clk := useFakeClock(s, time.Unix(1000, 0))
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	for _, body := range []string{
+		`{"timestamp":1,"source":"web","rps":100,"cpu":10}`,
+		`{"timestamp":1,"source":"api","rps":20,"cpu":50}`,
+	} {
+		resp, err := http.Post(ts.URL+"/metrics", "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	out.ReadFrom(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`stream_rolling_average{metric="rps",source="web"} 100`,
+		`stream_rolling_average{metric="cpu",source="api"} 50`,
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Fatalf("expected %q in /metrics output", want)
+		}
+	}
+
+	// источники, переставшие присылать метрики, удаляются вместе с сериями
+	s.streamIdle = time.Minute
+	clk.Advance(time.Minute + time.Second)
+	s.pruneIdleStreams()
+	if s.streams.Len() != 0 || s.metrics.Streams.Sources() != 0 {
+		t.Fatalf("expected idle streams to be pruned, got %d streams and %d sources", s.streams.Len(), s.metrics.Streams.Sources())
+	}
+}
+
+func TestRatesDecayWithoutTraffic(t *testing.T) {
+	s := newTestService()
+	clk := useFakeClock(s, time.Unix(1000, 0))
+	s.stop = make(chan struct{})
+	updated := make(chan struct{})
+	s.every(time.Second, func() {
+		s.updateRates()
+		updated <- struct{}{}
+	})
+	defer s.Close()
+	routes := s.setupRoutes()
+
+	for i := 0; i < 20; i++ {
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/metrics", bytes.NewReader([]byte(`{"timestamp":1,"rps":100}`))))
+		clk.Advance(500 * time.Millisecond)
+		if i%2 == 1 {
+			<-updated
+		}
+	}
+	if got := testutil.ToFloat64(s.metrics.RPSRate); got != 2 {
+		t.Fatalf("expected 2 metrics/s, got %v", got)
+	}
+
+	// без запросов метрика обновляется по тикеру и падает до нуля
+	for i := 0; i < 10; i++ {
+		clk.Advance(time.Second)
+		<-updated
+	}
+	if got := testutil.ToFloat64(s.metrics.RPSRate); got != 0 {
+		t.Fatalf("expected rate to drop to 0 without traffic, got %v", got)
+	}
+}
+
+func TestAnomalyRatePerMinute(t *testing.T) {
+	s := newTestService()
+	clk := useFakeClock(s, time.Unix(1000, 0))
+	routes := s.setupRoutes()
+	post := func(rps int) {
+		body := `{"timestamp":1,"rps":` + itoa(int64(rps)) + `}`
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/metrics", bytes.NewReader([]byte(body))))
+	}
+
+	for i := 0; i < 30; i++ {
+		post(100 + i%2)
+		clk.Advance(time.Second)
+	}
+	post(10000)
+	post(10000)
+	clk.Advance(30 * time.Second)
+	s.updateRates()
+	if got := testutil.ToFloat64(s.metrics.AnomalyRate); math.Abs(got-2) > 0.1 {
+		t.Fatalf("expected 2 anomalies/min, got %v", got)
+	}
+
+	clk.Advance(time.Minute)
+	s.updateRates()
+	if got := testutil.ToFloat64(s.metrics.AnomalyRate); got != 0 {
+		t.Fatalf("expected anomaly rate to drop to 0, got %v", got)
+	}
+}
+
+func TestRateUpdateIntervalMustBePositive(t *testing.T) {
+	for value, want := range map[string]time.Duration{"": time.Second, "250ms": 250 * time.Millisecond, "0": time.Second, "-1s": time.Second} {
+		t.Setenv("RATE_UPDATE_INTERVAL", value)
+		if got := rateUpdateInterval(); got != want {
+			t.Fatalf("RATE_UPDATE_INTERVAL=%q: expected %v, got %v", value, want, got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/highload-service/internal/metrics"
+	"github.com/highload-service/internal/sharding"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// ShardForwardedHeader marks a metric forwarded by another replica; such
+	// metrics are always handled locally, so replicas whose rings briefly
+	// disagree never bounce a request between each other
+	ShardForwardedHeader = "X-Shard-Forwarded-By"
+	// ShardSignatureHeader authenticates a forwarded metric, so that clients
+	// cannot set ShardForwardedHeader to skip forwarding
+	ShardSignatureHeader = "X-Shard-Signature"
+	// ShardOwnerHeader names the replica that handled a metric
+	ShardOwnerHeader = "X-Shard-Owner"
+)
+
+// newSharder builds the sharding layer from SHARD_PEERS or SHARD_SRV; it
+// returns nil when neither is set and every replica handles every source
+func newSharder(port string, m *metrics.Metrics) (*sharding.Sharder, error) {
+	var disc sharding.Discoverer
+	switch {
+	case os.Getenv("SHARD_PEERS") != "" && os.Getenv("SHARD_SRV") != "":
+		return nil, fmt.Errorf("SHARD_PEERS and SHARD_SRV are mutually exclusive")
+	case os.Getenv("SHARD_PEERS") != "":
+		disc = sharding.StaticPeers(splitList(os.Getenv("SHARD_PEERS")))
+	case os.Getenv("SHARD_SRV") != "":
+		disc = &sharding.SRVDiscovery{Name: os.Getenv("SHARD_SRV")}
+	default:
+		return nil, nil
+	}
+
+	self := os.Getenv("SHARD_SELF")
+	if self == "" {
+		host := os.Getenv("POD_IP")
+		if host == "" {
+			var err error
+			if host, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("failed to determine SHARD_SELF: %w", err)
+			}
+		}
+		self = net.JoinHostPort(host, port)
+	}
+
+	return sharding.NewSharder(self, disc, sharding.Options{
+		VirtualNodes:    getenvInt("SHARD_VIRTUAL_NODES", 100),
+		RefreshInterval: getenvDuration("SHARD_REFRESH_INTERVAL", 10*time.Second),
+		Hooks: sharding.Hooks{
+			Rebalanced: func(peers, joined, left []string) {
+				m.ShardPeers.Set(float64(len(peers)))
+				m.ShardRebalances.Inc()
+			},
+		},
+	}), nil
+}
+
+// shardSecretFromEnv reads SHARD_SECRET, which every replica of the ring
+// shares; it is required when sharding is enabled
+func shardSecretFromEnv() ([]byte, error) {
+	secret := os.Getenv("SHARD_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("SHARD_SECRET is required when SHARD_PEERS or SHARD_SRV is set")
+	}
+	return []byte(secret), nil
+}
+
+// shardSignature is the HMAC-SHA256 of the forwarding replica and the body
+func shardSignature(secret []byte, by string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(by))
+	mac.Write([]byte{0})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// forwardedByPeer reports whether r was forwarded by another replica. A
+// ShardForwardedHeader without a valid signature is ignored and the metric
+// is routed like any other.
+func (s *Service) forwardedByPeer(r *http.Request, body []byte) bool {
+	by := r.Header.Get(ShardForwardedHeader)
+	if by == "" {
+		return false
+	}
+	want := shardSignature(s.shardSecret, by, body)
+	if !hmac.Equal([]byte(r.Header.Get(ShardSignatureHeader)), []byte(want)) {
+		s.log(r).Warn("Ignoring unauthenticated shard forwarding header", "forwarded_by", by)
+		return false
+	}
+	return true
+}
+
+// forwardMetric sends a metric owned by another replica to its owner and
+// relays the response. It returns false if the owner could not be reached,
+// in which case the caller handles the metric itself: a window briefly fed
+// by two replicas is better than a lost metric.
+func (s *Service) forwardMetric(w http.ResponseWriter, r *http.Request, owner string, body []byte) bool {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "http://"+owner+"/metrics", bytes.NewReader(body))
+	if err != nil {
+		s.log(r).Warn("Failed to forward metric", "owner", owner, "error", err)
+		s.metrics.ShardForwards.WithLabelValues("error").Inc()
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ShardForwardedHeader, s.shards.Self())
+	req.Header.Set(ShardSignatureHeader, shardSignature(s.shardSecret, s.shards.Self(), body))
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	propagator.Inject(r.Context(), propagation.HeaderCarrier(req.Header))
+
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		s.log(r).Warn("Failed to forward metric, handling locally", "owner", owner, "error", err)
+		s.metrics.ShardForwards.WithLabelValues("error").Inc()
+		return false
+	}
+	defer resp.Body.Close()
+
+	s.metrics.ShardForwards.WithLabelValues("ok").Inc()
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set(ShardOwnerHeader, owner)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/highload-service/internal/sharding"
+)
+
+// startReplicas starts n services sharding sources between each other
+func startReplicas(t *testing.T, n int, extraPeers ...string) ([]*Service, []*httptest.Server) {
+	t.Helper()
+	var services []*Service
+	var servers []*httptest.Server
+	var peers sharding.StaticPeers
+	for i := 0; i < n; i++ {
+		s := newTestService()
+		ts := httptest.NewUnstartedServer(nil)
+		ts.Config.Handler = s.setupRoutes()
+		ts.Start()
+		t.Cleanup(ts.Close)
+		services = append(services, s)
+		servers = append(servers, ts)
+		peers = append(peers, ts.Listener.Addr().String())
+	}
+	peers = append(peers, extraPeers...)
+	for i, s := range services {
+		s.shards = sharding.NewSharder(peers[i], peers, sharding.Options{RefreshInterval: time.Hour})
+		s.forwardClient = &http.Client{Timeout: time.Second}
+		s.shardSecret = []byte("ring-secret")
+		t.Cleanup(s.shards.Close)
+	}
+	return services, servers
+}
+
+func TestShardingForwardsToOwner(t *testing.T) {
+	services, servers := startReplicas(t, 2)
+
+	perReplica := make([]int, 2)
+	for i := 0; i < 20; i++ {
+		source := fmt.Sprintf("web-%d", i)
+		owner, _ := services[0].shards.Owner(source)
+		body := fmt.Sprintf(`{"timestamp":%d,"source":%q,"cpu":20,"rps":100}`, i+1, source)
+		// все метрики приходят на первую реплику
+		resp, err := http.Post(servers[0].URL+"/metrics", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		if owner == services[1].shards.Self() {
+			perReplica[1]++
+			if got := resp.Header.Get(ShardOwnerHeader); got != owner {
+				t.Fatalf("expected %s to be handled by %s, got %q", source, owner, got)
+			}
+		} else {
+			perReplica[0]++
+		}
+	}
+	if perReplica[0] == 0 || perReplica[1] == 0 {
+		t.Fatalf("expected sources on both replicas, got %v", perReplica)
+	}
+	for i, s := range services {
+		if _, _, count := s.anomalyDetector.GetStats(); count != perReplica[i] {
+			t.Fatalf("replica %d: expected %d values in its window, got %d", i, perReplica[i], count)
+		}
+	}
+}
+
+func TestShardingHandlesLocallyWhenOwnerIsDown(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	addr := dead.Listener.Addr().String()
+	dead.Close()
+	services, servers := startReplicas(t, 1, addr)
+
+	var source string
+	for i := 0; ; i++ {
+		source = fmt.Sprintf("web-%d", i)
+		if owner, _ := services[0].shards.Owner(source); owner == addr {
+			break
+		}
+	}
+	body := fmt.Sprintf(`{"timestamp":1,"source":%q,"cpu":20,"rps":100}`, source)
+	resp, err := http.Post(servers[0].URL+"/metrics", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the metric to be handled locally, got %d", resp.StatusCode)
+	}
+	if _, _, count := services[0].anomalyDetector.GetStats(); count != 1 {
+		t.Fatalf("expected the metric in the local window, got %d values", count)
+	}
+}
+
+func TestShardingDoesNotForwardTwice(t *testing.T) {
+	services, servers := startReplicas(t, 2)
+
+	var source string
+	for i := 0; ; i++ {
+		source = fmt.Sprintf("web-%d", i)
+		if _, local := services[0].shards.Owner(source); !local {
+			break
+		}
+	}
+	body := fmt.Sprintf(`{"timestamp":1,"source":%q,"rps":100}`, source)
+	req, _ := http.NewRequest(http.MethodPost, servers[0].URL+"/metrics", strings.NewReader(body))
+	req.Header.Set(ShardForwardedHeader, "10.0.0.9:8080")
+	req.Header.Set(ShardSignatureHeader, shardSignature([]byte("ring-secret"), "10.0.0.9:8080", []byte(body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, _, count := services[0].anomalyDetector.GetStats(); count != 1 {
+		t.Fatalf("expected a forwarded metric to be handled where it arrived")
+	}
+}
+
+func TestShardingIgnoresUnsignedForwardHeader(t *testing.T) {
+	services, servers := startReplicas(t, 2)
+
+	var source string
+	for i := 0; ; i++ {
+		source = fmt.Sprintf("web-%d", i)
+		if _, local := services[0].shards.Owner(source); !local {
+			break
+		}
+	}
+	body := fmt.Sprintf(`{"timestamp":1,"source":%q,"rps":100}`, source)
+	for _, sig := range []string{
+		"",
+		shardSignature([]byte("guessed"), "10.0.0.9:8080", []byte(body)),
+		// подпись другого тела
+		shardSignature([]byte("ring-secret"), "10.0.0.9:8080", []byte(`{"rps":1}`)),
+	} {
+		req, _ := http.NewRequest(http.MethodPost, servers[0].URL+"/metrics", strings.NewReader(body))
+		req.Header.Set(ShardForwardedHeader, "10.0.0.9:8080")
+		if sig != "" {
+			req.Header.Set(ShardSignatureHeader, sig)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get(ShardOwnerHeader); got != services[1].shards.Self() {
+			t.Fatalf("expected the metric forwarded to its owner, got owner %q", got)
+		}
+	}
+	if _, _, count := services[0].anomalyDetector.GetStats(); count != 0 {
+		t.Fatalf("expected no metric handled by the replica it arrived at, got %d", count)
+	}
+	if _, _, count := services[1].anomalyDetector.GetStats(); count != 3 {
+		t.Fatalf("expected the owner to handle every metric, got %d", count)
+	}
+}
+
+func TestShardSecretRequired(t *testing.T) {
+	t.Setenv("SHARD_SECRET", "")
+	if _, err := shardSecretFromEnv(); err == nil {
+		t.Fatal("expected an error without SHARD_SECRET")
+	}
+	t.Setenv("SHARD_SECRET", "ring-secret")
+	if secret, err := shardSecretFromEnv(); err != nil || string(secret) != "ring-secret" {
+		t.Fatalf("unexpected secret %q (%v)", secret, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// shutdownOptions configures graceful shutdown
+type shutdownOptions struct {
+	// DrainPeriod is how long /readyz reports 503 before the listener stops,
+	// giving load balancers and kube-proxy time to stop sending traffic
+	DrainPeriod time.Duration
+	// Timeout bounds the whole shutdown: draining, in-flight requests and
+	// flushing of buffered state
+	Timeout time.Duration
+}
+
+// Draining reports whether the service is shutting down
+func (s *Service) Draining() bool {
+	return s.draining.Load()
+}
+
+// Shutdown drains srv and then flushes the service state: the replica first
+// reports itself unready for the drain period while still serving, then
+// stops accepting connections and waits for in-flight requests, then saves
+// the detector snapshot and flushes the cache buffers
+func (s *Service) Shutdown(srv *http.Server, opts shutdownOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	s.draining.Store(true)
+	s.logger.Info("Draining before closing connections", "period", opts.DrainPeriod)
+	select {
+	case <-time.After(opts.DrainPeriod):
+	case <-ctx.Done():
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		s.logger.Warn("In-flight requests did not finish", "error", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("shutdown timed out, buffered cache writes may be lost")
+	}
+}
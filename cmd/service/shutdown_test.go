@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/highload-service/internal/cache"
+)
+
+// gatedPoints holds point writes until released
+type gatedPoints struct {
+	*cache.MemoryCache
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c gatedPoints) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	close(c.started)
+	<-c.release
+	return c.MemoryCache.AddPoint(ctx, source, ts, value, maxLen)
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	s := newTestService()
+	gate := gatedPoints{cache.NewMemoryCache(10), make(chan struct{}), make(chan struct{})}
+	s.cache = gate
+	s.writeTimeout = 5 * time.Second
+	store := &fileSnapshots{path: filepath.Join(t.TempDir(), "detector.json")}
+	s.snapshots = store
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: s.setupRoutes()}
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String()
+
+	posted := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url+"/metrics", "application/json", strings.NewReader(`{"timestamp":1,"rps":100}`))
+		if err != nil {
+			posted <- 0
+			return
+		}
+		resp.Body.Close()
+		posted <- resp.StatusCode
+	}()
+	<-gate.started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(srv, shutdownOptions{DrainPeriod: 100 * time.Millisecond, Timeout: 5 * time.Second})
+	}()
+
+	// во время дренажа под ещё отвечает, но уже не готов
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := client.Get(url + "/ready")
+		if err != nil {
+			t.Fatalf("expected the listener to stay open while draining: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected /ready to report 503 while draining")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	close(gate.release)
+	if code := <-posted; code != http.StatusOK {
+		t.Fatalf("expected the in-flight request to complete, got %d", code)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, err := http.Get(url + "/ready"); err == nil {
+		t.Fatalf("expected the listener to be closed after shutdown")
+	}
+	snap, err := store.Load(context.Background())
+	if err != nil || len(snap.Detector.Values) != 1 {
+		t.Fatalf("expected a final snapshot with the drained metric, got %d values (%v)", len(snap.Detector.Values), err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	s := newTestService()
+	routes := s.setupRoutes()
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	s.draining.Store(true)
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while draining, got %d", rec.Code)
+	}
+}
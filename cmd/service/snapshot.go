@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/cache"
+)
+
+const (
+	SnapshotBackendRedis = "redis"
+	SnapshotBackendFile  = "file"
+	SnapshotBackendOff   = "off"
+	SnapshotKey          = "detector:snapshot"
+)
+
+var errNoSnapshot = errors.New("no snapshot")
+
+// snapshotStore persists analytics snapshots between restarts
+type snapshotStore interface {
+	Save(ctx context.Context, snap analytics.Snapshot) error
+	// Load returns the latest snapshot, or errNoSnapshot
+	Load(ctx context.Context) (analytics.Snapshot, error)
+}
+
+// cacheSnapshots keeps the snapshot of each replica under its own key of
+// the cache, so that replicas do not overwrite each other's windows. Without
+// sharding every replica sees the same traffic behind the load balancer, so
+// the snapshot is also written to a shared key, from which a pod with a new
+// name starts.
+type cacheSnapshots struct {
+	cache interface {
+		cache.Cache
+		cache.Getter
+	}
+	key    string
+	shared string // empty when sharding
+	ttl    time.Duration
+}
+
+// snapshotReplica names the replica in its snapshot key: DETECTOR_SNAPSHOT_ID,
+// else the shard address, else the host name (the pod name in Kubernetes)
+func (s *Service) snapshotReplica() string {
+	if id := os.Getenv("DETECTOR_SNAPSHOT_ID"); id != "" {
+		return id
+	}
+	if s.shards != nil {
+		return s.shards.Self()
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// newCacheSnapshots keys the snapshots of s under prefix
+func (s *Service) newCacheSnapshots(store interface {
+	cache.Cache
+	cache.Getter
+}, prefix string) *cacheSnapshots {
+	c := &cacheSnapshots{cache: store, key: prefix + ":" + s.snapshotReplica(), ttl: s.snapshotOpts.MaxAge}
+	if s.shards == nil {
+		c.shared = prefix
+	}
+	return c
+}
+
+func (c *cacheSnapshots) Save(ctx context.Context, snap analytics.Snapshot) error {
+	if err := c.cache.Set(ctx, c.key, snap, c.ttl); err != nil {
+		return err
+	}
+	if c.shared != "" {
+		return c.cache.Set(ctx, c.shared, snap, c.ttl)
+	}
+	return nil
+}
+
+func (c *cacheSnapshots) Load(ctx context.Context) (analytics.Snapshot, error) {
+	var snap analytics.Snapshot
+	err := c.cache.Get(ctx, c.key, &snap)
+	if errors.Is(err, cache.ErrNotFound) && c.shared != "" {
+		err = c.cache.Get(ctx, c.shared, &snap)
+	}
+	if errors.Is(err, cache.ErrNotFound) {
+		return snap, errNoSnapshot
+	}
+	return snap, err
+}
+
+// fileSnapshots keeps the snapshot in a local file, e.g. on a volume that
+// survives restarts of the pod
+type fileSnapshots struct {
+	path string
+}
+
+func (f *fileSnapshots) Save(ctx context.Context, snap analytics.Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	// пишем во временный файл и переименовываем, чтобы не оставить половину снапшота
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+func (f *fileSnapshots) Load(ctx context.Context) (analytics.Snapshot, error) {
+	var snap analytics.Snapshot
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, errNoSnapshot
+	}
+	if err != nil {
+		return snap, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// snapshotOptions configures detector snapshots
+type snapshotOptions struct {
+	Interval time.Duration
+	MaxAge   time.Duration // older snapshots are not restored
+	Timeout  time.Duration // 0 means no deadline
+}
+
+func (o snapshotOptions) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, o.Timeout)
+}
+
+func (s *Service) takeSnapshot() analytics.Snapshot {
+	return analytics.Snapshot{
+		TakenAt:        s.clock.Now(),
+		RollingAverage: s.rollingAvg.Snapshot(),
+		Detector:       s.anomalyDetector.Snapshot(),
+		Streams:        s.streams.Snapshot(),
+	}
+}
+
+// saveSnapshot stores the current analytics state
+func (s *Service) saveSnapshot(ctx context.Context) error {
+	if s.snapshots == nil {
+		return nil
+	}
+	ctx, cancel := s.snapshotOpts.context(ctx)
+	defer cancel()
+	return s.snapshots.Save(ctx, s.takeSnapshot())
+}
+
+// restoreSnapshot loads the latest snapshot into the detectors, unless it is
+// missing or too old to describe current traffic
+func (s *Service) restoreSnapshot(ctx context.Context) error {
+	ctx, cancel := s.snapshotOpts.context(ctx)
+	defer cancel()
+
+	snap, err := s.snapshots.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if age := s.clock.Now().Sub(snap.TakenAt); s.snapshotOpts.MaxAge > 0 && age > s.snapshotOpts.MaxAge {
+		return fmt.Errorf("snapshot is %v old, limit is %v", age.Round(time.Second), s.snapshotOpts.MaxAge)
+	}
+	s.rollingAvg.Restore(snap.RollingAverage)
+	s.anomalyDetector.Restore(snap.Detector)
+	streams := s.streams.Restore(s.ownedStreams(snap.Streams))
+	s.logger.Info("Restored detector state", "taken_at", snap.TakenAt, "values", len(snap.Detector.Values), "streams", streams)
+	return nil
+}
+
+// ownedStreams keeps the streams of sources this replica owns
+func (s *Service) ownedStreams(states []analytics.StreamState) []analytics.StreamState {
+	if s.shards == nil {
+		return states
+	}
+	var owned []analytics.StreamState
+	for _, st := range states {
+		if _, local := s.shards.Owner(st.Source); local {
+			owned = append(owned, st)
+		}
+	}
+	return owned
+}
+
+// saveSnapshotPeriodically is run every snapshot interval
+func (s *Service) saveSnapshotPeriodically() {
+	if err := s.saveSnapshot(context.Background()); err != nil {
+		s.logger.Warn("Failed to save detector snapshot", "error", err)
+	}
+}
+
+// every runs fn every interval in the background until Close
+func (s *Service) every(interval time.Duration, fn func()) {
+	// тикер создаётся до запуска горутины, чтобы тесты с фиктивными часами
+	// не сдвигали время раньше, чем цикл начнёт его слушать
+	ticker := s.clock.NewTicker(interval)
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				fn()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops background work, saves a final snapshot and closes the cache
+func (s *Service) Close() error {
+	if s.shards != nil {
+		s.shards.Close()
+	}
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.background.Wait()
+	if err := s.saveSnapshot(context.Background()); err != nil {
+		s.logger.Warn("Failed to save detector snapshot", "error", err)
+	}
+	return s.cache.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/cache"
+	"github.com/highload-service/internal/sharding"
+)
+
+func warmUp(s *Service, n int) {
+	for i := 0; i < n; i++ {
+		v := 100 + float64(i%3)
+		s.rollingAvg.Add(v)
+		s.anomalyDetector.Evaluate(v)
+	}
+}
+
+// warmUpSource fills the windows of source, which judge its values
+func warmUpSource(s *Service, source string, n int) {
+	for i := 0; i < n; i++ {
+		s.observeStreams(Metric{Source: source, CPU: 20, RPS: 100 + float64(i%3)})
+	}
+}
+
+func TestSnapshotRestoresDetectors(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rc, err := cache.NewRedisCache(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	defer rc.Close()
+
+	stores := map[string]snapshotStore{
+		"redis": &cacheSnapshots{cache: rc, key: SnapshotKey, ttl: time.Hour},
+		"file":  &fileSnapshots{path: filepath.Join(t.TempDir(), "detector.json")},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			old := newTestService()
+			old.snapshots = store
+			warmUp(old, 50)
+			warmUpSource(old, "web", 30)
+			if err := old.saveSnapshot(ctx); err != nil {
+				t.Fatalf("saveSnapshot failed: %v", err)
+			}
+
+			s := newTestService()
+			s.snapshots = store
+			if err := s.restoreSnapshot(ctx); err != nil {
+				t.Fatalf("restoreSnapshot failed: %v", err)
+			}
+			if _, _, count := s.anomalyDetector.GetStats(); count != 50 {
+				t.Fatalf("expected a warm window of 50 values, got %d", count)
+			}
+			if got, want := s.rollingAvg.GetAverage(), old.rollingAvg.GetAverage(); got != want {
+				t.Fatalf("expected rolling average %v, got %v", want, got)
+			}
+			// прогрев не нужен: выброс ловится первым же запросом
+			if d := s.anomalyDetector.Evaluate(2000); !d.IsAnomaly {
+				t.Fatalf("expected anomaly right after restore, got %+v", d)
+			}
+			if st, ok := s.streams.Stats(analytics.StreamKey{Source: "web", Metric: "rps"}); !ok || st.Count != 30 {
+				t.Fatalf("expected the web window of 30 values back, got %+v", st)
+			}
+			if d := s.observeStreams(Metric{Source: "web", RPS: 2000}); !d["rps"].IsAnomaly {
+				t.Fatalf("expected the restored stream to judge the first value, got %+v", d["rps"])
+			}
+		})
+	}
+}
+
+func TestCacheSnapshotsPerReplica(t *testing.T) {
+	ctx := context.Background()
+	store := cache.NewMemoryCache(100)
+	replica := func(id string, sharded bool) *Service {
+		t.Setenv("DETECTOR_SNAPSHOT_ID", id)
+		s := newTestService()
+		if sharded {
+			s.shards = sharding.NewSharder(id, sharding.StaticPeers{"a:8080", "b:8080"}, sharding.Options{RefreshInterval: time.Hour})
+			t.Cleanup(s.shards.Close)
+		}
+		s.snapshots = s.newCacheSnapshots(store, SnapshotKey)
+		return s
+	}
+
+	a, b := replica("a:8080", false), replica("b:8080", false)
+	warmUp(a, 10)
+	warmUp(b, 20)
+	a.saveSnapshot(ctx)
+	b.saveSnapshot(ctx)
+
+	// каждая реплика получает своё окно, а новый под — окно последней сохранившей
+	for _, c := range []struct {
+		s    *Service
+		want int
+	}{{replica("a:8080", false), 10}, {replica("b:8080", false), 20}, {replica("new-pod", false), 20}} {
+		if err := c.s.restoreSnapshot(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, count := c.s.anomalyDetector.GetStats(); count != c.want {
+			t.Fatalf("expected %d values, got %d", c.want, count)
+		}
+	}
+
+	// при шардировании окна не делятся, а потоки восстанавливает только владелец
+	sa := replica("a:8080", true)
+	var mine, theirs string
+	for i := 0; mine == "" || theirs == ""; i++ {
+		source := fmt.Sprintf("web-%d", i)
+		if _, local := sa.shards.Owner(source); local {
+			mine = source
+		} else {
+			theirs = source
+		}
+	}
+	warmUpSource(sa, mine, 5)
+	warmUpSource(sa, theirs, 5)
+	sa.saveSnapshot(ctx)
+
+	restarted := replica("a:8080", true)
+	if err := restarted.restoreSnapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.streams.Stats(analytics.StreamKey{Source: mine, Metric: "rps"}); !ok {
+		t.Fatalf("expected the owned source %s to be restored", mine)
+	}
+	if _, ok := restarted.streams.Stats(analytics.StreamKey{Source: theirs, Metric: "rps"}); ok {
+		t.Fatalf("expected the source %s of another replica to be skipped", theirs)
+	}
+	if err := replica("c:8080", true).restoreSnapshot(ctx); !errors.Is(err, errNoSnapshot) {
+		t.Fatalf("expected no shared snapshot when sharding, got %v", err)
+	}
+}
+
+func TestSnapshotSkipsMissingAndStale(t *testing.T) {
+	ctx := context.Background()
+	store := &fileSnapshots{path: filepath.Join(t.TempDir(), "detector.json")}
+
+	s := newTestService()
+	s.snapshots = store
+	if err := s.restoreSnapshot(ctx); !errors.Is(err, errNoSnapshot) {
+		t.Fatalf("expected errNoSnapshot, got %v", err)
+	}
+
+	warmUp(s, 10)
+	snap := s.takeSnapshot()
+	snap.TakenAt = time.Now().Add(-2 * time.Hour)
+	if err := store.Save(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := newTestService()
+	fresh.snapshots = store
+	fresh.snapshotOpts.MaxAge = time.Hour
+	if err := fresh.restoreSnapshot(ctx); err == nil {
+		t.Fatalf("expected a stale snapshot to be rejected")
+	}
+	if _, _, count := fresh.anomalyDetector.GetStats(); count != 0 {
+		t.Fatalf("expected a cold detector, got %d values", count)
+	}
+}
+
+func TestCloseSavesSnapshot(t *testing.T) {
+	store := &fileSnapshots{path: filepath.Join(t.TempDir(), "detector.json")}
+	s := newTestService()
+	s.snapshots = store
+	s.stop = make(chan struct{})
+	s.every(time.Hour, s.saveSnapshotPeriodically)
+
+	warmUp(s, 20)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	snap, err := store.Load(context.Background())
+	if err != nil || len(snap.Detector.Values) != 20 {
+		t.Fatalf("expected the final snapshot with 20 values, got %d (%v)", len(snap.Detector.Values), err)
+	}
+}
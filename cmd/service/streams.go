@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/highload-service/internal/analytics"
+	"github.com/highload-service/internal/cache"
+	"github.com/highload-service/internal/metrics"
+)
+
+// observeStreams feeds the per-source windows, exports their statistics and
+// returns the decision of each metric, judged with the source's own window
+// and configuration
+func (s *Service) observeStreams(metric Metric) map[string]analytics.Decision {
+	now := s.clock.Now()
+	decisions := make(map[string]analytics.Decision, 2)
+	for name, v := range map[string]float64{"rps": metric.RPS, "cpu": metric.CPU} {
+		d, st := s.streams.Observe(analytics.StreamKey{Source: metric.Source, Metric: name}, v, now)
+		decisions[name] = d
+		s.metrics.Streams.Set(metric.Source, name, metrics.StreamValues{
+			RollingAverage: st.RollingAverage,
+			Mean:           st.Mean,
+			StdDev:         st.StdDev,
+			LastZ:          st.LastZ,
+		}, now)
+	}
+	return decisions
+}
+
+// pruneIdleStreams forgets streams and series of sources that stopped
+// sending, so that their windows and labels do not pile up
+func (s *Service) pruneIdleStreams() {
+	before := s.clock.Now().Add(-s.streamIdle)
+	pruned := s.streams.Prune(before)
+	deleted := s.metrics.Streams.Sweep(before)
+	if len(pruned) > 0 || deleted > 0 {
+		s.logger.Info("Pruned idle streams", "streams", len(pruned), "series", deleted)
+	}
+}
+
+// pruneSources drops sources whose data has expired from the source list in
+// the cache
+func (s *Service) pruneSources() {
+	p, ok := s.cache.(cache.SourcePruner)
+	if !ok {
+		return
+	}
+	retention := s.rawRetention
+	for _, res := range s.resolutions {
+		retention = max(retention, res.Retention)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.readTimeout)
+	defer cancel()
+	now := s.clock.Now()
+	n, err := p.PruneSources(ctx, now, now.Add(-retention))
+	if err != nil {
+		s.logger.Warn("Failed to prune sources", "error", err)
+		return
+	}
+	if n > 0 {
+		s.logger.Info("Pruned expired sources", "sources", n)
+	}
+}
+
+// analyzeSource answers GET /analyze?source=: the rps window of one source
+// and the configuration it is judged with
+func (s *Service) analyzeSource(w http.ResponseWriter, source string) {
+	st, ok := s.streams.Stats(analytics.StreamKey{Source: source, Metric: "rps"})
+	if !ok {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+	cfg, overridden := s.streams.Config(source)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"source":          source,
+		"rolling_average": st.RollingAverage,
+		"anomaly_stats": map[string]interface{}{
+			"mean":        st.Mean,
+			"std_dev":     st.StdDev,
+			"threshold":   cfg.Threshold,
+			"window_size": cfg.WindowSize,
+			"detector":    cfg.Method,
+			"overridden":  overridden,
+			"data_points": st.Count,
+			"last_zscore": st.LastZ,
+			"is_anomaly":  st.LastIsAnomaly,
+		},
+	})
+}
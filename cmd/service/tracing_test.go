@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceSpansAcrossIngest(t *testing.T) {
+	s := newTestService()
+	recorder := tracetest.NewSpanRecorder()
+	s.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(TracerName)
+	routes := s.setupRoutes()
+
+	req := httptest.NewRequest("POST", "/metrics", strings.NewReader(`{"timestamp":1,"source":"web","rps":100}`))
+	req.Header.Set("traceparent", testTraceparent)
+	routes.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		// все спаны продолжают трассу вызывающего
+		if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %s has trace id %s, expected the caller's", span.Name(), got)
+		}
+	}
+	server, ok := spans["POST /metrics"]
+	if !ok {
+		t.Fatalf("expected a server span, got %v", spans)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Fatalf("expected the server span to be a child of the caller, got parent %s", got)
+	}
+	for _, name := range []string{"decode", "cache.add_point", "analytics.rolling_average", "analytics.streams", "analytics.detector"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected a %s span, got %v", name, spans)
+		}
+		if span.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Fatalf("expected %s to be a child of the server span", name)
+		}
+	}
+}
+
+func TestLatencyHistogramHasTraceExemplars(t *testing.T) {
+	s := newTestService()
+	s.tracer = sdktrace.NewTracerProvider().Tracer(TracerName)
+	req := httptest.NewRequest("GET", "/livez", nil)
+	req.Header.Set("traceparent", testTraceparent)
+	s.setupRoutes().ServeHTTP(httptest.NewRecorder(), req)
+
+	var m dto.Metric
+	if err := s.metrics.RequestDuration.WithLabelValues("GET", "/livez").(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range m.GetHistogram().GetBucket() {
+		if ex := b.GetExemplar(); ex != nil {
+			if l := ex.GetLabel()[0]; l.GetName() != "trace_id" || l.GetValue() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Fatalf("unexpected exemplar labels %v", ex.GetLabel())
+			}
+			return
+		}
+	}
+	t.Fatal("expected an exemplar on the latency histogram")
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if tp, err := newTracerProvider(context.Background()); tp != nil || err != nil {
+		t.Fatalf("expected tracing to be off without an endpoint, got %v (%v)", tp, err)
+	}
+
+	// заглушка коллектора принимает OTLP/HTTP
+	var mu sync.Mutex
+	var got []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, r.URL.Path+" "+r.Header.Get("Content-Type"))
+		mu.Unlock()
+		if len(body) == 0 {
+			t.Errorf("expected a non-empty export request")
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	tp, err := newTracerProvider(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tp.Tracer(TracerName).Start(context.Background(), "test")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0] != "/v1/traces application/x-protobuf" {
+		t.Fatalf("expected one OTLP export to /v1/traces, got %v", got)
+	}
+}
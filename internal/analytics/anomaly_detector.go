@@ -8,8 +8,10 @@ import (
 // AnomalyDetector detects anomalies using z-score method
 type AnomalyDetector struct {
 	windowSize int
-	values     []float64
+	values     []float64 // newest retain values; the window is the newest windowSize of them
+	retain     int
 	threshold  float64 // z-score threshold (default 2.0)
+	method     Method
 
 	lastZ         float64
 	lastIsAnomaly bool
@@ -29,7 +31,9 @@ func NewAnomalyDetector(windowSize int, threshold float64) *AnomalyDetector {
 	return &AnomalyDetector{
 		windowSize: windowSize,
 		values:     make([]float64, 0, windowSize),
+		retain:     windowSize,
 		threshold:  threshold,
+		method:     MethodZScore,
 	}
 }
 
@@ -53,57 +57,80 @@ func meanStd(values []float64) (mean, std float64) {
 	return
 }
 
+// Decision describes the outcome of evaluating a single value
+type Decision struct {
+	Method    Method
+	Value     float64
+	ZScore    float64
+	Mean      float64
+	StdDev    float64
+	Threshold float64
+	IsAnomaly bool
+}
+
 // Add adds a new value and returns if it's an anomaly
 func (a *AnomalyDetector) Add(value float64) bool {
+	return a.Evaluate(value).IsAnomaly
+}
+
+// Evaluate adds a new value and returns the full decision, including the
+// window statistics the z-score was computed against
+func (a *AnomalyDetector) Evaluate(value float64) Decision {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	// добавляем значение
-	a.values = append(a.values, value)
-	if len(a.values) > a.windowSize {
-		a.values = a.values[1:]
+	a.values = push(a.values, value, a.retain)
+
+	d := evaluate(a.method, a.window(), a.threshold)
+	a.lastZ = d.ZScore
+	a.lastIsAnomaly = d.IsAnomaly
+	return d
+}
+
+// decide evaluates the newest value of window against the whole window
+func decide(window []float64, threshold float64) Decision {
+	d := Decision{Threshold: threshold}
+	if len(window) == 0 {
+		return d
 	}
+	d.Value = window[len(window)-1]
 
 	// если данных мало — аномалии не считаем
-	if len(a.values) < 2 {
-		a.lastZ = 0
-		a.lastIsAnomaly = false
-		return false
+	if len(window) < 2 {
+		return d
 	}
 
-	mean, std := meanStd(a.values)
-	if std == 0 {
-		a.lastZ = 0
-		a.lastIsAnomaly = false
-		return false
+	d.Mean, d.StdDev = meanStd(window)
+	if d.StdDev == 0 {
+		return d
 	}
 
-	z := (value - mean) / std
-	a.lastZ = z
-	a.lastIsAnomaly = math.Abs(z) > a.threshold
-
-	return a.lastIsAnomaly
+	d.ZScore = (d.Value - d.Mean) / d.StdDev
+	d.IsAnomaly = math.Abs(d.ZScore) > threshold
+	return d
 }
 
 // calculateStats calculates mean and standard deviation
 func (ad *AnomalyDetector) calculateStats() (mean, stdDev float64) {
-	if len(ad.values) == 0 {
+	values := ad.window()
+	if len(values) == 0 {
 		return 0.0, 0.0
 	}
 
 	// Calculate mean
 	sum := 0.0
-	for _, v := range ad.values {
+	for _, v := range values {
 		sum += v
 	}
-	mean = sum / float64(len(ad.values))
+	mean = sum / float64(len(values))
 
 	// Calculate standard deviation
 	variance := 0.0
-	for _, v := range ad.values {
+	for _, v := range values {
 		variance += math.Pow(v-mean, 2)
 	}
-	variance /= float64(len(ad.values))
+	variance /= float64(len(values))
 	stdDev = math.Sqrt(variance)
 
 	return mean, stdDev
@@ -114,12 +141,13 @@ func (a *AnomalyDetector) GetStats() (mean, std float64, count int) {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
-	count = len(a.values)
+	window := a.window()
+	count = len(window)
 	if count == 0 {
 		return 0, 0, 0
 	}
 
-	mean, std = meanStd(a.values)
+	mean, std = meanStd(window)
 	return
 }
 
@@ -44,3 +44,25 @@ func TestAnomalyDetector_Reset(t *testing.T) {
 		t.Fatalf("expected mean/std 0 after reset, got mean=%v std=%v", mean, std)
 	}
 }
+
+func TestAnomalyDetector_EvaluateReportsStats(t *testing.T) {
+	ad := NewAnomalyDetector(10, 2.0)
+	for i := 0; i < 9; i++ {
+		_ = ad.Evaluate(100)
+	}
+
+	d := ad.Evaluate(1000)
+	if !d.IsAnomaly {
+		t.Fatalf("expected anomaly for spike")
+	}
+	if d.Value != 1000 || d.Threshold != 2.0 {
+		t.Fatalf("unexpected decision: %+v", d)
+	}
+	mean, std, _ := ad.GetStats()
+	if d.Mean != mean || d.StdDev != std {
+		t.Fatalf("expected mean/std %v/%v, got %v/%v", mean, std, d.Mean, d.StdDev)
+	}
+	if z, _ := ad.GetLastDecision(); z != d.ZScore {
+		t.Fatalf("expected last z %v, got %v", d.ZScore, z)
+	}
+}
@@ -0,0 +1,168 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Method is the statistic a detector judges values with
+type Method string
+
+const (
+	// MethodZScore compares a value with the mean and standard deviation of
+	// the window
+	MethodZScore Method = "zscore"
+	// MethodMAD compares a value with the median and the median absolute
+	// deviation of the window, which a few outliers in the window do not
+	// inflate
+	MethodMAD Method = "mad"
+)
+
+// MaxWindowSize bounds the window of a detector
+const MaxWindowSize = 100000
+
+// retainFactor bounds the values kept beyond the window: a detector keeps
+// at most this many windows' worth, so shrinking a window of up to
+// retainFactor times the new size and growing it back loses nothing, while
+// a briefly huge window does not pin its memory for the rest of the process
+const retainFactor = 4
+
+// retained returns how many values to keep for a window of windowSize
+// after keeping retain of them
+func retained(retain, windowSize int) int {
+	return min(max(retain, windowSize), retainFactor*windowSize)
+}
+
+// trim keeps the newest n of values, releasing the memory of the rest
+func trim(values []float64, n int) []float64 {
+	if len(values) <= n {
+		return values
+	}
+	return append(make([]float64, 0, n), newest(values, n)...)
+}
+
+// madScale turns the median absolute deviation into an estimate of the
+// standard deviation of normally distributed values
+const madScale = 1.4826
+
+// ParseMethod validates a method name
+func ParseMethod(s string) (Method, error) {
+	switch m := Method(s); m {
+	case MethodZScore, MethodMAD:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown detector %q", s)
+}
+
+// DetectorConfig is the runtime-tunable configuration of a detector
+type DetectorConfig struct {
+	Method     Method  `json:"detector"`
+	WindowSize int     `json:"window_size"`
+	Threshold  float64 `json:"threshold"`
+}
+
+// Validate checks that c can be applied to a detector
+func (c DetectorConfig) Validate() error {
+	if _, err := ParseMethod(string(c.Method)); err != nil {
+		return err
+	}
+	if c.WindowSize < 2 || c.WindowSize > MaxWindowSize {
+		return fmt.Errorf("window_size must be between 2 and %d", MaxWindowSize)
+	}
+	if !(c.Threshold > 0) || math.IsInf(c.Threshold, 0) {
+		return fmt.Errorf("threshold must be a positive number")
+	}
+	return nil
+}
+
+// Config returns the current configuration of the detector
+func (a *AnomalyDetector) Config() DetectorConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return DetectorConfig{Method: a.method, WindowSize: a.windowSize, Threshold: a.threshold}
+}
+
+// Configure applies c to the detector. Values are retained up to the
+// largest window the detector has had, but at most retainFactor windows,
+// so shrinking the window and growing it again brings the older values
+// back. The last decision stands until the next value is evaluated.
+func (a *AnomalyDetector) Configure(c DetectorConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.method, a.threshold = c.Method, c.Threshold
+	a.windowSize = c.WindowSize
+	a.retain = retained(a.retain, c.WindowSize)
+	a.values = trim(a.values, a.retain)
+	return nil
+}
+
+// Resize changes the window size. Like AnomalyDetector.Configure it keeps
+// the values of the largest window so far, up to retainFactor windows.
+func (ra *RollingAverage) Resize(windowSize int) {
+	if windowSize < 1 {
+		return
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.windowSize = windowSize
+	ra.retain = retained(ra.retain, windowSize)
+	ra.values = trim(ra.values, ra.retain)
+}
+
+// window returns the values the detector judges with
+func (a *AnomalyDetector) window() []float64 {
+	return newest(a.values, a.windowSize)
+}
+
+// push appends v to values and keeps the newest n
+func push(values []float64, v float64, n int) []float64 {
+	values = append(values, v)
+	if len(values) > n {
+		values = values[len(values)-n:]
+	}
+	return values
+}
+
+// evaluate judges the newest value of window with method
+func evaluate(method Method, window []float64, threshold float64) Decision {
+	var d Decision
+	if method == MethodMAD && len(window) >= 2 {
+		d = decideMAD(window, threshold)
+	} else {
+		d = decide(window, threshold)
+	}
+	d.Method = method
+	return d
+}
+
+// decideMAD is decide for MethodMAD: Mean is the median and StdDev the
+// scaled median absolute deviation
+func decideMAD(window []float64, threshold float64) Decision {
+	d := Decision{Threshold: threshold, Value: window[len(window)-1]}
+	median := medianOf(window)
+	deviations := make([]float64, len(window))
+	for i, v := range window {
+		deviations[i] = math.Abs(v - median)
+	}
+	d.Mean, d.StdDev = median, madScale*medianOf(deviations)
+	if d.StdDev == 0 {
+		return d
+	}
+	d.ZScore = (d.Value - d.Mean) / d.StdDev
+	d.IsAnomaly = math.Abs(d.ZScore) > threshold
+	return d
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,232 @@
+package analytics
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDetectorConfig_Validate(t *testing.T) {
+	valid := DetectorConfig{Method: MethodMAD, WindowSize: 10, Threshold: 3}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected %+v to be valid, got %v", valid, err)
+	}
+	for _, c := range []DetectorConfig{
+		{Method: "ewma", WindowSize: 10, Threshold: 3},
+		{Method: MethodZScore, WindowSize: 1, Threshold: 3},
+		{Method: MethodZScore, WindowSize: MaxWindowSize + 1, Threshold: 3},
+		{Method: MethodZScore, WindowSize: 10, Threshold: 0},
+		{Method: MethodZScore, WindowSize: 10, Threshold: math.NaN()},
+		{Method: MethodZScore, WindowSize: 10, Threshold: math.Inf(1)},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestAnomalyDetector_ConfigureKeepsWindow(t *testing.T) {
+	ad := NewAnomalyDetector(5, 2.0)
+	for i := 1; i <= 5; i++ {
+		ad.Add(float64(i))
+	}
+
+	// увеличение окна сохраняет все значения
+	if err := ad.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 8, Threshold: 3}); err != nil {
+		t.Fatal(err)
+	}
+	ad.Add(6)
+	if got := ad.Snapshot().Values; !reflect.DeepEqual(got, []float64{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("expected the window to grow, got %v", got)
+	}
+
+	// уменьшение окна сужает статистику, но не выбрасывает значения
+	if err := ad.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 3, Threshold: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if mean, _, count := ad.GetStats(); count != 3 || mean != 5 {
+		t.Fatalf("expected stats over the newest 3 values, got mean %v over %d", mean, count)
+	}
+	ad.Add(7)
+	if d := ad.Evaluate(8); d.Mean != 7 {
+		t.Fatalf("expected the decision over 6, 7, 8, got %+v", d)
+	}
+	if c := ad.Config(); c.WindowSize != 3 || c.Threshold != 3 || c.Method != MethodZScore {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	if err := ad.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 0, Threshold: 3}); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+	if ad.GetWindowSize() != 3 {
+		t.Fatalf("a rejected config must not be applied, window is %d", ad.GetWindowSize())
+	}
+
+	// обратное увеличение возвращает значения, сохранённые до уменьшения
+	if err := ad.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 8, Threshold: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ad.Snapshot().Values; !reflect.DeepEqual(got, []float64{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("expected every retained value back, got %v", got)
+	}
+	if _, _, count := ad.GetStats(); count != 8 {
+		t.Fatalf("expected a window of 8, got %d", count)
+	}
+}
+
+func TestAnomalyDetector_ConfigureBoundsRetained(t *testing.T) {
+	ad := NewAnomalyDetector(1000, 2.0)
+	ra := NewRollingAverage(1000)
+	for i := 0; i < 1000; i++ {
+		ad.Add(float64(i))
+		ra.Add(float64(i))
+	}
+
+	// после уменьшения хранится не больше retainFactor окон
+	if err := ad.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 10, Threshold: 2}); err != nil {
+		t.Fatal(err)
+	}
+	ra.Resize(10)
+	if n := len(ad.Snapshot().Values); n != 10*retainFactor {
+		t.Fatalf("expected %d retained values, got %d", 10*retainFactor, n)
+	}
+	if n := len(ra.Snapshot().Values); n != 10*retainFactor {
+		t.Fatalf("expected %d retained values in the rolling average, got %d", 10*retainFactor, n)
+	}
+
+	// рост окна обратно возвращает только сохранённое
+	ad.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 1000, Threshold: 2})
+	if _, _, count := ad.GetStats(); count != 10*retainFactor {
+		t.Fatalf("expected the dropped values to stay dropped, got %d", count)
+	}
+}
+
+func TestAnomalyDetector_MAD(t *testing.T) {
+	ad := NewAnomalyDetector(20, 3.0)
+	if err := ad.Configure(DetectorConfig{Method: MethodMAD, WindowSize: 20, Threshold: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// прошлый выброс раздувает стандартное отклонение, но не медиану
+	values := []float64{100, 101, 99, 100, 5000, 100, 102, 98, 100, 101}
+	for _, v := range values {
+		ad.Evaluate(v)
+	}
+	d := ad.Evaluate(130)
+	if !d.IsAnomaly || d.Method != MethodMAD || d.Mean != 100 {
+		t.Fatalf("expected a MAD anomaly around the median, got %+v", d)
+	}
+
+	zscore := NewAnomalyDetector(20, 3.0)
+	for _, v := range values {
+		zscore.Evaluate(v)
+	}
+	if d := zscore.Evaluate(130); d.IsAnomaly || d.Method != MethodZScore {
+		t.Fatalf("expected the z-score to miss the masked value, got %+v", d)
+	}
+}
+
+func TestRollingAverage_Resize(t *testing.T) {
+	ra := NewRollingAverage(4)
+	for _, v := range []float64{1, 2, 3, 4} {
+		ra.Add(v)
+	}
+	ra.Resize(2)
+	if ra.GetCount() != 2 || ra.GetAverage() != 3.5 {
+		t.Fatalf("expected the newest 2 values, got %v", ra.Snapshot().Values)
+	}
+	ra.Resize(5)
+	ra.Add(5)
+	if ra.GetCount() != 5 || ra.GetAverage() != 3 {
+		t.Fatalf("expected the window to grow over the retained values, got %v", ra.Snapshot().Values)
+	}
+}
+
+func TestSharedDetector_Configure(t *testing.T) {
+	ctx := context.Background()
+	store := memoryWindows{}
+	shared := NewSharedDetector(store, "rps", 5, 2.0)
+	for i := 1; i <= 5; i++ {
+		shared.Evaluate(ctx, float64(i))
+	}
+
+	if err := shared.Configure(DetectorConfig{Method: MethodMAD, WindowSize: 3, Threshold: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// хранилище сохраняет все значения, статистика — по новому размеру
+	stats, err := shared.Stats(ctx)
+	if err != nil || stats.Count != 3 || stats.Average != 4 {
+		t.Fatalf("expected stats over the newest 3 values, got %+v (%v)", stats, err)
+	}
+	d, _, err := shared.Evaluate(ctx, 6)
+	if err != nil || d.Method != MethodMAD || d.Threshold != 4 {
+		t.Fatalf("expected a MAD decision with the new threshold, got %+v (%v)", d, err)
+	}
+	if len(store["rps"]) != 5 {
+		t.Fatalf("expected the stored window to keep 5 values, got %v", store["rps"])
+	}
+
+	if err := shared.Configure(DetectorConfig{Method: MethodZScore, WindowSize: 5, Threshold: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := shared.Stats(ctx); stats.Count != 5 || stats.Average != 4 {
+		t.Fatalf("expected growing the window to bring back 2..6, got %+v", stats)
+	}
+}
+
+func TestStreams_Overrides(t *testing.T) {
+	s := NewStreams(10, 2.0)
+	now := time.Now()
+	a := StreamKey{Source: "a", Metric: "rps"}
+	b := StreamKey{Source: "b", Metric: "rps"}
+	for i := 0; i < 10; i++ {
+		s.Observe(a, float64(i), now)
+		s.Observe(b, float64(i), now)
+	}
+
+	override := DetectorConfig{Method: MethodMAD, WindowSize: 4, Threshold: 5}
+	if err := s.SetOverride("a", override); err != nil {
+		t.Fatal(err)
+	}
+	if _, st := s.Observe(a, 10, now); st.Count != 4 {
+		t.Fatalf("expected the overridden window to shrink to 4, got %d", st.Count)
+	}
+	if _, st := s.Observe(b, 10, now); st.Count != 10 {
+		t.Fatalf("expected the default window for b, got %d", st.Count)
+	}
+
+	defaults := DetectorConfig{Method: MethodZScore, WindowSize: 20, Threshold: 3}
+	if err := s.SetDefault(defaults); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := s.Config("a"); !ok || c != override {
+		t.Fatalf("expected the override to stay for a, got %+v", c)
+	}
+	if c, ok := s.Config("b"); ok || c != defaults {
+		t.Fatalf("expected the new defaults for b, got %+v", c)
+	}
+	if _, st := s.Observe(b, 11, now); st.Count != 11 {
+		t.Fatalf("expected b to keep its values in the larger window, got %d", st.Count)
+	}
+
+	if !s.ClearOverride("a") || s.ClearOverride("a") {
+		t.Fatal("expected the override of a to be cleared once")
+	}
+	if len(s.Overrides()) != 0 {
+		t.Fatalf("expected no overrides, got %v", s.Overrides())
+	}
+	if d, _ := s.Observe(a, 12, now); d.Method != MethodZScore || d.Threshold != 3 {
+		t.Fatalf("expected a to use the defaults, got %+v", d)
+	}
+
+	if err := s.SetOverrides(map[string]DetectorConfig{"b": override}); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := s.Observe(b, 13, now); d.Method != MethodMAD || d.Threshold != 5 {
+		t.Fatalf("expected b to use the replaced overrides, got %+v", d)
+	}
+	if err := s.SetOverrides(map[string]DetectorConfig{"a": {}}); err == nil {
+		t.Fatal("expected an invalid override to be rejected")
+	}
+}
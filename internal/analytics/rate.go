@@ -0,0 +1,103 @@
+package analytics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+// RateCounter counts events over a sliding time window split into buckets;
+// old buckets expire as time passes, so the rate falls to zero when events
+// stop instead of freezing at the last value
+type RateCounter struct {
+	window time.Duration
+	bucket time.Duration
+	clock  clock.Clock
+	start  time.Time
+
+	mu     sync.Mutex
+	counts []int64
+	epochs []int64 // номер интервала, к которому относится счётчик бакета
+}
+
+// NewRateCounter creates a counter over window with buckets of the given
+// width (window is rounded up to a whole number of buckets). A nil clock
+// means clock.Real.
+func NewRateCounter(window, bucket time.Duration, clk clock.Clock) *RateCounter {
+	if bucket <= 0 {
+		bucket = time.Second
+	}
+	if window < bucket {
+		window = bucket
+	}
+	n := int((window + bucket - 1) / bucket)
+	rc := &RateCounter{
+		window: time.Duration(n) * bucket,
+		bucket: bucket,
+		clock:  clock.Or(clk),
+		counts: make([]int64, n),
+		epochs: make([]int64, n),
+	}
+	for i := range rc.epochs {
+		rc.epochs[i] = -1
+	}
+	rc.start = rc.clock.Now()
+	return rc
+}
+
+// Add records n events at the current time
+func (rc *RateCounter) Add(n int64) {
+	epoch := rc.epoch(rc.clock.Now())
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	i := int(epoch % int64(len(rc.counts)))
+	if rc.epochs[i] != epoch {
+		rc.epochs[i], rc.counts[i] = epoch, 0
+	}
+	rc.counts[i] += n
+}
+
+// Inc records a single event
+func (rc *RateCounter) Inc() {
+	rc.Add(1)
+}
+
+// Rate returns the number of events per unit (e.g. time.Second) over the
+// window. Until the counter has existed for a full window, the rate is taken
+// over its lifetime so that it is not underestimated right after start.
+func (rc *RateCounter) Rate(unit time.Duration) float64 {
+	now := rc.clock.Now()
+	epoch := rc.epoch(now)
+	oldest := epoch - int64(len(rc.counts)) + 1
+
+	rc.mu.Lock()
+	var total int64
+	for i, e := range rc.epochs {
+		if e >= oldest && e <= epoch {
+			total += rc.counts[i]
+		}
+	}
+	rc.mu.Unlock()
+
+	// текущий бакет заполнен лишь частично
+	span := rc.window - rc.bucket + now.Sub(time.Unix(0, epoch*int64(rc.bucket)))
+	if lifetime := now.Sub(rc.start); lifetime < span {
+		span = lifetime
+	}
+	if span < rc.bucket {
+		span = rc.bucket
+	}
+	return float64(total) * float64(unit) / float64(span)
+}
+
+// Window returns the effective window of the counter
+func (rc *RateCounter) Window() time.Duration {
+	return rc.window
+}
+
+func (rc *RateCounter) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(rc.bucket)
+}
@@ -0,0 +1,65 @@
+package analytics
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+func TestRateCounter_SteadyRate(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	rc := NewRateCounter(10*time.Second, time.Second, clk)
+
+	// 5 событий в секунду в течение 30 секунд
+	for i := 0; i < 30; i++ {
+		rc.Add(5)
+		clk.Advance(time.Second)
+	}
+	if got := rc.Rate(time.Second); math.Abs(got-5) > 0.01 {
+		t.Fatalf("expected 5/s, got %v", got)
+	}
+	if got := rc.Rate(time.Minute); math.Abs(got-300) > 0.5 {
+		t.Fatalf("expected 300/min, got %v", got)
+	}
+}
+
+func TestRateCounter_DecaysWithoutEvents(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	rc := NewRateCounter(10*time.Second, time.Second, clk)
+	for i := 0; i < 20; i++ {
+		rc.Inc()
+		clk.Advance(time.Second)
+	}
+
+	clk.Advance(5 * time.Second)
+	if got := rc.Rate(time.Second); got <= 0 || got >= 1 {
+		t.Fatalf("expected the rate to fall while events stop, got %v", got)
+	}
+	clk.Advance(10 * time.Second)
+	if got := rc.Rate(time.Second); got != 0 {
+		t.Fatalf("expected 0 once the window has passed, got %v", got)
+	}
+}
+
+func TestRateCounter_WarmUp(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	rc := NewRateCounter(time.Minute, time.Second, clk)
+
+	// за первые 2 секунды окно ещё не заполнено: делим на прожитое время
+	rc.Add(10)
+	clk.Advance(time.Second)
+	rc.Add(10)
+	clk.Advance(time.Second)
+	if got := rc.Rate(time.Second); math.Abs(got-10) > 0.01 {
+		t.Fatalf("expected 10/s during warm-up, got %v", got)
+	}
+}
+
+func TestRateCounter_RoundsWindowToBuckets(t *testing.T) {
+	rc := NewRateCounter(2500*time.Millisecond, time.Second, nil)
+	if rc.Window() != 3*time.Second {
+		t.Fatalf("expected window of 3s, got %v", rc.Window())
+	}
+}
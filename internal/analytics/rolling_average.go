@@ -7,7 +7,8 @@ import (
 // RollingAverage calculates rolling average over a sliding window
 type RollingAverage struct {
 	windowSize int
-	values     []float64
+	values     []float64 // newest retain values; the window is the newest windowSize of them
+	retain     int
 	mu         sync.RWMutex
 }
 
@@ -16,6 +17,7 @@ func NewRollingAverage(windowSize int) *RollingAverage {
 	return &RollingAverage{
 		windowSize: windowSize,
 		values:     make([]float64, 0, windowSize),
+		retain:     windowSize,
 	}
 }
 
@@ -24,10 +26,7 @@ func (ra *RollingAverage) Add(value float64) {
 	ra.mu.Lock()
 	defer ra.mu.Unlock()
 
-	ra.values = append(ra.values, value)
-	if len(ra.values) > ra.windowSize {
-		ra.values = ra.values[1:]
-	}
+	ra.values = push(ra.values, value, ra.retain)
 }
 
 // GetAverage calculates and returns the current average
@@ -35,22 +34,23 @@ func (ra *RollingAverage) GetAverage() float64 {
 	ra.mu.RLock()
 	defer ra.mu.RUnlock()
 
-	if len(ra.values) == 0 {
+	values := newest(ra.values, ra.windowSize)
+	if len(values) == 0 {
 		return 0.0
 	}
 
 	sum := 0.0
-	for _, v := range ra.values {
+	for _, v := range values {
 		sum += v
 	}
-	return sum / float64(len(ra.values))
+	return sum / float64(len(values))
 }
 
 // GetCount returns the number of values in the window
 func (ra *RollingAverage) GetCount() int {
 	ra.mu.RLock()
 	defer ra.mu.RUnlock()
-	return len(ra.values)
+	return len(newest(ra.values, ra.windowSize))
 }
 
 // Reset clears all values
@@ -0,0 +1,128 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+)
+
+// WindowStore keeps sliding windows of values outside the process, so
+// that every replica computes over the same data
+type WindowStore interface {
+	// PushWindow appends value to the window at key, keeps at least the
+	// newest size values and returns them oldest first, atomically
+	PushWindow(ctx context.Context, key string, value float64, size int) ([]float64, error)
+	// Window returns the values of the window at key, oldest first
+	Window(ctx context.Context, key string) ([]float64, error)
+}
+
+// WindowStats summarises a detector window
+type WindowStats struct {
+	Average       float64
+	StdDev        float64
+	Count         int
+	LastZ         float64
+	LastIsAnomaly bool
+}
+
+// SharedDetector computes the rolling average and z-score over a window
+// kept in a WindowStore. Decisions match AnomalyDetector for the same
+// sequence of values, but the sequence is the one seen by all replicas.
+type SharedDetector struct {
+	store WindowStore
+	key   string
+
+	mu         sync.RWMutex
+	windowSize int
+	retain     int // largest window so far, kept in the store
+	threshold  float64
+	method     Method
+}
+
+// NewSharedDetector creates a SharedDetector over the window at key
+func NewSharedDetector(store WindowStore, key string, windowSize int, threshold float64) *SharedDetector {
+	if windowSize < 1 {
+		windowSize = 50
+	}
+	if threshold <= 0 {
+		threshold = 2.0
+	}
+
+	return &SharedDetector{
+		store:      store,
+		key:        key,
+		windowSize: windowSize,
+		retain:     windowSize,
+		threshold:  threshold,
+		method:     MethodZScore,
+	}
+}
+
+// Evaluate adds value to the shared window and returns the decision along
+// with the window statistics after the update
+func (s *SharedDetector) Evaluate(ctx context.Context, value float64) (Decision, WindowStats, error) {
+	c := s.Config()
+	s.mu.RLock()
+	retain := max(s.retain, c.WindowSize)
+	s.mu.RUnlock()
+	window, err := s.store.PushWindow(ctx, s.key, value, retain)
+	if err != nil {
+		return Decision{Method: c.Method, Value: value, Threshold: c.Threshold}, WindowStats{}, err
+	}
+	window = newest(window, c.WindowSize)
+	d := evaluate(c.Method, window, c.Threshold)
+	return d, windowStats(window, d), nil
+}
+
+// Stats reads the current window statistics. The last decision is the
+// newest value evaluated against the window, as recorded by Evaluate on
+// whichever replica received it.
+func (s *SharedDetector) Stats(ctx context.Context) (WindowStats, error) {
+	c := s.Config()
+	window, err := s.store.Window(ctx, s.key)
+	if err != nil {
+		return WindowStats{}, err
+	}
+	// хранилище держит самое большое окно, судим по текущему
+	window = newest(window, c.WindowSize)
+	return windowStats(window, evaluate(c.Method, window, c.Threshold)), nil
+}
+
+// Config returns the current configuration of the detector
+func (s *SharedDetector) Config() DetectorConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return DetectorConfig{Method: s.method, WindowSize: s.windowSize, Threshold: s.threshold}
+}
+
+// Configure applies c to this replica's view of the shared window. The
+// stored window keeps the values of the largest window so far, up to
+// retainFactor windows, so shrinking and growing it again loses nothing.
+func (s *SharedDetector) Configure(c DetectorConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.method, s.windowSize, s.threshold = c.Method, c.WindowSize, c.Threshold
+	s.retain = retained(s.retain, c.WindowSize)
+	return nil
+}
+
+func windowStats(window []float64, d Decision) WindowStats {
+	mean, std := meanStd(window)
+	return WindowStats{
+		Average:       mean,
+		StdDev:        std,
+		Count:         len(window),
+		LastZ:         d.ZScore,
+		LastIsAnomaly: d.IsAnomaly,
+	}
+}
+
+func (s *SharedDetector) GetWindowSize() int {
+	return s.Config().WindowSize
+}
+
+func (s *SharedDetector) GetThreshold() float64 {
+	return s.Config().Threshold
+}
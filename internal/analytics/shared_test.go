@@ -0,0 +1,120 @@
+package analytics
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/highload-service/internal/cache"
+)
+
+// memoryWindows is a WindowStore kept in process
+type memoryWindows map[string][]float64
+
+func (m memoryWindows) PushWindow(ctx context.Context, key string, value float64, size int) ([]float64, error) {
+	w := append(m[key], value)
+	if len(w) > size {
+		w = w[len(w)-size:]
+	}
+	m[key] = w
+	return append([]float64(nil), w...), nil
+}
+
+func (m memoryWindows) Window(ctx context.Context, key string) ([]float64, error) {
+	return append([]float64(nil), m[key]...), nil
+}
+
+func TestSharedDetector_MatchesLocal(t *testing.T) {
+	ctx := context.Background()
+	local := NewAnomalyDetector(10, 2.0)
+	shared := NewSharedDetector(memoryWindows{}, "rps", 10, 2.0)
+
+	values := []float64{100, 102, 98, 101, 99, 100, 103, 97, 100, 101, 100, 1000, 100, 99}
+	for i, v := range values {
+		want := local.Evaluate(v)
+		got, stats, err := shared.Evaluate(ctx, v)
+		if err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+		if got.IsAnomaly != want.IsAnomaly || math.Abs(got.ZScore-want.ZScore) > 1e-9 {
+			t.Fatalf("value %d: shared %+v, local %+v", i, got, want)
+		}
+		mean, std, count := local.GetStats()
+		if stats.Count != count || math.Abs(stats.Average-mean) > 1e-9 || math.Abs(stats.StdDev-std) > 1e-9 {
+			t.Fatalf("value %d: shared stats %+v, local %v/%v/%d", i, stats, mean, std, count)
+		}
+	}
+}
+
+func TestSharedDetector_ReplicasSeeOneWindow(t *testing.T) {
+	ctx := context.Background()
+	store := memoryWindows{}
+	a := NewSharedDetector(store, "rps", 50, 2.0)
+	b := NewSharedDetector(store, "rps", 50, 2.0)
+
+	// каждая реплика видит только половину потока
+	for i := 0; i < 50; i++ {
+		d := a
+		if i%2 == 1 {
+			d = b
+		}
+		if _, _, err := d.Evaluate(ctx, 100+float64(i%3)); err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+
+	d, _, _ := b.Evaluate(ctx, 2000)
+	if !d.IsAnomaly {
+		t.Fatalf("expected anomaly for spike, got %+v", d)
+	}
+	stats, err := a.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Count != 50 || !stats.LastIsAnomaly || stats.LastZ != d.ZScore {
+		t.Fatalf("expected replica a to see the spike, got %+v", stats)
+	}
+}
+
+// benchmarkValue cycles through a stable series so that the cost of
+// evaluation, not of anomaly handling, is measured
+func benchmarkValue(i int) float64 {
+	return 100 + float64(i%7)
+}
+
+func BenchmarkDetector_Local(b *testing.B) {
+	d := NewAnomalyDetector(50, 2.0)
+	for i := 0; i < b.N; i++ {
+		d.Evaluate(benchmarkValue(i))
+	}
+}
+
+// BenchmarkDetector_Shared runs against miniredis, or against the Redis at
+// BENCH_REDIS_ADDR to include real network round trips
+func BenchmarkDetector_Shared(b *testing.B) {
+	addr := os.Getenv("BENCH_REDIS_ADDR")
+	if addr == "" {
+		mr := miniredis.NewMiniRedis()
+		if err := mr.Start(); err != nil {
+			b.Fatalf("failed to start miniredis: %v", err)
+		}
+		defer mr.Close()
+		addr = mr.Addr()
+	}
+	c, err := cache.NewRedisCache(addr, "", 0)
+	if err != nil {
+		b.Fatalf("failed to connect to Redis: %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	d := NewSharedDetector(c, "bench", 50, 2.0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := d.Evaluate(ctx, benchmarkValue(i)); err != nil {
+			b.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+}
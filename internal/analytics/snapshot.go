@@ -0,0 +1,87 @@
+package analytics
+
+import "time"
+
+// RollingAverageState is the serialisable state of a RollingAverage
+type RollingAverageState struct {
+	WindowSize int       `json:"window_size"`
+	Values     []float64 `json:"values"`
+}
+
+// DetectorState is the serialisable state of an AnomalyDetector
+type DetectorState struct {
+	WindowSize    int       `json:"window_size"`
+	Threshold     float64   `json:"threshold"`
+	Values        []float64 `json:"values"`
+	LastZ         float64   `json:"last_zscore"`
+	LastIsAnomaly bool      `json:"last_is_anomaly"`
+}
+
+// StreamState is the serialisable state of one per-source stream
+type StreamState struct {
+	Source         string              `json:"source"`
+	Metric         string              `json:"metric"`
+	LastSeen       time.Time           `json:"last_seen"`
+	RollingAverage RollingAverageState `json:"rolling_average"`
+	Detector       DetectorState       `json:"detector"`
+}
+
+// Snapshot captures the analytics state of a service instance so that a
+// restarted instance does not have to warm its windows up again
+type Snapshot struct {
+	TakenAt        time.Time           `json:"taken_at"`
+	RollingAverage RollingAverageState `json:"rolling_average"`
+	Detector       DetectorState       `json:"detector"`
+	Streams        []StreamState       `json:"streams,omitempty"`
+}
+
+// Snapshot returns a copy of the retained values, which may be more than
+// the current window after it was shrunk
+func (ra *RollingAverage) Snapshot() RollingAverageState {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	return RollingAverageState{
+		WindowSize: ra.windowSize,
+		Values:     append([]float64(nil), ra.values...),
+	}
+}
+
+// Restore replaces the window with the newest values of st. The configured
+// window size is kept, so a snapshot taken with a larger window is trimmed.
+func (ra *RollingAverage) Restore(st RollingAverageState) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.values = append(make([]float64, 0, ra.retain), newest(st.Values, ra.retain)...)
+}
+
+// Snapshot returns a copy of the detector state, including values retained
+// beyond the current window
+func (a *AnomalyDetector) Snapshot() DetectorState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return DetectorState{
+		WindowSize:    a.windowSize,
+		Threshold:     a.threshold,
+		Values:        append([]float64(nil), a.values...),
+		LastZ:         a.lastZ,
+		LastIsAnomaly: a.lastIsAnomaly,
+	}
+}
+
+// Restore replaces the window and last decision with those of st. The
+// configured window size and threshold are kept: a snapshot must not undo
+// a configuration change made together with the restart.
+func (a *AnomalyDetector) Restore(st DetectorState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.values = append(make([]float64, 0, a.retain), newest(st.Values, a.retain)...)
+	a.lastZ = st.LastZ
+	a.lastIsAnomaly = st.LastIsAnomaly
+}
+
+func newest(values []float64, n int) []float64 {
+	if len(values) > n {
+		return values[len(values)-n:]
+	}
+	return values
+}
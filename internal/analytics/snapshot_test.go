@@ -0,0 +1,60 @@
+package analytics
+
+import "testing"
+
+func TestAnomalyDetector_SnapshotRestore(t *testing.T) {
+	ad := NewAnomalyDetector(10, 2.0)
+	for i := 0; i < 9; i++ {
+		_ = ad.Evaluate(100 + float64(i%2))
+	}
+	want := ad.Evaluate(1000)
+
+	restored := NewAnomalyDetector(10, 2.0)
+	restored.Restore(ad.Snapshot())
+
+	mean, std, count := ad.GetStats()
+	gotMean, gotStd, gotCount := restored.GetStats()
+	if gotMean != mean || gotStd != std || gotCount != count {
+		t.Fatalf("expected stats %v/%v/%d, got %v/%v/%d", mean, std, count, gotMean, gotStd, gotCount)
+	}
+	if z, isA := restored.GetLastDecision(); z != want.ZScore || !isA {
+		t.Fatalf("expected last decision %v/true, got %v/%v", want.ZScore, z, isA)
+	}
+	// восстановленный детектор продолжает с того же окна
+	if a, b := ad.Evaluate(100), restored.Evaluate(100); a != b {
+		t.Fatalf("expected identical decisions after restore, got %+v and %+v", a, b)
+	}
+}
+
+func TestAnomalyDetector_RestoreKeepsConfig(t *testing.T) {
+	big := NewAnomalyDetector(10, 3.0)
+	for i := 0; i < 10; i++ {
+		_ = big.Evaluate(float64(i))
+	}
+
+	small := NewAnomalyDetector(4, 2.0)
+	small.Restore(big.Snapshot())
+	if small.GetWindowSize() != 4 || small.GetThreshold() != 2.0 {
+		t.Fatalf("expected the configured window and threshold to be kept")
+	}
+	if mean, _, count := small.GetStats(); count != 4 || mean != 7.5 {
+		t.Fatalf("expected the newest 4 values, got mean=%v count=%d", mean, count)
+	}
+}
+
+func TestRollingAverage_SnapshotRestore(t *testing.T) {
+	ra := NewRollingAverage(5)
+	for i := 1; i <= 7; i++ {
+		ra.Add(float64(i))
+	}
+
+	restored := NewRollingAverage(3)
+	restored.Restore(ra.Snapshot())
+	if got := restored.GetAverage(); got != 6 || restored.GetCount() != 3 {
+		t.Fatalf("expected avg 6 over 3 values, got %v over %d", got, restored.GetCount())
+	}
+	restored.Add(8)
+	if got := restored.GetAverage(); got != 7 {
+		t.Fatalf("expected 7, got %v", got)
+	}
+}
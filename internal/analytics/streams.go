@@ -0,0 +1,328 @@
+package analytics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StreamKey identifies one metric of one source
+type StreamKey struct {
+	Source string
+	Metric string
+}
+
+// StreamStats describes the window of a stream after an update
+type StreamStats struct {
+	RollingAverage float64
+	Mean           float64
+	StdDev         float64
+	LastZ          float64
+	LastIsAnomaly  bool
+	Count          int
+}
+
+type stream struct {
+	avg      *RollingAverage
+	detector *AnomalyDetector
+	lastSeen time.Time
+}
+
+// OverflowSource is the source whose windows are shared by the sources
+// beyond the limit set by SetLimit
+const OverflowSource = "__overflow__"
+
+// Streams keeps a separate window per source and metric, so that each
+// stream is judged against its own history. At most maxSources sources get
+// their own windows; further sources share the OverflowSource windows, so a
+// client sending random source names cannot grow the map without bound.
+type Streams struct {
+	mu         sync.Mutex
+	maxSources int
+	defaults   DetectorConfig
+	overrides  map[string]DetectorConfig // по источнику
+	streams    map[StreamKey]*stream
+	sources    map[string]int // число потоков источника
+}
+
+// NewStreams creates an empty set of streams with the given window settings
+func NewStreams(windowSize int, threshold float64) *Streams {
+	return &Streams{
+		defaults:  DetectorConfig{Method: MethodZScore, WindowSize: windowSize, Threshold: threshold},
+		overrides: make(map[string]DetectorConfig),
+		streams:   make(map[StreamKey]*stream),
+		sources:   make(map[string]int),
+	}
+}
+
+// SetLimit sets the maximum number of sources with their own windows
+// (0 means unlimited). Sources with an override always get their own.
+func (s *Streams) SetLimit(maxSources int) {
+	s.mu.Lock()
+	s.maxSources = maxSources
+	s.mu.Unlock()
+}
+
+// resolveLocked returns the key the stream at key is tracked under: key
+// itself, or its OverflowSource counterpart once the limit is reached
+func (s *Streams) resolveLocked(key StreamKey) StreamKey {
+	if _, ok := s.sources[key.Source]; ok || s.maxSources <= 0 || len(s.sources) < s.maxSources {
+		return key
+	}
+	if _, ok := s.overrides[key.Source]; ok {
+		return key
+	}
+	return StreamKey{Source: OverflowSource, Metric: key.Metric}
+}
+
+// Observe adds value to the stream at key, creating it on first use. Once
+// the limit is reached, new sources are observed in the overflow stream.
+func (s *Streams) Observe(key StreamKey, value float64, now time.Time) (Decision, StreamStats) {
+	s.mu.Lock()
+	key = s.resolveLocked(key)
+	st, ok := s.streams[key]
+	if !ok {
+		st = s.addLocked(key)
+	}
+	st.lastSeen = now
+	s.mu.Unlock()
+
+	st.avg.Add(value)
+	d := st.detector.Evaluate(value)
+	mean, std, count := st.detector.GetStats()
+	return d, StreamStats{
+		RollingAverage: st.avg.GetAverage(),
+		Mean:           mean,
+		StdDev:         std,
+		LastZ:          d.ZScore,
+		LastIsAnomaly:  d.IsAnomaly,
+		Count:          count,
+	}
+}
+
+// addLocked creates the stream at key with the configuration of its source
+func (s *Streams) addLocked(key StreamKey) *stream {
+	c := s.configLocked(key.Source)
+	st := &stream{
+		avg:      NewRollingAverage(c.WindowSize),
+		detector: NewAnomalyDetector(c.WindowSize, c.Threshold),
+	}
+	st.detector.Configure(c)
+	s.streams[key] = st
+	s.sources[key.Source]++
+	return st
+}
+
+// Snapshot returns the state of every stream, ordered by source and metric
+func (s *Streams) Snapshot() []StreamState {
+	s.mu.Lock()
+	states := make([]StreamState, 0, len(s.streams))
+	for k, st := range s.streams {
+		states = append(states, StreamState{
+			Source:         k.Source,
+			Metric:         k.Metric,
+			LastSeen:       st.lastSeen,
+			RollingAverage: st.avg.Snapshot(),
+			Detector:       st.detector.Snapshot(),
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Source != states[j].Source {
+			return states[i].Source < states[j].Source
+		}
+		return states[i].Metric < states[j].Metric
+	})
+	return states
+}
+
+// Restore recreates the streams of states and returns how many were
+// restored. Windows are sized by the current configuration of their source;
+// streams beyond the source limit are skipped.
+func (s *Streams) Restore(states []StreamState) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restored := 0
+	for _, state := range states {
+		key := StreamKey{Source: state.Source, Metric: state.Metric}
+		if s.resolveLocked(key) != key {
+			continue
+		}
+		st, ok := s.streams[key]
+		if !ok {
+			st = s.addLocked(key)
+		}
+		st.avg.Restore(state.RollingAverage)
+		st.detector.Restore(state.Detector)
+		st.lastSeen = state.LastSeen
+		restored++
+	}
+	return restored
+}
+
+// Stats returns the statistics of the stream at key, if it is tracked
+func (s *Streams) Stats(key StreamKey) (StreamStats, bool) {
+	s.mu.Lock()
+	st, ok := s.streams[key]
+	s.mu.Unlock()
+	if !ok {
+		return StreamStats{}, false
+	}
+	mean, std, count := st.detector.GetStats()
+	z, isAnomaly := st.detector.GetLastDecision()
+	return StreamStats{
+		RollingAverage: st.avg.GetAverage(),
+		Mean:           mean,
+		StdDev:         std,
+		LastZ:          z,
+		LastIsAnomaly:  isAnomaly,
+		Count:          count,
+	}, true
+}
+
+// Config returns the configuration the streams of source are judged with
+// and whether it is an override of the defaults
+func (s *Streams) Config(source string) (DetectorConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.overrides[source]
+	if !ok {
+		c = s.defaults
+	}
+	return c, ok
+}
+
+// Overrides returns a copy of the per-source overrides
+func (s *Streams) Overrides() map[string]DetectorConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]DetectorConfig, len(s.overrides))
+	for source, c := range s.overrides {
+		out[source] = c
+	}
+	return out
+}
+
+// SetDefault changes the configuration of every source without an
+// override, resizing their windows in place
+func (s *Streams) SetDefault(c DetectorConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaults = c
+	for k, st := range s.streams {
+		if _, ok := s.overrides[k.Source]; !ok {
+			st.configure(c)
+		}
+	}
+	return nil
+}
+
+// SetOverride judges the streams of source with c instead of the defaults.
+// Overrides survive Prune, so a source that comes back keeps its settings.
+func (s *Streams) SetOverride(source string, c DetectorConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[source] = c
+	s.configureSourceLocked(source, c)
+	return nil
+}
+
+// SetOverrides replaces every per-source override, e.g. with those another
+// replica stored
+func (s *Streams) SetOverrides(overrides map[string]DetectorConfig) error {
+	for _, c := range overrides {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = make(map[string]DetectorConfig, len(overrides))
+	for source, c := range overrides {
+		s.overrides[source] = c
+	}
+	for k, st := range s.streams {
+		st.configure(s.configLocked(k.Source))
+	}
+	return nil
+}
+
+// ClearOverride returns source to the defaults and reports whether it had
+// an override
+func (s *Streams) ClearOverride(source string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.overrides[source]; !ok {
+		return false
+	}
+	delete(s.overrides, source)
+	s.configureSourceLocked(source, s.defaults)
+	return true
+}
+
+func (s *Streams) configLocked(source string) DetectorConfig {
+	if c, ok := s.overrides[source]; ok {
+		return c
+	}
+	return s.defaults
+}
+
+func (s *Streams) configureSourceLocked(source string, c DetectorConfig) {
+	for k, st := range s.streams {
+		if k.Source == source {
+			st.configure(c)
+		}
+	}
+}
+
+func (st *stream) configure(c DetectorConfig) {
+	st.avg.Resize(c.WindowSize)
+	st.detector.Configure(c)
+}
+
+// Prune drops streams not observed since before and returns their keys
+func (s *Streams) Prune(before time.Time) []StreamKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned []StreamKey
+	for k, st := range s.streams {
+		if st.lastSeen.Before(before) {
+			delete(s.streams, k)
+			if s.sources[k.Source]--; s.sources[k.Source] == 0 {
+				delete(s.sources, k.Source)
+			}
+			pruned = append(pruned, k)
+		}
+	}
+	sort.Slice(pruned, func(i, j int) bool {
+		if pruned[i].Source != pruned[j].Source {
+			return pruned[i].Source < pruned[j].Source
+		}
+		return pruned[i].Metric < pruned[j].Metric
+	})
+	return pruned
+}
+
+// Len returns the number of tracked streams
+func (s *Streams) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Sources returns the number of sources with their own windows, including
+// the overflow source
+func (s *Streams) Sources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sources)
+}
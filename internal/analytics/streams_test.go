@@ -0,0 +1,119 @@
+package analytics
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreams_SeparateWindows(t *testing.T) {
+	s := NewStreams(10, 2.0)
+	now := time.Now()
+	quiet := StreamKey{Source: "quiet", Metric: "rps"}
+	loud := StreamKey{Source: "loud", Metric: "rps"}
+
+	for i := 0; i < 9; i++ {
+		s.Observe(quiet, 10+float64(i%2), now)
+		s.Observe(loud, 1000+float64(i%2), now)
+	}
+	// 1000 — норма для loud, но аномалия для quiet
+	if d, _ := s.Observe(loud, 1000, now); d.IsAnomaly {
+		t.Fatalf("expected no anomaly in loud stream, got %+v", d)
+	}
+	d, st := s.Observe(quiet, 1000, now)
+	if !d.IsAnomaly {
+		t.Fatalf("expected anomaly in quiet stream, got %+v", d)
+	}
+	if st.Count != 10 || st.LastZ != d.ZScore {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestStreams_Prune(t *testing.T) {
+	s := NewStreams(10, 2.0)
+	start := time.Now()
+	s.Observe(StreamKey{"b", "rps"}, 1, start)
+	s.Observe(StreamKey{"a", "rps"}, 1, start)
+	s.Observe(StreamKey{"a", "cpu"}, 1, start.Add(time.Minute))
+
+	pruned := s.Prune(start.Add(time.Second))
+	want := []StreamKey{{"a", "rps"}, {"b", "rps"}}
+	if !reflect.DeepEqual(pruned, want) {
+		t.Fatalf("expected %v pruned, got %v", want, pruned)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 stream left, got %d", s.Len())
+	}
+}
+
+func TestStreams_Limit(t *testing.T) {
+	s := NewStreams(1000, 2.0)
+	s.SetLimit(2)
+	now := time.Now()
+	s.Observe(StreamKey{"a", "rps"}, 1, now)
+	s.Observe(StreamKey{"a", "cpu"}, 1, now)
+	s.Observe(StreamKey{"b", "rps"}, 1, now)
+
+	// новые источники сверх лимита делят окна переполнения
+	for i := 0; i < 100; i++ {
+		s.Observe(StreamKey{fmt.Sprintf("random-%d", i), "rps"}, 1, now)
+	}
+	if s.Sources() != 3 || s.Len() != 4 {
+		t.Fatalf("expected a, b and the overflow source, got %d sources / %d streams", s.Sources(), s.Len())
+	}
+	if _, st := s.Observe(StreamKey{"random-0", "rps"}, 1, now); st.Count != 101 {
+		t.Fatalf("expected the overflow window to collect every extra source, got %d", st.Count)
+	}
+	if _, ok := s.Stats(StreamKey{"random-0", "rps"}); ok {
+		t.Fatal("expected no own window for a source beyond the limit")
+	}
+	if _, st := s.Observe(StreamKey{"a", "rps"}, 1, now); st.Count != 2 {
+		t.Fatalf("expected known sources to keep their windows, got %d", st.Count)
+	}
+
+	// источник с переопределением получает своё окно и сверх лимита
+	s.SetOverride("vip", DetectorConfig{Method: MethodZScore, WindowSize: 5, Threshold: 3})
+	if _, st := s.Observe(StreamKey{"vip", "rps"}, 1, now); st.Count != 1 {
+		t.Fatalf("expected an own window for an overridden source, got %d", st.Count)
+	}
+
+	// простаивающие источники освобождают место
+	s.Prune(now.Add(time.Second))
+	if s.Sources() != 0 {
+		t.Fatalf("expected every source pruned, got %d", s.Sources())
+	}
+	if _, st := s.Observe(StreamKey{"c", "rps"}, 1, now); st.Count != 1 {
+		t.Fatalf("expected a new source to get its own window after pruning, got %d", st.Count)
+	}
+	if _, ok := s.Stats(StreamKey{"c", "rps"}); !ok {
+		t.Fatal("expected c to be tracked")
+	}
+}
+
+func TestStreams_SnapshotRestore(t *testing.T) {
+	s := NewStreams(10, 2.0)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		s.Observe(StreamKey{"b", "rps"}, float64(i), now)
+		s.Observe(StreamKey{"a", "rps"}, float64(i), now)
+	}
+	states := s.Snapshot()
+	if len(states) != 2 || states[0].Source != "a" || len(states[0].Detector.Values) != 5 {
+		t.Fatalf("unexpected snapshot %+v", states)
+	}
+
+	restored := NewStreams(3, 2.0)
+	restored.SetLimit(1)
+	if n := restored.Restore(states); n != 1 {
+		t.Fatalf("expected only one source restored under the limit, got %d", n)
+	}
+	st, ok := restored.Stats(StreamKey{"a", "rps"})
+	if !ok || st.Count != 3 || st.Mean != 3 {
+		t.Fatalf("expected the newest 3 values of a in the current window, got %+v", st)
+	}
+	// время последнего значения восстанавливается, так что простой учитывается
+	if pruned := restored.Prune(now.Add(time.Second)); len(pruned) != 1 {
+		t.Fatalf("expected the restored stream to be idle since the snapshot, got %v", pruned)
+	}
+}
@@ -0,0 +1,237 @@
+package anomalies
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/highload-service/internal/cache"
+	"github.com/highload-service/internal/clock"
+)
+
+// RedisKey is the sorted set used when the store is backed by Redis
+const RedisKey = "anomalies"
+
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// ErrInvalidCursor is returned by Query for cursors it did not issue
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Event is a single detected anomaly
+type Event struct {
+	ID        uint64    `json:"id"`
+	Timestamp int64     `json:"timestamp"`
+	Source    string    `json:"source"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	ZScore    float64   `json:"zscore"`
+	Mean      float64   `json:"mean"`
+	StdDev    float64   `json:"std_dev"`
+	Threshold float64   `json:"threshold"`
+	Detector  string    `json:"detector"`
+	Severity  string    `json:"severity"`
+	Detected  time.Time `json:"detected_at"`
+}
+
+// Severity classifies a z-score relative to the detector threshold:
+// anything beyond twice the threshold is critical
+func Severity(z, threshold float64) string {
+	if threshold > 0 && math.Abs(z) >= 2*threshold {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+func severityRank(s string) int {
+	if s == SeverityCritical {
+		return 1
+	}
+	return 0
+}
+
+// ValidSeverity reports whether s is a known severity level
+func ValidSeverity(s string) bool {
+	return s == SeverityWarning || s == SeverityCritical
+}
+
+// Query selects events; zero values mean "no filter"
+type Query struct {
+	From     int64 // inclusive, unix seconds
+	To       int64 // inclusive, unix seconds
+	Source   string
+	Severity string // minimum severity
+	Limit    int
+	Cursor   string
+}
+
+// Page is one page of query results, newest first
+type Page struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// Store keeps a bounded history of anomaly events in memory, optionally
+// mirrored to a cache.Log so the history is shared and survives restarts
+type Store struct {
+	capacity int
+	events   []Event
+	lastID   uint64
+	backing  cache.Log
+	clock    clock.Clock
+
+	mu sync.RWMutex
+}
+
+// NewStore creates a new Store holding at most capacity events; clk stamps
+// their detection time and IDs (default clock.Real)
+func NewStore(capacity int, backing cache.Log, clk clock.Clock) *Store {
+	if capacity < 1 {
+		capacity = 1000
+	}
+
+	return &Store{
+		capacity: capacity,
+		events:   make([]Event, 0, capacity),
+		backing:  backing,
+		clock:    clock.Or(clk),
+	}
+}
+
+// Add records an event, assigning its ID and detection time. The event is
+// always kept in memory; the error reports a failed write to the backing log.
+func (s *Store) Add(ctx context.Context, e Event) (Event, error) {
+	s.mu.Lock()
+	now := s.clock.Now()
+	id := uint64(now.UnixNano())
+	if id <= s.lastID {
+		id = s.lastID + 1
+	}
+	s.lastID = id
+	e.ID = id
+	e.Detected = now
+	if e.Severity == "" {
+		e.Severity = Severity(e.ZScore, e.Threshold)
+	}
+
+	s.events = append(s.events, e)
+	if len(s.events) > s.capacity {
+		s.events = s.events[1:]
+	}
+	s.mu.Unlock()
+
+	if s.backing != nil {
+		if err := s.backing.Append(ctx, RedisKey, float64(e.Timestamp), e, int64(s.capacity)); err != nil {
+			return e, fmt.Errorf("failed to persist anomaly event: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// Len returns the number of events held in memory
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.events)
+}
+
+// Query returns events matching q, newest first. When the store is backed
+// by a cache the shared history is queried, falling back to memory on error
+// unless ctx is done.
+func (s *Store) Query(ctx context.Context, q Query) (Page, error) {
+	var before uint64 = math.MaxUint64
+	if q.Cursor != "" {
+		c, err := strconv.ParseUint(q.Cursor, 36, 64)
+		if err != nil || c == 0 {
+			return Page{}, ErrInvalidCursor
+		}
+		before = c
+	}
+	if q.Limit <= 0 || q.Limit > s.capacity {
+		q.Limit = s.capacity
+	}
+
+	candidates, err := s.loadBacking(ctx, q)
+	if err != nil && ctx.Err() != nil {
+		return Page{}, err
+	}
+	if err != nil || candidates == nil {
+		if err != nil {
+			slog.Warn("Failed to read anomaly history, serving from memory", "error", err)
+		}
+		s.mu.RLock()
+		candidates = make([]Event, len(s.events))
+		copy(candidates, s.events)
+		s.mu.RUnlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID > candidates[j].ID })
+
+	page := Page{Events: make([]Event, 0)}
+	for _, e := range candidates {
+		if e.ID >= before || !q.matches(e) {
+			continue
+		}
+		if len(page.Events) == q.Limit {
+			last := page.Events[len(page.Events)-1]
+			page.NextCursor = strconv.FormatUint(last.ID, 36)
+			break
+		}
+		page.Events = append(page.Events, e)
+	}
+	return page, nil
+}
+
+func (s *Store) loadBacking(ctx context.Context, q Query) ([]Event, error) {
+	if s.backing == nil {
+		return nil, nil
+	}
+
+	min, max := math.Inf(-1), math.Inf(1)
+	if q.From != 0 {
+		min = float64(q.From)
+	}
+	if q.To != 0 {
+		max = float64(q.To)
+	}
+
+	raw, err := s.backing.Range(ctx, RedisKey, min, max)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, len(raw))
+	for _, b := range raw {
+		var e Event
+		if err := json.Unmarshal(b, &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (q Query) matches(e Event) bool {
+	if q.From != 0 && e.Timestamp < q.From {
+		return false
+	}
+	if q.To != 0 && e.Timestamp > q.To {
+		return false
+	}
+	if q.Source != "" && e.Source != q.Source {
+		return false
+	}
+	if q.Severity != "" && severityRank(e.Severity) < severityRank(q.Severity) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package anomalies
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+func TestStore_BoundedCapacity(t *testing.T) {
+	ctx := context.Background()
+	s := NewStore(3, nil, nil)
+	for i := 1; i <= 5; i++ {
+		s.Add(ctx, Event{Timestamp: int64(i), Source: "a", ZScore: 3, Threshold: 2})
+	}
+
+	if got := s.Len(); got != 3 {
+		t.Fatalf("expected 3 events, got %d", got)
+	}
+
+	page, err := s.Query(ctx, Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 3 || page.Events[0].Timestamp != 5 || page.Events[2].Timestamp != 3 {
+		t.Fatalf("expected newest three events, got %+v", page.Events)
+	}
+}
+
+func TestStore_Filters(t *testing.T) {
+	ctx := context.Background()
+	s := NewStore(100, nil, nil)
+	s.Add(ctx, Event{Timestamp: 10, Source: "a", ZScore: 2.5, Threshold: 2})
+	s.Add(ctx, Event{Timestamp: 20, Source: "b", ZScore: -5, Threshold: 2})
+	s.Add(ctx, Event{Timestamp: 30, Source: "a", ZScore: 4, Threshold: 2})
+
+	page, _ := s.Query(ctx, Query{Source: "a"})
+	if len(page.Events) != 2 {
+		t.Fatalf("expected 2 events for source a, got %d", len(page.Events))
+	}
+
+	page, _ = s.Query(ctx, Query{Severity: SeverityCritical})
+	if len(page.Events) != 2 || page.Events[0].Timestamp != 30 || page.Events[1].Timestamp != 20 {
+		t.Fatalf("expected 2 critical events, got %+v", page.Events)
+	}
+
+	page, _ = s.Query(ctx, Query{From: 15, To: 25})
+	if len(page.Events) != 1 || page.Events[0].Source != "b" {
+		t.Fatalf("expected single event in range, got %+v", page.Events)
+	}
+}
+
+func TestStore_CursorPagination(t *testing.T) {
+	ctx := context.Background()
+	s := NewStore(100, nil, nil)
+	for i := 1; i <= 5; i++ {
+		s.Add(ctx, Event{Timestamp: int64(i), Source: "a", ZScore: 3, Threshold: 2})
+	}
+
+	var seen []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("pagination did not terminate")
+		}
+		page, err := s.Query(ctx, Query{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page.Events {
+			seen = append(seen, e.Timestamp)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	want := []int64{5, 4, 3, 2, 1}
+	if len(seen) != len(want) {
+		t.Fatalf("expected %v, got %v", want, seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, seen)
+		}
+	}
+
+	if _, err := s.Query(ctx, Query{Cursor: "!"}); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestStore_UsesClock(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Unix(1000, 0))
+	s := NewStore(10, nil, clk)
+
+	first, _ := s.Add(ctx, Event{Timestamp: 1})
+	second, _ := s.Add(ctx, Event{Timestamp: 2})
+	if !first.Detected.Equal(time.Unix(1000, 0)) || !second.Detected.Equal(time.Unix(1000, 0)) {
+		t.Fatalf("expected detection times from the clock, got %v and %v", first.Detected, second.Detected)
+	}
+	// на замерших часах ID всё равно растут
+	if second.ID <= first.ID {
+		t.Fatalf("expected increasing IDs, got %d then %d", first.ID, second.ID)
+	}
+	clk.Advance(time.Minute)
+	if e, _ := s.Add(ctx, Event{Timestamp: 3}); !e.Detected.Equal(time.Unix(1060, 0)) {
+		t.Fatalf("expected the advanced time, got %v", e.Detected)
+	}
+}
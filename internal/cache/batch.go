@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// OpKind is the kind of a buffered write
+type OpKind int
+
+const (
+	OpSet OpKind = iota
+	OpAppend
+	OpAddPoint
+	OpObserve
+)
+
+// Op is a single write that can be buffered and applied later. Values are
+// kept pre-marshalled so replays store exactly what was originally sent.
+type Op struct {
+	Kind   OpKind
+	Key    string // key for Set/Append, source for AddPoint/Observe
+	Score  float64
+	TS     time.Time
+	TTL    time.Duration
+	MaxLen int64
+	Data   json.RawMessage
+	Values map[string]float64
+}
+
+// Apply performs op against c
+func (op Op) Apply(ctx context.Context, c Cache) error {
+	switch op.Kind {
+	case OpSet:
+		return c.Set(ctx, op.Key, op.Data, op.TTL)
+	case OpAppend:
+		return c.Append(ctx, op.Key, op.Score, op.Data, op.MaxLen)
+	case OpAddPoint:
+		return c.AddPoint(ctx, op.Key, op.TS, op.Data, op.MaxLen)
+	case OpObserve:
+		if r, ok := c.(Rollups); ok {
+			return r.Observe(ctx, op.Key, op.TS, op.Values)
+		}
+	}
+	return nil
+}
+
+// Batcher is implemented by caches that can apply many writes in one
+// round trip
+type Batcher interface {
+	WriteBatch(ctx context.Context, ops []Op) error
+}
+
+// BatchError is returned when only part of a batch was applied. Batches
+// are not transactional, so a retry must resend only Failed: resending the
+// whole batch would apply increments and appends twice.
+type BatchError struct {
+	// Failed were not applied and can be resent
+	Failed []Op
+	// Unknown lost their reply, e.g. to a timeout: the primary may have
+	// applied them, so resending them could apply them twice
+	Unknown []Op
+	Err     error
+}
+
+func (e *BatchError) Error() string { return e.Err.Error() }
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// Unapplied returns the ops of a failed batch that were surely not
+// applied: those reported by a BatchError, none after a timeout, or all
+// of them
+func Unapplied(ops []Op, err error) []Op {
+	var be *BatchError
+	if errors.As(err, &be) {
+		return be.Failed
+	}
+	if isTimeout(err) {
+		return nil
+	}
+	return ops
+}
+
+// Unconfirmed returns the ops of a failed batch that may have been applied
+func Unconfirmed(ops []Op, err error) []Op {
+	var be *BatchError
+	if errors.As(err, &be) {
+		return be.Unknown
+	}
+	if isTimeout(err) {
+		return ops
+	}
+	return nil
+}
+
+// isTimeout reports whether err is a deadline that ran out
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// WriteBatch applies ops to c, in a single round trip when c supports it
+func WriteBatch(ctx context.Context, c Cache, ops []Op) error {
+	if b, ok := c.(Batcher); ok {
+		return b.WriteBatch(ctx, ops)
+	}
+	for i, op := range ops {
+		if err := op.Apply(ctx, c); err != nil {
+			if isTimeout(err) {
+				return &BatchError{Unknown: ops[i : i+1], Failed: ops[i+1:], Err: err}
+			}
+			return &BatchError{Failed: ops[i:], Err: err}
+		}
+	}
+	return nil
+}
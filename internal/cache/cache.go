@@ -1,8 +1,86 @@
 package cache
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
+// ErrNotFound is returned by Get for missing or expired keys
+var ErrNotFound = errors.New("key not found")
+
+// Cache stores ingested metrics and reads their history back. Every
+// operation honours the deadline and cancellation of its context.
 type Cache interface {
-	Set(key string, value interface{}, ttl time.Duration) error
+	Log
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	// AddPoint stores a metric point of source, keeping at most maxLen
+	// points per source (maxLen <= 0 disables trimming)
+	AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error
+	// RangePoints returns points of source within [from, to] ordered by
+	// timestamp; an empty source reads every known source
+	RangePoints(ctx context.Context, source string, from, to time.Time) ([]Point, error)
 	Close() error
 }
+
+// PointLimiter is implemented by caches that can bound a history read on
+// the store itself instead of loading every matching point
+type PointLimiter interface {
+	// RangePointsLimit is RangePoints that reads sources in name order and
+	// stops once limit points were read (limit <= 0 reads them all)
+	RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]Point, error)
+}
+
+// RangePointsLimit reads at most limit points from c, bounding the read
+// itself when c supports it
+func RangePointsLimit(ctx context.Context, c Cache, source string, from, to time.Time, limit int64) ([]Point, error) {
+	if l, ok := c.(PointLimiter); ok {
+		return l.RangePointsLimit(ctx, source, from, to, limit)
+	}
+	points, err := c.RangePoints(ctx, source, from, to)
+	if limit > 0 && int64(len(points)) > limit {
+		points = points[:limit]
+	}
+	return points, err
+}
+
+// Log is implemented by caches that can keep a bounded, score-ordered
+// log of records under a single key
+type Log interface {
+	// Append adds value to the log at key and trims it to the newest
+	// maxLen records (maxLen <= 0 disables trimming)
+	Append(ctx context.Context, key string, score float64, value interface{}, maxLen int64) error
+	// Range returns the raw records with min <= score <= max in ascending order
+	Range(ctx context.Context, key string, min, max float64) ([][]byte, error)
+}
+
+// Migrator is implemented by caches that can move points stored by older
+// layouts into their own
+type Migrator interface {
+	MigrateLegacy(ctx context.Context, defaultSource string, maxLen int64) (int, error)
+}
+
+// SourcePruner is implemented by caches that can forget sources whose
+// newest point is older than before; now stands for sources of unknown age
+type SourcePruner interface {
+	PruneSources(ctx context.Context, now, before time.Time) (int, error)
+}
+
+// ErrConflict is returned by SetIfRevision when the stored value has
+// another revision
+var ErrConflict = errors.New("value was changed concurrently")
+
+// RevisionSetter is implemented by caches that can replace a value only if
+// nobody replaced it since it was read
+type RevisionSetter interface {
+	// SetIfRevision stores value at key if the key is missing or the
+	// "revision" field of the stored JSON equals revision, or returns
+	// ErrConflict
+	SetIfRevision(ctx context.Context, key string, revision int64, value interface{}) error
+}
+
+// Getter is implemented by caches that can read back values stored by Set
+type Getter interface {
+	// Get decodes the value at key into dest, or returns ErrNotFound
+	Get(ctx context.Context, key string, dest interface{}) error
+}
@@ -0,0 +1,508 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+// ErrDegraded is returned for operations that cannot be served while the
+// primary cache is unavailable
+var ErrDegraded = errors.New("cache is degraded")
+
+// Pinger is implemented by caches that can check their connection
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// callerDone reports whether a failure is due to the caller's context
+// running out rather than to the primary itself. Such failures are
+// returned as is: they neither degrade the cache nor get journaled.
+func callerDone(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
+
+// callerCanceled reports whether the caller gave up on a write. A write
+// whose deadline ran out is not dropped: if the primary surely did not
+// apply it, it is journaled like any other failure.
+func callerCanceled(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// FallbackOptions configures FallbackCache
+type FallbackOptions struct {
+	// BufferSize bounds both the in-memory copy and the replay journal
+	BufferSize int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ReplayBatch is the number of journaled writes sent per round trip on
+	// recovery
+	ReplayBatch int
+	// ReplayTimeout bounds the reconnect check and each replayed batch
+	ReplayTimeout time.Duration
+	// TimeoutLimit is the number of writes in a row whose reply was lost
+	// before the cache degrades (default 3)
+	TimeoutLimit int
+	// OnStateChange is called whenever the cache enters or leaves degraded mode
+	OnStateChange func(degraded bool)
+	// Clock expires the TTLs of buffered values (default clock.Real)
+	Clock clock.Clock
+}
+
+// FallbackCache serves a primary cache (Redis) and keeps the service
+// working while it is down: writes go to a bounded MemoryCache and a
+// replay journal, reads are served from memory, and a background loop
+// reconnects with exponential backoff and replays buffered writes on
+// recovery. Reconnects and replays run on a background context.
+type FallbackCache struct {
+	connect func() (Cache, error)
+	opts    FallbackOptions
+
+	primary  Cache
+	memory   *MemoryCache
+	journal  []Op
+	dropped  int
+	degraded bool
+	timeouts atomic.Int64 // записи подряд, оставшиеся без ответа
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.RWMutex
+}
+
+// NewFallbackCache connects to the primary cache, starting in degraded
+// mode with a reconnect loop if the first attempt fails
+func NewFallbackCache(connect func() (Cache, error), opts FallbackOptions) *FallbackCache {
+	if opts.BufferSize < 1 {
+		opts.BufferSize = 10000
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.ReplayBatch < 1 {
+		opts.ReplayBatch = 500
+	}
+	if opts.ReplayTimeout <= 0 {
+		opts.ReplayTimeout = 5 * time.Second
+	}
+	if opts.TimeoutLimit < 1 {
+		opts.TimeoutLimit = 3
+	}
+	opts.Clock = clock.Or(opts.Clock)
+
+	f := &FallbackCache{
+		connect: connect,
+		opts:    opts,
+		memory:  newMemoryCache(opts.BufferSize, opts.Clock),
+		stop:    make(chan struct{}),
+	}
+
+	primary, err := connect()
+	if err != nil {
+		f.markDegraded(err)
+		return f
+	}
+	f.primary = primary
+	return f
+}
+
+// Degraded reports whether the primary cache is currently unavailable
+func (f *FallbackCache) Degraded() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.degraded
+}
+
+// Ping checks the primary without changing the degraded state, so that a
+// probe with a short deadline does not switch writes to memory
+func (f *FallbackCache) Ping(ctx context.Context) error {
+	primary, _ := f.reader()
+	if primary == nil {
+		return ErrDegraded
+	}
+	if p, ok := primary.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Buffered returns the number of writes waiting to be replayed
+func (f *FallbackCache) Buffered() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.journal)
+}
+
+// Primary returns the primary cache, or nil if it has never connected
+func (f *FallbackCache) Primary() Cache {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.primary
+}
+
+func (f *FallbackCache) markDegraded(cause error) {
+	f.mu.Lock()
+	if f.degraded {
+		f.mu.Unlock()
+		return
+	}
+	f.degraded = true
+	f.mu.Unlock()
+
+	slog.Warn("Cache degraded, buffering writes in memory", "error", cause)
+	if f.opts.OnStateChange != nil {
+		f.opts.OnStateChange(true)
+	}
+	go f.reconnectLoop()
+}
+
+func (f *FallbackCache) reconnectLoop() {
+	backoff := f.opts.MinBackoff
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		err := f.recover()
+		if err == nil {
+			return
+		}
+		slog.Warn("Cache still unavailable", "retry_in", backoff, "error", err)
+
+		backoff *= 2
+		if backoff > f.opts.MaxBackoff {
+			backoff = f.opts.MaxBackoff
+		}
+	}
+}
+
+// recover reconnects to the primary and replays the journal. The journal
+// is taken out under the lock and replayed in batches outside it, so writes
+// made meanwhile keep going to memory and the journal, and reads keep being
+// served from memory. The cache leaves degraded mode once a pass under the
+// lock finds nothing left to replay, which preserves the order of writes.
+func (f *FallbackCache) recover() error {
+	primary, err := f.reconnect()
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for {
+		f.mu.Lock()
+		pending := f.journal
+		f.journal = nil
+		if len(pending) == 0 {
+			slog.Info("Cache recovered", "replayed", replayed, "dropped", f.dropped)
+			f.memory = newMemoryCache(f.opts.BufferSize, f.opts.Clock)
+			f.dropped = 0
+			f.degraded = false
+			f.timeouts.Store(0)
+			if f.opts.OnStateChange != nil {
+				f.opts.OnStateChange(false)
+			}
+			f.mu.Unlock()
+			return nil
+		}
+		f.mu.Unlock()
+
+		n, left, err := f.replay(primary, pending)
+		replayed += n
+		if err != nil {
+			f.requeue(left)
+			return fmt.Errorf("replay stopped with %d writes left: %w", len(left), err)
+		}
+	}
+}
+
+// reconnect returns the primary once it answers again
+func (f *FallbackCache) reconnect() (Cache, error) {
+	f.mu.RLock()
+	primary := f.primary
+	f.mu.RUnlock()
+
+	if primary == nil {
+		primary, err := f.connect()
+		if err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		f.primary = primary
+		f.mu.Unlock()
+		return primary, nil
+	}
+	if p, ok := primary.(Pinger); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), f.opts.ReplayTimeout)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return primary, nil
+}
+
+// replay writes ops to primary in batches of ReplayBatch, each bounded by
+// ReplayTimeout. It returns how many of them were written and, on failure,
+// the ones left to replay.
+func (f *FallbackCache) replay(primary Cache, ops []Op) (int, []Op, error) {
+	done := 0
+	for done < len(ops) {
+		end := min(done+f.opts.ReplayBatch, len(ops))
+		batch := ops[done:end]
+		ctx, cancel := context.WithTimeout(context.Background(), f.opts.ReplayTimeout)
+		err := WriteBatch(ctx, primary, batch)
+		cancel()
+		if err != nil {
+			failed := Unapplied(batch, err)
+			left := append(failed[:len(failed):len(failed)], ops[end:]...)
+			return done + len(batch) - len(failed), left, err
+		}
+		done = end
+	}
+	return done, nil, nil
+}
+
+// requeue puts ops that failed to replay back in front of the journal,
+// dropping the oldest writes beyond BufferSize
+func (f *FallbackCache) requeue(ops []Op) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.journal = append(ops[:len(ops):len(ops)], f.journal...)
+	if extra := len(f.journal) - f.opts.BufferSize; extra > 0 {
+		f.journal = f.journal[extra:]
+		f.dropped += extra
+	}
+}
+
+// write applies op to the primary, buffering it when the primary is down
+func (f *FallbackCache) write(ctx context.Context, op Op) error {
+	return f.WriteBatch(ctx, []Op{op})
+}
+
+// WriteBatch applies ops to the primary in one round trip, buffering the
+// ones that were not applied when the primary is down. Writes whose reply
+// was lost may have been applied, so they are not buffered: replaying them
+// would duplicate points and count rollups twice. They fail the call, and
+// only TimeoutLimit such failures in a row degrade the cache.
+func (f *FallbackCache) WriteBatch(ctx context.Context, ops []Op) error {
+	f.mu.RLock()
+	primary, degraded := f.primary, f.degraded
+	f.mu.RUnlock()
+
+	var lost error
+	if !degraded && primary != nil {
+		err := WriteBatch(ctx, primary, ops)
+		if err == nil {
+			f.timeouts.Store(0)
+			return nil
+		}
+		if callerCanceled(ctx) {
+			return err
+		}
+		failed := Unapplied(ops, err)
+		if len(Unconfirmed(ops, err)) > 0 {
+			lost = err
+		}
+		if len(failed) == 0 {
+			if f.timeouts.Add(1) >= int64(f.opts.TimeoutLimit) {
+				f.markDegraded(err)
+			}
+			return err
+		}
+		f.markDegraded(err)
+		ops = failed
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.degraded && f.primary != nil {
+		// восстановились, пока ждали блокировку
+		if err := WriteBatch(ctx, f.primary, ops); err != nil {
+			return err
+		}
+		return lost
+	}
+
+	for _, op := range ops {
+		f.journal = append(f.journal, op)
+		if len(f.journal) > f.opts.BufferSize {
+			f.journal = f.journal[1:]
+			f.dropped++
+		}
+		if op.Kind != OpObserve {
+			// буфер в памяти не должен зависеть от истёкшего контекста записи
+			op.Apply(context.Background(), f.memory)
+		}
+	}
+	return lost
+}
+
+// reader returns the cache reads should be served from, or nil while
+// degraded, along with the current memory buffer
+func (f *FallbackCache) reader() (Cache, *MemoryCache) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.degraded || f.primary == nil {
+		return nil, f.memory
+	}
+	return f.primary, f.memory
+}
+
+// Set stores a value with expiration
+func (f *FallbackCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return f.write(ctx, Op{Kind: OpSet, Key: key, TTL: ttl, Data: data})
+}
+
+// Get reads a value from the primary, or from memory while degraded
+func (f *FallbackCache) Get(ctx context.Context, key string, dest interface{}) error {
+	primary, memory := f.reader()
+	g, ok := primary.(Getter)
+	if !ok {
+		return memory.Get(ctx, key, dest)
+	}
+	err := g.Get(ctx, key, dest)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		if callerDone(ctx) {
+			return err
+		}
+		f.markDegraded(err)
+		return memory.Get(ctx, key, dest)
+	}
+	return err
+}
+
+// SetIfRevision replaces a value of the primary. The journal cannot keep
+// the condition, so it fails with ErrDegraded while degraded.
+func (f *FallbackCache) SetIfRevision(ctx context.Context, key string, revision int64, value interface{}) error {
+	primary, _ := f.reader()
+	rs, ok := primary.(RevisionSetter)
+	if !ok {
+		return ErrDegraded
+	}
+	err := rs.SetIfRevision(ctx, key, revision, value)
+	if err != nil && !errors.Is(err, ErrConflict) && !callerDone(ctx) {
+		f.markDegraded(err)
+	}
+	return err
+}
+
+// Append adds a record to the log at key
+func (f *FallbackCache) Append(ctx context.Context, key string, score float64, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return f.write(ctx, Op{Kind: OpAppend, Key: key, Score: score, MaxLen: maxLen, Data: data})
+}
+
+// Range returns records of the log at key, from memory while degraded
+func (f *FallbackCache) Range(ctx context.Context, key string, min, max float64) ([][]byte, error) {
+	primary, memory := f.reader()
+	if primary == nil {
+		return memory.Range(ctx, key, min, max)
+	}
+	out, err := primary.Range(ctx, key, min, max)
+	if err != nil {
+		if callerDone(ctx) {
+			return nil, err
+		}
+		f.markDegraded(err)
+		return memory.Range(ctx, key, min, max)
+	}
+	return out, nil
+}
+
+// AddPoint stores a point of source
+func (f *FallbackCache) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return f.write(ctx, Op{Kind: OpAddPoint, Key: source, TS: ts, MaxLen: maxLen, Data: data})
+}
+
+// RangePoints returns points of one or all sources, from memory while degraded
+func (f *FallbackCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]Point, error) {
+	return f.RangePointsLimit(ctx, source, from, to, 0)
+}
+
+// RangePointsLimit returns at most limit points of one or all sources, from
+// memory while degraded
+func (f *FallbackCache) RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]Point, error) {
+	primary, memory := f.reader()
+	if primary == nil {
+		return memory.RangePointsLimit(ctx, source, from, to, limit)
+	}
+	out, err := RangePointsLimit(ctx, primary, source, from, to, limit)
+	if err != nil {
+		if callerDone(ctx) {
+			return nil, err
+		}
+		f.markDegraded(err)
+		return memory.RangePointsLimit(ctx, source, from, to, limit)
+	}
+	return out, nil
+}
+
+// Observe updates rollups of the primary, buffering the update while degraded
+func (f *FallbackCache) Observe(ctx context.Context, source string, ts time.Time, values map[string]float64) error {
+	return f.write(ctx, Op{Kind: OpObserve, Key: source, TS: ts, Values: values})
+}
+
+// RangeRollup reads rollups of the primary; they are not kept in memory
+func (f *FallbackCache) RangeRollup(ctx context.Context, source string, res Resolution, from, to time.Time) ([]Bucket, error) {
+	primary, _ := f.reader()
+	r, ok := primary.(Rollups)
+	if !ok {
+		return nil, ErrDegraded
+	}
+	out, err := r.RangeRollup(ctx, source, res, from, to)
+	if err != nil && !callerDone(ctx) {
+		f.markDegraded(err)
+	}
+	return out, err
+}
+
+// PruneSources prunes the sources of the primary; there is nothing to prune
+// while degraded
+func (f *FallbackCache) PruneSources(ctx context.Context, now, before time.Time) (int, error) {
+	primary, _ := f.reader()
+	p, ok := primary.(SourcePruner)
+	if !ok {
+		return 0, ErrDegraded
+	}
+	n, err := p.PruneSources(ctx, now, before)
+	if err != nil && !callerDone(ctx) {
+		f.markDegraded(err)
+	}
+	return n, err
+}
+
+// Close stops reconnecting and closes the primary cache
+func (f *FallbackCache) Close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.primary != nil {
+		return f.primary.Close()
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/highload-service/internal/clock"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFallbackCache_StartsDegradedAndReplays(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	var down atomic.Bool
+	down.Store(true)
+	var states []bool
+
+	f := NewFallbackCache(func() (Cache, error) {
+		if down.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return NewRedisCache(mr.Addr(), "", 0)
+	}, FallbackOptions{
+		BufferSize:    100,
+		MinBackoff:    5 * time.Millisecond,
+		MaxBackoff:    10 * time.Millisecond,
+		OnStateChange: func(d bool) { states = append(states, d) },
+	})
+	defer f.Close()
+
+	if !f.Degraded() {
+		t.Fatalf("expected degraded mode when Redis is down at startup")
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := f.AddPoint(ctx, "web-1", time.Unix(i, 0), testPoint{Timestamp: i}, 0); err != nil {
+			t.Fatalf("buffered write should not fail: %v", err)
+		}
+	}
+	pts, err := f.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("expected 3 buffered points served from memory, got %d (%v)", len(pts), err)
+	}
+	if f.Buffered() != 3 {
+		t.Fatalf("expected 3 buffered writes, got %d", f.Buffered())
+	}
+
+	down.Store(false)
+	waitFor(t, func() bool { return !f.Degraded() })
+
+	if !mr.Exists(PointsKey("web-1")) {
+		t.Fatalf("expected buffered points to be replayed into Redis")
+	}
+	pts, err = f.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("expected 3 replayed points, got %d (%v)", len(pts), err)
+	}
+	if len(states) != 2 || !states[0] || states[1] {
+		t.Fatalf("expected degraded/recovered transitions, got %v", states)
+	}
+}
+
+func TestFallbackCache_DegradesOnErrorAndRecovers(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	f := NewFallbackCache(func() (Cache, error) {
+		return NewRedisCache(mr.Addr(), "", 0)
+	}, FallbackOptions{MinBackoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	defer f.Close()
+
+	if f.Degraded() {
+		t.Fatalf("expected healthy cache")
+	}
+	if err := f.Append(ctx, "events", 1, testPoint{Timestamp: 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.Close()
+	if err := f.Append(ctx, "events", 2, testPoint{Timestamp: 2}, 0); err != nil {
+		t.Fatalf("write during outage should be buffered, got %v", err)
+	}
+	if !f.Degraded() {
+		t.Fatalf("expected degraded mode after Redis error")
+	}
+	if _, err := f.RangeRollup(ctx, "web-1", DefaultResolutions[0], time.Time{}, time.Time{}); err != ErrDegraded {
+		t.Fatalf("expected ErrDegraded for rollups, got %v", err)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !f.Degraded() })
+
+	recs, err := f.Range(ctx, "events", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected both records after replay, got %d", len(recs))
+	}
+}
+
+func TestMemoryCache_Bounded(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryCache(5)
+	for i := int64(1); i <= 4; i++ {
+		m.AddPoint(ctx, "a", time.Unix(i, 0), testPoint{Timestamp: i}, 0)
+	}
+	for i := int64(5); i <= 7; i++ {
+		m.Append(ctx, "log", float64(i), testPoint{Timestamp: i}, 0)
+	}
+
+	if m.Len() != 5 {
+		t.Fatalf("expected 5 records, got %d", m.Len())
+	}
+	pts, _ := m.RangePoints(ctx, "", time.Time{}, time.Time{})
+	if len(pts) != 2 || pts[0].Timestamp.Unix() != 3 {
+		t.Fatalf("expected the two newest points to survive, got %+v", pts)
+	}
+
+	m.AddPoint(ctx, "b", time.Unix(10, 0), testPoint{}, 1)
+	m.AddPoint(ctx, "b", time.Unix(11, 0), testPoint{}, 1)
+	if pts, _ := m.RangePoints(ctx, "b", time.Time{}, time.Time{}); len(pts) != 1 || pts[0].Timestamp.Unix() != 11 {
+		t.Fatalf("expected maxLen to keep only the newest point, got %+v", pts)
+	}
+	if m.Len() != 5 {
+		t.Fatalf("expected 5 records after maxLen trim, got %d", m.Len())
+	}
+}
+
+func TestFallbackCache_CallerCancelDoesNotDegrade(t *testing.T) {
+	r, _ := newTestRedis(t)
+	f := NewFallbackCache(func() (Cache, error) { return r, nil }, FallbackOptions{MinBackoff: time.Hour})
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.AddPoint(ctx, "web-1", time.Unix(1, 0), testPoint{Timestamp: 1}, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := f.RangePoints(ctx, "web-1", time.Time{}, time.Time{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from a read, got %v", err)
+	}
+	if f.Degraded() || f.Buffered() != 0 {
+		t.Fatalf("a cancelled caller must not degrade the cache or journal its write")
+	}
+}
+
+func TestFallbackCache_Get(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	f := NewFallbackCache(func() (Cache, error) {
+		return NewRedisCache(mr.Addr(), "", 0)
+	}, FallbackOptions{MinBackoff: time.Hour})
+	defer f.Close()
+
+	var p testPoint
+	if err := f.Get(ctx, "snapshot", &p); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if f.Degraded() {
+		t.Fatalf("a missing key must not degrade the cache")
+	}
+	if err := f.Set(ctx, "snapshot", testPoint{Timestamp: 7}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Get(ctx, "snapshot", &p); err != nil || p.Timestamp != 7 {
+		t.Fatalf("expected the stored value, got %+v (%v)", p, err)
+	}
+
+	// во время сбоя значение берётся из буфера в памяти
+	mr.Close()
+	if err := f.Set(ctx, "snapshot", testPoint{Timestamp: 8}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Get(ctx, "snapshot", &p); err != nil || p.Timestamp != 8 {
+		t.Fatalf("expected the buffered value while degraded, got %+v (%v)", p, err)
+	}
+}
+
+func TestFallbackCache_BufferedValuesExpire(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Unix(1000, 0))
+	f := NewFallbackCache(func() (Cache, error) {
+		return nil, errors.New("redis is down")
+	}, FallbackOptions{MinBackoff: time.Hour, Clock: clk})
+	defer f.Close()
+
+	if err := f.Set(ctx, "snapshot", testPoint{Timestamp: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var p testPoint
+	clk.Advance(59 * time.Second)
+	if err := f.Get(ctx, "snapshot", &p); err != nil {
+		t.Fatalf("expected the value before its TTL, got %v", err)
+	}
+	clk.Advance(2 * time.Second)
+	if err := f.Get(ctx, "snapshot", &p); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after the TTL, got %v", err)
+	}
+}
+
+// blockingReplay is a primary whose batches wait for release
+type blockingReplay struct {
+	*MemoryCache
+	batches atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *blockingReplay) WriteBatch(ctx context.Context, ops []Op) error {
+	if g.batches.Add(1) == 1 {
+		close(g.started)
+		<-g.release
+	}
+	for _, op := range ops {
+		if err := op.Apply(ctx, g.MemoryCache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFallbackCache_ReplaysInBatchesWithoutBlockingWrites(t *testing.T) {
+	ctx := context.Background()
+	primary := &blockingReplay{MemoryCache: NewMemoryCache(100), started: make(chan struct{}), release: make(chan struct{})}
+	var down atomic.Bool
+	down.Store(true)
+	f := NewFallbackCache(func() (Cache, error) {
+		if down.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return primary, nil
+	}, FallbackOptions{MinBackoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, ReplayBatch: 2})
+	defer f.Close()
+
+	for i := int64(1); i <= 5; i++ {
+		f.AddPoint(ctx, "web-1", time.Unix(i, 0), testPoint{Timestamp: i}, 0)
+	}
+	down.Store(false)
+	<-primary.started
+
+	// запись и чтение во время дозаписи не ждут её окончания
+	done := make(chan error)
+	go func() {
+		if err := f.AddPoint(ctx, "web-1", time.Unix(6, 0), testPoint{Timestamp: 6}, 0); err != nil {
+			done <- err
+			return
+		}
+		pts, err := f.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+		if err == nil && len(pts) != 6 {
+			err = errors.New("expected reads from memory during the replay")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a write blocked on the replay")
+	}
+	if !f.Degraded() {
+		t.Fatal("expected the cache to stay degraded until the replay is done")
+	}
+
+	close(primary.release)
+	waitFor(t, func() bool { return !f.Degraded() })
+	pts, _ := primary.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if len(pts) != 6 || pts[5].Timestamp.Unix() != 6 {
+		t.Fatalf("expected all 6 points replayed in order, got %+v", pts)
+	}
+	// 5 записей пачками по 2 и одна, сделанная во время дозаписи
+	if n := primary.batches.Load(); n != 4 {
+		t.Fatalf("expected 4 replay batches, got %d", n)
+	}
+}
+
+func TestFallbackCache_JournalsOnlyFailedWrites(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t)
+	f := NewFallbackCache(func() (Cache, error) { return r, nil }, FallbackOptions{MinBackoff: time.Hour})
+	defer f.Close()
+
+	// ZADD в строковый ключ падает с WRONGTYPE, остальная пачка применяется
+	mr.Set("events", "not a log")
+	err := f.WriteBatch(ctx, []Op{
+		{Kind: OpAddPoint, Key: "web-1", TS: time.Unix(1, 0), Data: []byte(`{"timestamp":1}`)},
+		{Kind: OpAppend, Key: "events", Score: 1, Data: []byte(`{"timestamp":1}`)},
+		{Kind: OpObserve, Key: "web-1", TS: time.Unix(1, 0), Values: map[string]float64{"rps": 1}},
+	})
+	if err != nil {
+		t.Fatalf("expected the failed write to be buffered, got %v", err)
+	}
+	if f.Buffered() != 1 {
+		t.Fatalf("expected only the failed write in the journal, got %d", f.Buffered())
+	}
+	if n, _ := r.client.ZCard(ctx, PointsKey("web-1")).Result(); n != 1 {
+		t.Fatalf("expected the applied point once, got %d", n)
+	}
+}
+
+// stalledCache is a primary that answers only when the context runs out
+type stalledCache struct {
+	*MemoryCache
+}
+
+func (stalledCache) WriteBatch(ctx context.Context, ops []Op) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFallbackCache_DoesNotReplayWritesPastDeadline(t *testing.T) {
+	f := NewFallbackCache(func() (Cache, error) {
+		return stalledCache{NewMemoryCache(10)}, nil
+	}, FallbackOptions{MinBackoff: time.Hour, TimeoutLimit: 2})
+	defer f.Close()
+
+	write := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return f.AddPoint(ctx, "web-1", time.Unix(1, 0), testPoint{Timestamp: 1}, 0)
+	}
+	// запись могла примениться, повтор продублировал бы точку
+	if err := write(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the write past its deadline to fail, got %v", err)
+	}
+	if f.Degraded() || f.Buffered() != 0 {
+		t.Fatalf("expected a single timeout neither to degrade nor to journal, got degraded=%v buffered=%d", f.Degraded(), f.Buffered())
+	}
+	write()
+	if !f.Degraded() || f.Buffered() != 0 {
+		t.Fatalf("expected timeouts in a row to degrade without journaling, got degraded=%v buffered=%d", f.Degraded(), f.Buffered())
+	}
+}
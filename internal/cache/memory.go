@@ -0,0 +1,271 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+// MemoryCache is a bounded in-process Cache. It keeps at most limit
+// records across all logs and sources, evicting the oldest records (by
+// score or timestamp) first, and is used as the write buffer while Redis
+// is unavailable. Operations never block, so contexts are not consulted.
+type MemoryCache struct {
+	limit int
+	clock clock.Clock
+
+	values map[string]memoryValue
+	logs   map[string][]memoryRecord
+	points map[string][]Point
+	total  int
+
+	mu sync.RWMutex
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time
+}
+
+type memoryRecord struct {
+	score float64
+	data  []byte
+}
+
+// NewMemoryCache creates a new MemoryCache holding at most limit records
+func NewMemoryCache(limit int) *MemoryCache {
+	return newMemoryCache(limit, clock.Real)
+}
+
+func newMemoryCache(limit int, clk clock.Clock) *MemoryCache {
+	if limit < 1 {
+		limit = 10000
+	}
+
+	return &MemoryCache{
+		limit:  limit,
+		clock:  clk,
+		values: make(map[string]memoryValue),
+		logs:   make(map[string][]memoryRecord),
+		points: make(map[string][]Point),
+	}
+}
+
+// Set stores a value with expiration
+func (m *MemoryCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v := memoryValue{data: data}
+	if ttl > 0 {
+		v.expires = m.clock.Now().Add(ttl)
+	}
+	if _, ok := m.values[key]; !ok && len(m.values) >= m.limit {
+		m.evictValue()
+	}
+	m.values[key] = v
+	return nil
+}
+
+// Get retrieves a value
+func (m *MemoryCache) Get(ctx context.Context, key string, dest interface{}) error {
+	m.mu.RLock()
+	v, ok := m.values[key]
+	m.mu.RUnlock()
+
+	if !ok || (!v.expires.IsZero() && m.clock.Now().After(v.expires)) {
+		return ErrNotFound
+	}
+	return json.Unmarshal(v.data, dest)
+}
+
+// SetIfRevision stores a value unless another writer replaced the revision
+// the caller read
+func (m *MemoryCache) SetIfRevision(ctx context.Context, key string, revision int64, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.values[key]; ok && (v.expires.IsZero() || !m.clock.Now().After(v.expires)) {
+		var cur struct {
+			Revision int64 `json:"revision"`
+		}
+		if json.Unmarshal(v.data, &cur) != nil || cur.Revision != revision {
+			return ErrConflict
+		}
+	} else if !ok && len(m.values) >= m.limit {
+		m.evictValue()
+	}
+	m.values[key] = memoryValue{data: data}
+	return nil
+}
+
+func (m *MemoryCache) evictValue() {
+	var oldest string
+	var oldestExp time.Time
+	for k, v := range m.values {
+		if oldest == "" || (!v.expires.IsZero() && (oldestExp.IsZero() || v.expires.Before(oldestExp))) {
+			oldest, oldestExp = k, v.expires
+		}
+	}
+	delete(m.values, oldest)
+}
+
+// Append adds a record to the log at key
+func (m *MemoryCache) Append(ctx context.Context, key string, score float64, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recs := m.logs[key]
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].score > score })
+	recs = append(recs, memoryRecord{})
+	copy(recs[i+1:], recs[i:])
+	recs[i] = memoryRecord{score: score, data: data}
+	m.total++
+	if maxLen > 0 && int64(len(recs)) > maxLen {
+		m.total -= len(recs) - int(maxLen)
+		recs = recs[int64(len(recs))-maxLen:]
+	}
+	m.logs[key] = recs
+	m.evict()
+	return nil
+}
+
+// Range returns records of the log at key within [min, max]
+func (m *MemoryCache) Range(ctx context.Context, key string, min, max float64) ([][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out [][]byte
+	for _, rec := range m.logs[key] {
+		if rec.score >= min && rec.score <= max {
+			out = append(out, rec.data)
+		}
+	}
+	return out, nil
+}
+
+// AddPoint stores a point of source
+func (m *MemoryCache) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pts := m.points[source]
+	i := sort.Search(len(pts), func(i int) bool { return pts[i].Timestamp.After(ts) })
+	pts = append(pts, Point{})
+	copy(pts[i+1:], pts[i:])
+	pts[i] = Point{Source: source, Timestamp: ts, Data: data}
+	m.total++
+	if maxLen > 0 && int64(len(pts)) > maxLen {
+		m.total -= len(pts) - int(maxLen)
+		pts = pts[int64(len(pts))-maxLen:]
+	}
+	m.points[source] = pts
+	m.evict()
+	return nil
+}
+
+// RangePoints returns points of one or all sources within [from, to]
+func (m *MemoryCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]Point, error) {
+	return m.RangePointsLimit(ctx, source, from, to, 0)
+}
+
+// RangePointsLimit returns at most limit points of one or all sources
+// within [from, to]
+func (m *MemoryCache) RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]Point, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sources := []string{source}
+	if source == "" {
+		sources = make([]string, 0, len(m.points))
+		for src := range m.points {
+			sources = append(sources, src)
+		}
+		sort.Strings(sources)
+	}
+
+	var out []Point
+	for _, src := range sources {
+		for _, p := range m.points[src] {
+			if limit > 0 && int64(len(out)) >= limit {
+				break
+			}
+			if (from.IsZero() || !p.Timestamp.Before(from)) && (to.IsZero() || !p.Timestamp.After(to)) {
+				out = append(out, p)
+			}
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if !out[i].Timestamp.Equal(out[j].Timestamp) {
+			return out[i].Timestamp.Before(out[j].Timestamp)
+		}
+		return out[i].Source < out[j].Source
+	})
+	return out, nil
+}
+
+// Len returns the number of log records and points held
+func (m *MemoryCache) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.total
+}
+
+// evict drops the oldest log record or point until the cache fits its limit
+func (m *MemoryCache) evict() {
+	for m.total > m.limit {
+		var logKey, pointKey string
+		oldestLog, oldestPoint := 0.0, 0.0
+		for k, recs := range m.logs {
+			if len(recs) > 0 && (logKey == "" || recs[0].score < oldestLog) {
+				logKey, oldestLog = k, recs[0].score
+			}
+		}
+		for k, pts := range m.points {
+			if len(pts) > 0 && (pointKey == "" || Score(pts[0].Timestamp) < oldestPoint) {
+				pointKey, oldestPoint = k, Score(pts[0].Timestamp)
+			}
+		}
+
+		switch {
+		case logKey != "" && (pointKey == "" || oldestLog <= oldestPoint):
+			m.logs[logKey] = m.logs[logKey][1:]
+		case pointKey != "":
+			m.points[pointKey] = m.points[pointKey][1:]
+		default:
+			return
+		}
+		m.total--
+	}
+}
+
+// Close releases nothing; it exists to satisfy Cache
+func (m *MemoryCache) Close() error {
+	return nil
+}
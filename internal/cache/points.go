@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Storage layout for ingested metric points.
+//
+// Every source has its own sorted set "metrics:{<source>}" scored by the
+// point timestamp in fractional unix seconds. Members are "<id>|<json>",
+// where id is unique per write, so two points with the same timestamp and
+// even the same payload never collapse into one member. Known sources are
+// tracked in the set "metrics:sources", and the sorted set
+// "metrics:sources:seen" holds the timestamp of their newest point so that
+// sources whose data has expired can be pruned from it.
+//
+// Older layouts are still readable and can be migrated with MigrateLegacy:
+//   - "metric:<unix seconds>" string keys (one point per second overall)
+//   - the single "metrics:history" sorted set with bare JSON members
+const (
+	SourcesKey       = "metrics:sources"
+	SourcesSeenKey   = "metrics:sources:seen"
+	LegacyHistoryKey = "metrics:history"
+	LegacyKeyPattern = "metric:*"
+	// MigrationLockKey is held by the replica running MigrateLegacy
+	MigrationLockKey = "migration:legacy:lock"
+)
+
+// UnparsableKey returns where MigrateLegacy moves a legacy key, or the
+// members of one, it could not parse. The original name is the hash tag,
+// so the key stays in the slot of the original.
+func UnparsableKey(key string) string {
+	return "legacy:unparsable:{" + key + "}"
+}
+
+// Point is a single stored metric sample
+type Point struct {
+	Source    string
+	Timestamp time.Time
+	Data      json.RawMessage
+}
+
+// PointsKey returns the sorted set holding points of source. The braces
+// keep all keys of a source in one Redis Cluster hash slot.
+func PointsKey(source string) string {
+	return "metrics:{" + source + "}"
+}
+
+// Score converts a timestamp into a sorted set score with sub-second precision
+func Score(ts time.Time) float64 {
+	return float64(ts.UnixNano()) / 1e9
+}
+
+func scoreTime(score float64) time.Time {
+	sec := int64(score)
+	return time.Unix(sec, int64((score-float64(sec))*1e9))
+}
+
+var (
+	instanceID = newInstanceID()
+	pointSeq   uint64
+)
+
+func newInstanceID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// encodeMember prefixes data with an identifier unique to this write
+func encodeMember(data []byte) string {
+	seq := atomic.AddUint64(&pointSeq, 1)
+	return fmt.Sprintf("%s%012x|%s", instanceID, seq, data)
+}
+
+// legacyMember prefixes data with an identifier derived from the legacy key
+// or member it was copied from, so copying it again stores the same member
+func legacyMember(origin string, data []byte) string {
+	sum := sha256.Sum256([]byte(origin))
+	return fmt.Sprintf("legacy-%x|%s", sum[:8], data)
+}
+
+// decodeMember strips the write identifier; bare JSON members written by
+// the legacy layout are returned unchanged
+func decodeMember(member string) []byte {
+	if strings.HasPrefix(member, "{") {
+		return []byte(member)
+	}
+	if i := strings.IndexByte(member, '|'); i >= 0 {
+		return []byte(member[i+1:])
+	}
+	return []byte(member)
+}
+
+// legacyPoint is the subset of a stored metric needed to re-key it
+type legacyPoint struct {
+	Timestamp int64  `json:"timestamp"`
+	Source    string `json:"source"`
+}
+
+func parseLegacyPoint(data []byte, defaultSource string) (source string, ts time.Time, err error) {
+	var lp legacyPoint
+	if err := json.Unmarshal(data, &lp); err != nil {
+		return "", time.Time{}, err
+	}
+	source = lp.Source
+	if source == "" {
+		source = defaultSource
+	}
+	return source, time.Unix(lp.Timestamp, 0), nil
+}
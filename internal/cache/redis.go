@@ -2,53 +2,210 @@ package cache
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// Redis deployment modes
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
+// RedisOptions describes how to reach Redis
+type RedisOptions struct {
+	// Mode is ModeStandalone (default), ModeSentinel or ModeCluster
+	Mode string
+	// Addrs is the server address in standalone mode, the sentinel
+	// addresses in sentinel mode and the seed nodes in cluster mode
+	Addrs []string
+	// MasterName is the monitored master in sentinel mode
+	MasterName string
+	// SentinelPassword authenticates against the sentinels, if they require it
+	SentinelPassword string
+	// Username is the Redis 6 ACL user; empty means the default user
+	Username string
+	Password string
+	// DB is not supported in cluster mode
+	DB int
+
+	TLS  TLSOptions
+	Pool PoolOptions
+}
+
+// TLSOptions configures encrypted connections. TLS is used when Enabled is
+// set or any of the other fields is.
+type TLSOptions struct {
+	Enabled bool
+	// CAFile verifies the server against a custom CA instead of the system pool
+	CAFile string
+	// CertFile and KeyFile present a client certificate
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name checked against the server certificate
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (o TLSOptions) enabled() bool {
+	return o.Enabled || o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.ServerName != ""
+}
+
+// Config builds the tls.Config, or returns nil when TLS is off
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if !o.enabled() {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate requires both a cert and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// PoolOptions tunes the connection pool; zero values keep go-redis defaults
+type PoolOptions struct {
+	Size         int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// PoolTimeout is how long a command waits for a free connection
+	PoolTimeout time.Duration
+	IdleTimeout time.Duration
+	MaxConnAge  time.Duration
+}
+
 // RedisCache wraps Redis client for caching metrics
 type RedisCache struct {
-	client *redis.Client
-	ctx    context.Context
+	client redis.UniversalClient
+
+	rawRetention time.Duration
+	resolutions  []Resolution
 }
 
 // NewRedisCache creates a new Redis cache client
 func NewRedisCache(addr string, password string, db int) (*RedisCache, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     addr,
+	return NewRedisCacheWithOptions(RedisOptions{
+		Addrs:    []string{addr},
 		Password: password,
 		DB:       db,
 	})
+}
+
+// NewRedisCacheWithOptions creates a Redis cache client for a standalone
+// server, a Sentinel-managed master or a Cluster
+func NewRedisCacheWithOptions(opts RedisOptions) (*RedisCache, error) {
+	rdb, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
 
-	ctx := context.Background()
 	// Test connection
-	if err := rdb.Ping(ctx).Err(); err != nil {
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		rdb.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisCache{
-		client: rdb,
-		ctx:    ctx,
-	}, nil
+	return &RedisCache{client: rdb}, nil
+}
+
+func newRedisClient(opts RedisOptions) (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no Redis address configured")
+	}
+	tlsConfig, err := opts.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	uo := &redis.UniversalOptions{
+		Addrs:            opts.Addrs,
+		DB:               opts.DB,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		SentinelPassword: opts.SentinelPassword,
+		MasterName:       opts.MasterName,
+		TLSConfig:        tlsConfig,
+
+		PoolSize:     opts.Pool.Size,
+		MinIdleConns: opts.Pool.MinIdleConns,
+		DialTimeout:  opts.Pool.DialTimeout,
+		ReadTimeout:  opts.Pool.ReadTimeout,
+		WriteTimeout: opts.Pool.WriteTimeout,
+		PoolTimeout:  opts.Pool.PoolTimeout,
+		IdleTimeout:  opts.Pool.IdleTimeout,
+		MaxConnAge:   opts.Pool.MaxConnAge,
+	}
+
+	switch opts.Mode {
+	case "", ModeStandalone:
+		return redis.NewClient(uo.Simple()), nil
+	case ModeSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("sentinel mode requires a master name")
+		}
+		return redis.NewFailoverClient(uo.Failover()), nil
+	case ModeCluster:
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("cluster mode supports only DB 0")
+		}
+		return redis.NewClusterClient(uo.Cluster()), nil
+	}
+	return nil, fmt.Errorf("unknown Redis mode %q", opts.Mode)
 }
 
 // Set stores a value with expiration
-func (r *RedisCache) Set(key string, value interface{}, expiration time.Duration) error {
+func (r *RedisCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
 	data, err := json.Marshal(value)
 	if err != nil {
 		return fmt.Errorf("failed to marshal value: %w", err)
 	}
-	return r.client.Set(r.ctx, key, data, expiration).Err()
+	return r.client.Set(ctx, key, data, expiration).Err()
 }
 
 // Get retrieves a value
-func (r *RedisCache) Get(key string, dest interface{}) error {
-	val, err := r.client.Get(r.ctx, key).Result()
+func (r *RedisCache) Get(ctx context.Context, key string, dest interface{}) error {
+	val, err := r.client.Get(ctx, key).Result()
 	if err == redis.Nil {
-		return fmt.Errorf("key not found")
+		return ErrNotFound
 	}
 	if err != nil {
 		return fmt.Errorf("failed to get value: %w", err)
@@ -56,20 +213,466 @@ func (r *RedisCache) Get(key string, dest interface{}) error {
 	return json.Unmarshal([]byte(val), dest)
 }
 
+// setIfRevisionScript stores ARGV[2] at KEYS[1] if the key is missing or
+// the revision of the stored JSON equals ARGV[1]
+var setIfRevisionScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	local ok, v = pcall(cjson.decode, cur)
+	if not ok or type(v) ~= 'table' or tonumber(v['revision']) ~= tonumber(ARGV[1]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// SetIfRevision stores a value unless another writer replaced the revision
+// the caller read
+func (r *RedisCache) SetIfRevision(ctx context.Context, key string, revision int64, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	stored, err := setIfRevisionScript.Run(ctx, r.client, []string{key}, revision, data).Int()
+	if err != nil {
+		return err
+	}
+	if stored == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
 // Increment increments a counter
-func (r *RedisCache) Increment(key string) (int64, error) {
-	return r.client.Incr(r.ctx, key).Result()
+func (r *RedisCache) Increment(ctx context.Context, key string) (int64, error) {
+	return r.client.Incr(ctx, key).Result()
 }
 
 // GetInt64 retrieves an integer value
-func (r *RedisCache) GetInt64(key string) (int64, error) {
-	val, err := r.client.Get(r.ctx, key).Int64()
+func (r *RedisCache) GetInt64(ctx context.Context, key string) (int64, error) {
+	val, err := r.client.Get(ctx, key).Int64()
 	if err == redis.Nil {
 		return 0, fmt.Errorf("key not found")
 	}
 	return val, err
 }
 
+// Append adds a record to the sorted set at key and trims the oldest ones
+func (r *RedisCache) Append(ctx context.Context, key string, score float64, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	pipe := r.client.TxPipeline()
+	r.queueAppend(ctx, pipe, key, score, data, maxLen)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to append value: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisCache) queueAppend(ctx context.Context, pipe redis.Pipeliner, key string, score float64, data []byte, maxLen int64) {
+	pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: data})
+	if maxLen > 0 {
+		pipe.ZRemRangeByRank(ctx, key, 0, -maxLen-1)
+	}
+}
+
+// Range returns records of the sorted set at key within [min, max]
+func (r *RedisCache) Range(ctx context.Context, key string, min, max float64) ([][]byte, error) {
+	vals, err := r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min: formatScore(min),
+		Max: formatScore(max),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read range: %w", err)
+	}
+
+	out := make([][]byte, len(vals))
+	for i, v := range vals {
+		out[i] = []byte(v)
+	}
+	return out, nil
+}
+
+// SetRawRetention limits how long raw points are kept: older points (relative
+// to the newest written one) are trimmed and idle sources expire. Zero keeps
+// points until they are trimmed by count.
+func (r *RedisCache) SetRawRetention(d time.Duration) {
+	r.rawRetention = d
+}
+
+// RawRetention returns the configured raw point retention
+func (r *RedisCache) RawRetention() time.Duration {
+	return r.rawRetention
+}
+
+// AddPoint stores a point in the per-source sorted set
+func (r *RedisCache) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	pipe := r.client.TxPipeline()
+	r.queuePoint(ctx, pipe, Op{Key: source, TS: ts, MaxLen: maxLen, Data: data})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store point: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisCache) queuePoint(ctx context.Context, pipe redis.Pipeliner, op Op) {
+	r.queueMember(ctx, pipe, op, encodeMember(op.Data))
+}
+
+func (r *RedisCache) queueMember(ctx context.Context, pipe redis.Pipeliner, op Op, member string) {
+	key := PointsKey(op.Key)
+	pipe.ZAdd(ctx, key, &redis.Z{Score: Score(op.TS), Member: member})
+	if op.MaxLen > 0 {
+		pipe.ZRemRangeByRank(ctx, key, 0, -op.MaxLen-1)
+	}
+	if r.rawRetention > 0 {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+formatScore(Score(op.TS.Add(-r.rawRetention))))
+		pipe.Expire(ctx, key, r.rawRetention)
+	}
+	queueSource(ctx, pipe, op)
+}
+
+// queueSource records the source of a point and the timestamp of its
+// newest point
+func queueSource(ctx context.Context, pipe redis.Pipeliner, op Op) {
+	pipe.SAdd(ctx, SourcesKey, op.Key)
+	pipe.ZAddArgs(ctx, SourcesSeenKey, redis.ZAddArgs{GT: true, Members: []redis.Z{{Score: Score(op.TS), Member: op.Key}}})
+}
+
+// PruneSources drops the sources whose newest point is older than before
+// from "metrics:sources" and returns how many were dropped. Sources listed
+// before "metrics:sources:seen" existed count as seen at now. A source
+// dropped while it is being written is listed again by its next point.
+func (r *RedisCache) PruneSources(ctx context.Context, now, before time.Time) (int, error) {
+	sources, err := r.client.SMembers(ctx, SourcesKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list sources: %w", err)
+	}
+	if len(sources) > 0 {
+		members := make([]*redis.Z, len(sources))
+		for i, src := range sources {
+			members[i] = &redis.Z{Score: Score(now), Member: src}
+		}
+		if err := r.client.ZAddNX(ctx, SourcesSeenKey, members...).Err(); err != nil {
+			return 0, fmt.Errorf("failed to index sources: %w", err)
+		}
+	}
+
+	cutoff := "(" + formatScore(Score(before))
+	stale, err := r.client.ZRangeByScore(ctx, SourcesSeenKey, &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read sources: %w", err)
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	members := make([]interface{}, len(stale))
+	for i, src := range stale {
+		members[i] = src
+	}
+	pipe := r.client.Pipeline()
+	pipe.SRem(ctx, SourcesKey, members...)
+	pipe.ZRem(ctx, SourcesSeenKey, members...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to prune sources: %w", err)
+	}
+	return len(stale), nil
+}
+
+// WriteBatch applies ops in a single pipeline. The pipeline is not a
+// transaction, so on a mid-batch failure some ops may already be applied.
+func (r *RedisCache) WriteBatch(ctx context.Context, ops []Op) error {
+	return r.writeBatch(ctx, ops, r.queuePoint)
+}
+
+func (r *RedisCache) writeBatch(ctx context.Context, ops []Op, queuePoint func(context.Context, redis.Pipeliner, Op)) error {
+	pipe := r.client.Pipeline()
+	// first[i] is the index of the first command queued for ops[i]
+	first := make([]int, len(ops)+1)
+	for i, op := range ops {
+		first[i] = pipe.Len()
+		switch op.Kind {
+		case OpSet:
+			pipe.Set(ctx, op.Key, []byte(op.Data), op.TTL)
+		case OpAppend:
+			r.queueAppend(ctx, pipe, op.Key, op.Score, op.Data, op.MaxLen)
+		case OpAddPoint:
+			queuePoint(ctx, pipe, op)
+		case OpObserve:
+			r.queueObserve(ctx, pipe, op.Key, op.TS, op.Values)
+		}
+	}
+	first[len(ops)] = pipe.Len()
+
+	cmds, err := pipe.Exec(ctx)
+	if err == nil {
+		return nil
+	}
+	// пачка не транзакционна: повторять можно только операции с ошибкой.
+	// Пачка, не дождавшаяся ответа к дедлайну, ничего не говорит об исходе
+	// команд без ответа: Redis мог их применить
+	timedOut := isTimeout(err)
+	be := &BatchError{Err: fmt.Errorf("failed to write batch: %w", err)}
+	for i, op := range ops {
+		var opErr error
+		for _, cmd := range cmds[first[i]:first[i+1]] {
+			if cmd.Err() != nil && cmd.Err() != redis.Nil {
+				opErr = cmd.Err()
+				break
+			}
+		}
+		var reply redis.Error
+		switch {
+		case opErr == nil:
+		case timedOut && !errors.As(opErr, &reply):
+			be.Unknown = append(be.Unknown, op)
+		default:
+			be.Failed = append(be.Failed, op)
+		}
+	}
+	if len(be.Failed) == 0 && len(be.Unknown) == 0 {
+		return nil
+	}
+	return be
+}
+
+// RangePoints reads points of one or all sources within [from, to]
+func (r *RedisCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]Point, error) {
+	return r.RangePointsLimit(ctx, source, from, to, 0)
+}
+
+// RangePointsLimit reads at most limit points of one or all sources within
+// [from, to], asking Redis for no more than are still missing
+func (r *RedisCache) RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]Point, error) {
+	sources := []string{source}
+	if source == "" {
+		var err error
+		if sources, err = r.client.SMembers(ctx, SourcesKey).Result(); err != nil {
+			return nil, fmt.Errorf("failed to list sources: %w", err)
+		}
+		sort.Strings(sources)
+	}
+
+	var points []Point
+	for _, src := range sources {
+		rng := &redis.ZRangeBy{Min: pointBound(from, "-inf"), Max: pointBound(to, "+inf")}
+		if limit > 0 {
+			if rng.Count = limit - int64(len(points)); rng.Count <= 0 {
+				break
+			}
+		}
+		vals, err := r.client.ZRangeByScoreWithScores(ctx, PointsKey(src), rng).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read points: %w", err)
+		}
+		for _, v := range vals {
+			member, _ := v.Member.(string)
+			points = append(points, Point{
+				Source:    src,
+				Timestamp: scoreTime(v.Score),
+				Data:      decodeMember(member),
+			})
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp.Before(points[j].Timestamp)
+	})
+	return points, nil
+}
+
+func pointBound(t time.Time, unbounded string) string {
+	if t.IsZero() {
+		return unbounded
+	}
+	return formatScore(Score(t))
+}
+
+// ErrMigrationLocked is returned by MigrateLegacy while another replica is
+// migrating
+var ErrMigrationLocked = errors.New("legacy migration is running on another replica")
+
+// migrationLockTTL bounds how long a crashed replica blocks the migration
+const migrationLockTTL = 15 * time.Minute
+
+// unlockScript releases a lock only if it is still held with ARGV[1]
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// withMigrationLock runs fn holding MigrationLockKey, so that replicas
+// starting together do not copy the same legacy points twice
+func (r *RedisCache) withMigrationLock(ctx context.Context, fn func() (int, error)) (int, error) {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+
+	ok, err := r.client.SetNX(ctx, MigrationLockKey, token, migrationLockTTL).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to take the migration lock: %w", err)
+	}
+	if !ok {
+		return 0, ErrMigrationLocked
+	}
+	defer unlockScript.Run(context.Background(), r.client, []string{MigrationLockKey}, token)
+	return fn()
+}
+
+// legacyCopier stores points copied by the legacy migration. A point is
+// identified by the legacy key or member it came from, its origin, and
+// copying the same origin again stores nothing, so a run that stopped
+// between copying a point and deleting its legacy entry can be repeated.
+type legacyCopier interface {
+	copyLegacyPoint(ctx context.Context, source string, ts time.Time, origin string, data []byte, maxLen int64) error
+}
+
+// copyLegacyPoint stores the point under a member derived from origin
+func (r *RedisCache) copyLegacyPoint(ctx context.Context, source string, ts time.Time, origin string, data []byte, maxLen int64) error {
+	pipe := r.client.TxPipeline()
+	op := Op{Key: source, TS: ts, MaxLen: maxLen, Data: data}
+	r.queueMember(ctx, pipe, op, legacyMember(origin, data))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store point: %w", err)
+	}
+	return nil
+}
+
+// MigrateLegacy moves points stored by older layouts ("metric:<ts>" keys
+// and the single "metrics:history" sorted set) into per-source sorted sets.
+// Points without a source are assigned defaultSource. Legacy keys are
+// deleted once copied, and a copied point keeps a member derived from its
+// legacy key or member, so the migration is safe to re-run after a
+// failure; keys and members that cannot be parsed are kept under
+// UnparsableKey. Only one replica migrates at a time, the others get
+// ErrMigrationLocked.
+func (r *RedisCache) MigrateLegacy(ctx context.Context, defaultSource string, maxLen int64) (int, error) {
+	return r.withMigrationLock(ctx, func() (int, error) {
+		return r.migrateLegacyInto(ctx, r, defaultSource, maxLen)
+	})
+}
+
+func (r *RedisCache) migrateLegacyInto(ctx context.Context, dst legacyCopier, defaultSource string, maxLen int64) (int, error) {
+	migrated := 0
+
+	err := r.scanKeys(ctx, LegacyKeyPattern, func(key string) error {
+		val, err := r.client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		source, ts, err := parseLegacyPoint(val, defaultSource)
+		if err != nil {
+			// не удаляем то, что не смогли разобрать
+			if err := r.client.Rename(ctx, key, UnparsableKey(key)).Err(); err != nil {
+				return fmt.Errorf("failed to set aside %s: %w", key, err)
+			}
+			slog.Warn("Legacy key is not a metric point, set aside", "key", key, "moved_to", UnparsableKey(key), "error", err)
+			return nil
+		}
+		if err := dst.copyLegacyPoint(ctx, source, ts, key, val, maxLen); err != nil {
+			return err
+		}
+		migrated++
+		if err := r.client.Del(ctx, key).Err(); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return migrated, err
+	}
+
+	vals, err := r.client.ZRangeWithScores(ctx, LegacyHistoryKey, 0, -1).Result()
+	if err != nil {
+		return migrated, fmt.Errorf("failed to read %s: %w", LegacyHistoryKey, err)
+	}
+	var unparsable []*redis.Z
+	for _, v := range vals {
+		member, _ := v.Member.(string)
+		data := decodeMember(member)
+		source, _, err := parseLegacyPoint(data, defaultSource)
+		if err != nil {
+			unparsable = append(unparsable, &redis.Z{Score: v.Score, Member: member})
+			continue
+		}
+		if err := dst.copyLegacyPoint(ctx, source, scoreTime(v.Score), LegacyHistoryKey+":"+member, data, maxLen); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	if len(unparsable) > 0 {
+		key := UnparsableKey(LegacyHistoryKey)
+		if err := r.client.ZAdd(ctx, key, unparsable...).Err(); err != nil {
+			return migrated, fmt.Errorf("failed to set aside members of %s: %w", LegacyHistoryKey, err)
+		}
+		slog.Warn("Legacy history members are not metric points, set aside", "key", LegacyHistoryKey, "moved_to", key, "members", len(unparsable))
+	}
+	if len(vals) > 0 {
+		if err := r.client.Del(ctx, LegacyHistoryKey).Err(); err != nil {
+			return migrated, fmt.Errorf("failed to delete %s: %w", LegacyHistoryKey, err)
+		}
+	}
+
+	return migrated, nil
+}
+
+// scanKeys calls fn for every key matching pattern. In cluster mode SCAN
+// only walks one node, so every master is scanned.
+func (r *RedisCache) scanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("failed to scan keys: %w", err)
+		}
+		return nil
+	}
+
+	if cc, ok := r.client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			// fn is not safe for concurrent use; masters are scanned in parallel
+			mu.Lock()
+			defer mu.Unlock()
+			return scan(ctx, c)
+		})
+	}
+	return scan(ctx, r.client)
+}
+
+func formatScore(v float64) string {
+	switch {
+	case math.IsInf(v, -1):
+		return "-inf"
+	case math.IsInf(v, 1):
+		return "+inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Ping checks the Redis connection
+func (r *RedisCache) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
 // Close closes the Redis connection
 func (r *RedisCache) Close() error {
 	return r.client.Close()
@@ -0,0 +1,310 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedis(t *testing.T) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCache(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, mr
+}
+
+type testPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Source    string  `json:"source,omitempty"`
+	RPS       float64 `json:"rps"`
+}
+
+func TestRedisCache_ConcurrentSameSecondWrites(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestRedis(t)
+
+	ts := time.Unix(1700000000, 0)
+	sources := []string{"web-1", "web-2", "web-3"}
+	const perSource = 20
+
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		for i := 0; i < perSource; i++ {
+			wg.Add(1)
+			go func(src string) {
+				defer wg.Done()
+				// одинаковые payload и секунда — раньше такие точки затирали друг друга
+				p := testPoint{Timestamp: ts.Unix(), Source: src, RPS: 100}
+				if err := c.AddPoint(ctx, src, ts, p, 0); err != nil {
+					t.Errorf("AddPoint failed: %v", err)
+				}
+			}(src)
+		}
+	}
+	wg.Wait()
+
+	all, err := c.RangePoints(ctx, "", ts, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(sources)*perSource {
+		t.Fatalf("expected %d points, got %d", len(sources)*perSource, len(all))
+	}
+
+	one, err := c.RangePoints(ctx, "web-2", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(one) != perSource {
+		t.Fatalf("expected %d points for web-2, got %d", perSource, len(one))
+	}
+	var p testPoint
+	if err := json.Unmarshal(one[0].Data, &p); err != nil {
+		t.Fatalf("stored point is not valid JSON: %v", err)
+	}
+	if p.Source != "web-2" || !one[0].Timestamp.Equal(ts) {
+		t.Fatalf("unexpected point %+v at %v", p, one[0].Timestamp)
+	}
+}
+
+func TestRedisCache_AddPointTrimsPerSource(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestRedis(t)
+
+	for i := 0; i < 10; i++ {
+		if err := c.AddPoint(ctx, "a", time.Unix(int64(i), 0), testPoint{Timestamp: int64(i)}, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddPoint(ctx, "b", time.Unix(0, 0), testPoint{}, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	pts, err := c.RangePoints(ctx, "a", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 3 || pts[0].Timestamp.Unix() != 7 {
+		t.Fatalf("expected newest 3 points, got %d starting at %v", len(pts), pts[0].Timestamp)
+	}
+}
+
+func TestRedisCache_MigrateLegacy(t *testing.T) {
+	ctx := context.Background()
+	c, mr := newTestRedis(t)
+
+	for i := int64(1); i <= 3; i++ {
+		data, _ := json.Marshal(testPoint{Timestamp: i, RPS: float64(i)})
+		mr.Set(fmt.Sprintf("metric:%d", i), string(data))
+	}
+	data, _ := json.Marshal(testPoint{Timestamp: 4, Source: "web-1", RPS: 4})
+	mr.ZAdd(LegacyHistoryKey, 4, string(data))
+
+	n, err := c.MigrateLegacy(ctx, "default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 migrated points, got %d", n)
+	}
+	if mr.Exists("metric:1") || mr.Exists(LegacyHistoryKey) {
+		t.Fatalf("expected legacy keys to be removed")
+	}
+
+	def, _ := c.RangePoints(ctx, "default", time.Time{}, time.Time{})
+	web, _ := c.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if len(def) != 3 || len(web) != 1 || web[0].Timestamp.Unix() != 4 {
+		t.Fatalf("unexpected migrated points: default=%d web-1=%d", len(def), len(web))
+	}
+
+	if n, err := c.MigrateLegacy(ctx, "default", 0); err != nil || n != 0 {
+		t.Fatalf("expected re-run to be a no-op, got n=%d err=%v", n, err)
+	}
+}
+
+func TestRedisCache_MigrateLegacyRerunAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	c, mr := newTestRedis(t)
+	legacy := func() {
+		mr.Set("metric:1", `{"timestamp":1}`)
+		mr.ZAdd(LegacyHistoryKey, 2, `{"timestamp":2}`)
+	}
+	legacy()
+	if _, err := c.MigrateLegacy(ctx, "default", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// прогон упал после копирования, но до удаления исходных записей
+	legacy()
+	if _, err := c.MigrateLegacy(ctx, "default", 0); err != nil {
+		t.Fatal(err)
+	}
+	if pts, _ := c.RangePoints(ctx, "default", time.Time{}, time.Time{}); len(pts) != 2 {
+		t.Fatalf("expected a re-run not to duplicate points, got %d", len(pts))
+	}
+}
+
+func TestRedisCache_MigrateLegacyKeepsUnparsable(t *testing.T) {
+	ctx := context.Background()
+	c, mr := newTestRedis(t)
+	mr.Set("metric:1", "not json")
+	mr.Set("metric:2", `{"timestamp":2}`)
+	mr.ZAdd(LegacyHistoryKey, 3, "garbage")
+	mr.ZAdd(LegacyHistoryKey, 4, `{"timestamp":4}`)
+
+	n, err := c.MigrateLegacy(ctx, "default", 0)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 migrated points, got %d (%v)", n, err)
+	}
+	if got, _ := mr.Get(UnparsableKey("metric:1")); got != "not json" || mr.Exists("metric:1") {
+		t.Fatalf("expected the unparsable key to be set aside, got %q", got)
+	}
+	if members, _ := mr.ZMembers(UnparsableKey(LegacyHistoryKey)); len(members) != 1 || members[0] != "garbage" {
+		t.Fatalf("expected the unparsable member to be set aside, got %v", members)
+	}
+	if mr.Exists(LegacyHistoryKey) {
+		t.Fatal("expected the legacy history to be removed")
+	}
+}
+
+func TestRedisCache_MigrateLegacyLocked(t *testing.T) {
+	ctx := context.Background()
+	c, mr := newTestRedis(t)
+	mr.Set("metric:1", `{"timestamp":1}`)
+
+	// другая реплика уже переносит ключи
+	mr.Set(MigrationLockKey, "other")
+	if _, err := c.MigrateLegacy(ctx, "default", 0); !errors.Is(err, ErrMigrationLocked) {
+		t.Fatalf("expected ErrMigrationLocked, got %v", err)
+	}
+	if !mr.Exists("metric:1") {
+		t.Fatal("expected nothing migrated while locked")
+	}
+
+	mr.Del(MigrationLockKey)
+	if n, err := c.MigrateLegacy(ctx, "default", 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 migrated point, got %d (%v)", n, err)
+	}
+	if mr.Exists(MigrationLockKey) {
+		t.Fatal("expected the lock to be released")
+	}
+}
+
+func TestRedisCache_PruneSources(t *testing.T) {
+	ctx := context.Background()
+	c, mr := newTestRedis(t)
+	now := time.Unix(10000, 0)
+	c.AddPoint(ctx, "old", now.Add(-2*time.Hour), testPoint{}, 0)
+	c.AddPoint(ctx, "fresh", now.Add(-2*time.Hour), testPoint{}, 0)
+	c.AddPoint(ctx, "fresh", now, testPoint{}, 0)
+	// back-fill не молодит источник
+	c.AddPoint(ctx, "fresh", now.Add(-3*time.Hour), testPoint{}, 0)
+	// источник, записанный до появления индекса
+	mr.SAdd(SourcesKey, "legacy")
+
+	n, err := c.PruneSources(ctx, now, now.Add(-time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expected one source pruned, got %d (%v)", n, err)
+	}
+	members, _ := mr.Members(SourcesKey)
+	if len(members) != 2 || members[0] != "fresh" || members[1] != "legacy" {
+		t.Fatalf("expected fresh and legacy to stay, got %v", members)
+	}
+
+	// новая точка возвращает источник в список
+	c.AddPoint(ctx, "old", now, testPoint{}, 0)
+	if ok, _ := mr.SIsMember(SourcesKey, "old"); !ok {
+		t.Fatal("expected a pruned source to be listed again by its next point")
+	}
+}
+
+func TestRedisCache_SetIfRevision(t *testing.T) {
+	ctx := context.Background()
+	c, mr := newTestRedis(t)
+	type versioned struct {
+		Revision int64 `json:"revision"`
+	}
+
+	if err := c.SetIfRevision(ctx, "config", 0, versioned{1}); err != nil {
+		t.Fatalf("expected a missing key to be set, got %v", err)
+	}
+	if err := c.SetIfRevision(ctx, "config", 0, versioned{1}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a stale revision to conflict, got %v", err)
+	}
+	if err := c.SetIfRevision(ctx, "config", 1, versioned{2}); err != nil {
+		t.Fatalf("expected the current revision to be replaced, got %v", err)
+	}
+	var got versioned
+	if err := c.Get(ctx, "config", &got); err != nil || got.Revision != 2 {
+		t.Fatalf("expected revision 2, got %+v (%v)", got, err)
+	}
+
+	mr.Set("config", "not json")
+	if err := c.SetIfRevision(ctx, "config", 2, versioned{3}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected an unreadable value to conflict, got %v", err)
+	}
+}
+
+func TestRedisCache_WriteBatchReportsLostReplies(t *testing.T) {
+	// сервер принимает команды, но не отвечает
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	c := &RedisCache{client: redis.NewClient(&redis.Options{Addr: ln.Addr().String(), MaxRetries: -1})}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ops := []Op{{Kind: OpSet, Key: "config", Data: []byte(`{}`)}}
+	err = c.WriteBatch(ctx, ops)
+	if len(Unapplied(ops, err)) != 0 || len(Unconfirmed(ops, err)) != 1 {
+		t.Fatalf("expected a write without a reply to have an unknown outcome, got %v", err)
+	}
+}
+
+func TestRedisCache_RangePointsLimit(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestRedis(t)
+	for i := int64(1); i <= 5; i++ {
+		c.AddPoint(ctx, "a", time.Unix(i, 0), testPoint{Timestamp: i}, 0)
+		c.AddPoint(ctx, "b", time.Unix(i, 0), testPoint{Timestamp: i}, 0)
+	}
+
+	pts, err := c.RangePointsLimit(ctx, "", time.Unix(2, 0), time.Time{}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// источники читаются по порядку имён, пока не набрано limit точек
+	var fromB int
+	for _, p := range pts {
+		if p.Source == "b" {
+			fromB++
+		}
+	}
+	if len(pts) != 6 || fromB != 2 || pts[0].Timestamp.Unix() != 2 {
+		t.Fatalf("expected 4 points of a and 2 of b from ts 2, got %+v", pts)
+	}
+}
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Rollup storage layout.
+//
+// For every resolution and source the bucket starting at <start> (unix
+// seconds) is the hash "rollup:<res>:{<source>}:<start>" with the fields
+// "<field>:min|max|sum|count|last|last_ts" for every observed value, and
+// the sorted set "rollup:<res>:{<source>}" indexes bucket starts. Buckets
+// expire after the resolution retention; the index is trimmed to the same
+// window relative to the newest bucket.
+
+// Resolution is a rollup bucket size with its own retention
+type Resolution struct {
+	Name      string
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// DefaultResolutions are the rollups maintained unless configured otherwise
+var DefaultResolutions = []Resolution{
+	{Name: "1m", Step: time.Minute, Retention: 24 * time.Hour},
+	{Name: "5m", Step: 5 * time.Minute, Retention: 7 * 24 * time.Hour},
+	{Name: "1h", Step: time.Hour, Retention: 30 * 24 * time.Hour},
+}
+
+// Aggregate summarises the values of one field within a bucket
+type Aggregate struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Sum   float64 `json:"-"`
+	Count int64   `json:"count"`
+	Last  float64 `json:"last"`
+}
+
+// Merge combines two aggregates of the same field; b is the later one
+func (a Aggregate) Merge(b Aggregate) Aggregate {
+	if a.Count == 0 {
+		return b
+	}
+	if b.Count == 0 {
+		return a
+	}
+	out := Aggregate{
+		Min:   a.Min,
+		Max:   a.Max,
+		Sum:   a.Sum + b.Sum,
+		Count: a.Count + b.Count,
+		Last:  b.Last,
+	}
+	if b.Min < out.Min {
+		out.Min = b.Min
+	}
+	if b.Max > out.Max {
+		out.Max = b.Max
+	}
+	out.Avg = out.Sum / float64(out.Count)
+	return out
+}
+
+// Bucket is one rollup bucket of a source
+type Bucket struct {
+	Source string
+	Start  time.Time
+	Values map[string]Aggregate
+}
+
+// Rollups is implemented by caches that maintain downsampled aggregates
+type Rollups interface {
+	// Observe adds the named values of a point to every resolution
+	Observe(ctx context.Context, source string, ts time.Time, values map[string]float64) error
+	// RangeRollup returns buckets of source ("" = all) starting within [from, to]
+	RangeRollup(ctx context.Context, source string, res Resolution, from, to time.Time) ([]Bucket, error)
+}
+
+func rollupIndexKey(res Resolution, source string) string {
+	return "rollup:" + res.Name + ":{" + source + "}"
+}
+
+func rollupBucketKey(res Resolution, source string, start int64) string {
+	return rollupIndexKey(res, source) + ":" + strconv.FormatInt(start, 10)
+}
+
+func bucketStart(ts time.Time, step time.Duration) int64 {
+	return ts.Truncate(step).Unix()
+}
+
+// observeScript updates all resolutions of one point atomically.
+// KEYS: bucket hash and bucket index for every resolution.
+// ARGV: point ts, resolution count n, then (bucket start, ttl seconds,
+// index cutoff) per resolution, then field/value pairs.
+var observeScript = redis.NewScript(`
+local ts = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local fieldsAt = 3 + 3 * n
+for i = 1, n do
+	local hash = KEYS[2 * i - 1]
+	local index = KEYS[2 * i]
+	local base = 3 + 3 * (i - 1)
+	local start = ARGV[base]
+	local ttl = tonumber(ARGV[base + 1])
+	local cutoff = ARGV[base + 2]
+	for j = fieldsAt, #ARGV, 2 do
+		local f = ARGV[j]
+		local v = tonumber(ARGV[j + 1])
+		local cur = redis.call('HMGET', hash, f .. ':min', f .. ':max', f .. ':last_ts')
+		if not cur[1] or v < tonumber(cur[1]) then
+			redis.call('HSET', hash, f .. ':min', ARGV[j + 1])
+		end
+		if not cur[2] or v > tonumber(cur[2]) then
+			redis.call('HSET', hash, f .. ':max', ARGV[j + 1])
+		end
+		if not cur[3] or ts >= tonumber(cur[3]) then
+			redis.call('HSET', hash, f .. ':last', ARGV[j + 1], f .. ':last_ts', ARGV[1])
+		end
+		redis.call('HINCRBYFLOAT', hash, f .. ':sum', ARGV[j + 1])
+		redis.call('HINCRBY', hash, f .. ':count', 1)
+	end
+	redis.call('ZADD', index, start, start)
+	if ttl > 0 then
+		redis.call('EXPIRE', hash, ttl)
+		redis.call('EXPIRE', index, ttl)
+		redis.call('ZREMRANGEBYSCORE', index, '-inf', '(' .. cutoff)
+	end
+end
+return n
+`)
+
+// SetResolutions configures the rollups maintained by Observe; nil disables them
+func (r *RedisCache) SetResolutions(res []Resolution) {
+	r.resolutions = res
+}
+
+// Resolutions returns the configured rollup resolutions, finest first
+func (r *RedisCache) Resolutions() []Resolution {
+	return r.resolutions
+}
+
+// Observe updates every configured rollup with the values of one point
+func (r *RedisCache) Observe(ctx context.Context, source string, ts time.Time, values map[string]float64) error {
+	keys, args, ok := r.observeArgs(source, ts, values)
+	if !ok {
+		return nil
+	}
+	if err := observeScript.Run(ctx, r.client, keys, args...).Err(); err != nil {
+		return fmt.Errorf("failed to update rollups: %w", err)
+	}
+	return nil
+}
+
+// queueObserve adds a rollup update to a pipeline; the script is sent in
+// full since EVALSHA cannot fall back to EVAL inside a pipeline
+func (r *RedisCache) queueObserve(ctx context.Context, pipe redis.Pipeliner, source string, ts time.Time, values map[string]float64) {
+	if keys, args, ok := r.observeArgs(source, ts, values); ok {
+		observeScript.Eval(ctx, pipe, keys, args...)
+	}
+}
+
+func (r *RedisCache) observeArgs(source string, ts time.Time, values map[string]float64) ([]string, []interface{}, bool) {
+	if len(r.resolutions) == 0 || len(values) == 0 {
+		return nil, nil, false
+	}
+
+	keys := make([]string, 0, 2*len(r.resolutions))
+	args := []interface{}{formatScore(Score(ts)), len(r.resolutions)}
+	for _, res := range r.resolutions {
+		start := bucketStart(ts, res.Step)
+		keys = append(keys, rollupBucketKey(res, source, start), rollupIndexKey(res, source))
+		args = append(args, start, int64(res.Retention/time.Second), start-int64(res.Retention/time.Second))
+	}
+
+	fields := make([]string, 0, len(values))
+	for f := range values {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		args = append(args, f, strconv.FormatFloat(values[f], 'f', -1, 64))
+	}
+	return keys, args, true
+}
+
+// RangeRollup reads buckets of one or all sources within [from, to]
+func (r *RedisCache) RangeRollup(ctx context.Context, source string, res Resolution, from, to time.Time) ([]Bucket, error) {
+	sources := []string{source}
+	if source == "" {
+		var err error
+		if sources, err = r.client.SMembers(ctx, SourcesKey).Result(); err != nil {
+			return nil, fmt.Errorf("failed to list sources: %w", err)
+		}
+		sort.Strings(sources)
+	}
+
+	min, max := "-inf", "+inf"
+	if !from.IsZero() {
+		min = strconv.FormatInt(bucketStart(from, res.Step), 10)
+	}
+	if !to.IsZero() {
+		max = strconv.FormatInt(to.Unix(), 10)
+	}
+
+	var buckets []Bucket
+	for _, src := range sources {
+		starts, err := r.client.ZRangeByScore(ctx, rollupIndexKey(res, src), &redis.ZRangeBy{Min: min, Max: max}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rollup index: %w", err)
+		}
+		if len(starts) == 0 {
+			continue
+		}
+
+		pipe := r.client.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, len(starts))
+		for i, st := range starts {
+			start, _ := strconv.ParseInt(st, 10, 64)
+			cmds[i] = pipe.HGetAll(ctx, rollupBucketKey(res, src, start))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to read rollups: %w", err)
+		}
+
+		for i, cmd := range cmds {
+			start, _ := strconv.ParseInt(starts[i], 10, 64)
+			values := parseBucket(cmd.Val())
+			if len(values) == 0 {
+				// бакет уже истёк, а индекс ещё нет
+				continue
+			}
+			buckets = append(buckets, Bucket{Source: src, Start: time.Unix(start, 0), Values: values})
+		}
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+	return buckets, nil
+}
+
+func parseBucket(h map[string]string) map[string]Aggregate {
+	values := make(map[string]Aggregate)
+	for k, v := range h {
+		i := strings.LastIndexByte(k, ':')
+		if i < 0 {
+			continue
+		}
+		field, stat := k[:i], k[i+1:]
+		agg := values[field]
+		switch stat {
+		case "min":
+			agg.Min, _ = strconv.ParseFloat(v, 64)
+		case "max":
+			agg.Max, _ = strconv.ParseFloat(v, 64)
+		case "sum":
+			agg.Sum, _ = strconv.ParseFloat(v, 64)
+		case "count":
+			agg.Count, _ = strconv.ParseInt(v, 10, 64)
+		case "last":
+			agg.Last, _ = strconv.ParseFloat(v, 64)
+		}
+		values[field] = agg
+	}
+	for f, agg := range values {
+		if agg.Count == 0 {
+			delete(values, f)
+			continue
+		}
+		agg.Avg = agg.Sum / float64(agg.Count)
+		values[f] = agg
+	}
+	return values
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedisCache_ObserveRollups(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t)
+	r.SetResolutions(DefaultResolutions)
+
+	base := time.Unix(1700000000, 0).Truncate(time.Hour)
+	// две минуты по три точки; последняя точка первой минуты пришла не по порядку
+	points := []struct {
+		offset time.Duration
+		rps    float64
+	}{
+		{0, 10}, {30 * time.Second, 30}, {10 * time.Second, 20},
+		{time.Minute, 5}, {time.Minute + time.Second, 7}, {time.Minute + 2*time.Second, 6},
+	}
+	for _, p := range points {
+		values := map[string]float64{"rps": p.rps, "cpu": 50}
+		if err := r.Observe(ctx, "web-1", base.Add(p.offset), values); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	minute, err := r.RangeRollup(ctx, "web-1", DefaultResolutions[0], base, base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minute) != 2 {
+		t.Fatalf("expected 2 one-minute buckets, got %d", len(minute))
+	}
+	first := minute[0].Values["rps"]
+	want := Aggregate{Min: 10, Max: 30, Avg: 20, Sum: 60, Count: 3, Last: 30}
+	if first != want {
+		t.Fatalf("expected %+v, got %+v", want, first)
+	}
+	if minute[1].Values["rps"].Last != 6 || minute[1].Values["cpu"].Avg != 50 {
+		t.Fatalf("unexpected second bucket: %+v", minute[1].Values)
+	}
+
+	hour, err := r.RangeRollup(ctx, "", DefaultResolutions[2], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// набор источников пополняется AddPoint, а не Observe
+	if len(hour) != 0 {
+		t.Fatalf("expected no buckets for unknown sources, got %d", len(hour))
+	}
+	hour, err = r.RangeRollup(ctx, "web-1", DefaultResolutions[2], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hour) != 1 || hour[0].Values["rps"].Count != 6 || hour[0].Values["rps"].Min != 5 {
+		t.Fatalf("unexpected hourly rollup: %+v", hour)
+	}
+
+	ttl := mr.TTL(rollupBucketKey(DefaultResolutions[0], "web-1", base.Unix()))
+	if ttl != DefaultResolutions[0].Retention {
+		t.Fatalf("expected bucket ttl %v, got %v", DefaultResolutions[0].Retention, ttl)
+	}
+}
+
+func TestRedisCache_RawRetention(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t)
+	r.SetRawRetention(time.Minute)
+
+	base := time.Unix(1700000000, 0)
+	for i := 0; i < 5; i++ {
+		ts := base.Add(time.Duration(i) * 30 * time.Second)
+		if err := r.AddPoint(ctx, "web-1", ts, testPoint{Timestamp: ts.Unix()}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pts, err := r.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// последняя точка base+120s, сохраняются точки не старше base+60s
+	if len(pts) != 3 || pts[0].Timestamp.Unix() != base.Unix()+60 {
+		t.Fatalf("expected 3 points from base+60s, got %+v", pts)
+	}
+}
+
+func TestAggregate_Merge(t *testing.T) {
+	a := Aggregate{Min: 1, Max: 5, Sum: 6, Count: 2, Last: 5}
+	b := Aggregate{Min: 0, Max: 3, Sum: 3, Count: 1, Last: 3}
+
+	got := a.Merge(b)
+	want := Aggregate{Min: 0, Max: 5, Avg: 3, Sum: 9, Count: 3, Last: 3}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if (Aggregate{}).Merge(b) != b {
+		t.Fatalf("merging into empty aggregate should return the other one")
+	}
+}
@@ -0,0 +1,444 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/highload-service/internal/clock"
+)
+
+// Stream storage layout.
+//
+// Every source is appended to the Redis Stream "metrics:stream:{<source>}"
+// with XADD. Entry IDs are assigned by Redis, so the stream is ordered by
+// ingestion time; each entry carries the point timestamp ("ts", fractional
+// unix seconds) and its JSON payload ("data"). Since a point may arrive long
+// after its timestamp (back-fills, migrations), the sorted set
+// "metrics:stream:{<source>}:ts" indexes entry IDs by point timestamp and
+// range queries go through it. Retention is bounded by length (MAXLEN ~) or,
+// when configured, by age (XTRIM MINID ~).
+// Known sources are tracked in "metrics:sources" as in the sorted set layout.
+const (
+	streamFieldTS   = "ts"
+	streamFieldData = "data"
+)
+
+// StreamKey returns the stream holding points of source
+func StreamKey(source string) string {
+	return "metrics:stream:{" + source + "}"
+}
+
+// streamCopiedKey returns the set of legacy origins the running migration
+// copied into the stream of source; it shares the hash slot of the stream
+func streamCopiedKey(source string) string {
+	return StreamKey(source) + ":copied"
+}
+
+// StreamIndexKey returns the sorted set indexing the stream of source by
+// point timestamp; it shares the hash slot of the stream
+func StreamIndexKey(source string) string {
+	return StreamKey(source) + ":ts"
+}
+
+// addStreamPointScript appends a point to KEYS[1] and indexes its entry ID
+// in KEYS[2] by the point timestamp. ARGV: ts score, payload, MAXLEN (0 =
+// unbounded), the last entry ID past retention ("" = none). Entries beyond
+// MAXLEN or past retention are deleted from the stream and the index
+// together, oldest first and at most 1000 per call, so both always hold
+// the same points, back-filled ones included.
+var addStreamPointScript = redis.NewScript(addStreamPoint)
+
+// copyStreamPointScript is addStreamPointScript for the legacy migration: it
+// adds the point only if ARGV[5], its origin, is not yet in the set KEYS[3]
+var copyStreamPointScript = redis.NewScript(`
+if redis.call('SADD', KEYS[3], ARGV[5]) == 0 then
+	return false
+end
+` + addStreamPoint)
+
+const addStreamPoint = `
+local limit = 1000
+local id = redis.call('XADD', KEYS[1], '*', 'ts', ARGV[1], 'data', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[1], id)
+local old = {}
+if ARGV[4] ~= '' then
+	old = redis.call('XRANGE', KEYS[1], '-', ARGV[4], 'COUNT', limit)
+end
+local maxLen = tonumber(ARGV[3])
+if maxLen > 0 then
+	local extra = math.min(redis.call('XLEN', KEYS[1]) - maxLen, limit)
+	if extra > #old then
+		old = redis.call('XRANGE', KEYS[1], '-', '+', 'COUNT', extra)
+	end
+end
+for i = 1, #old, 500 do
+	local ids = {}
+	for j = i, math.min(i + 499, #old) do
+		ids[#ids + 1] = old[j][1]
+	end
+	redis.call('XDEL', KEYS[1], unpack(ids))
+	redis.call('ZREM', KEYS[2], unpack(ids))
+end
+return id
+`
+
+// StreamOptions configures the stream backend
+type StreamOptions struct {
+	// Retention trims entries older than this by ingestion time (0 = only MAXLEN)
+	Retention time.Duration
+	// ConsumerGroup, if set, is created on every stream so downstream
+	// consumers can read with XREADGROUP
+	ConsumerGroup string
+	// Clock dates the Retention cutoff (default clock.Real)
+	Clock clock.Clock
+}
+
+// StreamCache stores metric points in Redis Streams. Everything except
+// the point history (Set, Log, Close) is served by the embedded RedisCache.
+type StreamCache struct {
+	*RedisCache
+	opts StreamOptions
+
+	groups sync.Map // source -> struct{}, streams with the consumer group ensured
+}
+
+// NewStreamCache creates a stream-backed cache on top of an existing connection
+func NewStreamCache(r *RedisCache, opts StreamOptions) *StreamCache {
+	opts.Clock = clock.Or(opts.Clock)
+	return &StreamCache{RedisCache: r, opts: opts}
+}
+
+// AddPoint appends a point to the per-source stream
+func (s *StreamCache) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	if err := s.ensureGroup(ctx, source); err != nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	s.queuePoint(ctx, pipe, Op{Key: source, TS: ts, MaxLen: maxLen, Data: data})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to append point: %w", err)
+	}
+	return nil
+}
+
+// queuePoint adds a point to a pipeline; the script is sent in full since
+// EVALSHA cannot fall back to EVAL inside a pipeline
+func (s *StreamCache) queuePoint(ctx context.Context, pipe redis.Pipeliner, op Op) {
+	addStreamPointScript.Eval(ctx, pipe, []string{StreamKey(op.Key), StreamIndexKey(op.Key)},
+		formatScore(Score(op.TS)), string(op.Data), op.MaxLen, s.expiredID())
+	queueSource(ctx, pipe, op)
+}
+
+// expiredID returns the newest entry ID past Retention, or "" without one.
+// Retention counts from ingestion, that is from the entry ID, and not from
+// the point timestamp.
+func (s *StreamCache) expiredID() string {
+	if s.opts.Retention <= 0 {
+		return ""
+	}
+	return streamID(s.opts.Clock.Now().Add(-s.opts.Retention - time.Millisecond))
+}
+
+// WriteBatch applies ops in a single pipeline, appending points to streams
+func (s *StreamCache) WriteBatch(ctx context.Context, ops []Op) error {
+	for _, op := range ops {
+		if op.Kind != OpAddPoint {
+			continue
+		}
+		if err := s.ensureGroup(ctx, op.Key); err != nil {
+			return err
+		}
+	}
+	return s.writeBatch(ctx, ops, s.queuePoint)
+}
+
+func (s *StreamCache) ensureGroup(ctx context.Context, source string) error {
+	if s.opts.ConsumerGroup == "" {
+		return nil
+	}
+	if _, ok := s.groups.Load(source); ok {
+		return nil
+	}
+
+	err := s.client.XGroupCreateMkStream(ctx, StreamKey(source), s.opts.ConsumerGroup, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group: %w", err)
+	}
+	s.groups.Store(source, struct{}{})
+	return nil
+}
+
+// RangePoints reads points of one or all sources within [from, to]. The
+// timestamp index gives the entry IDs of matching points, and the stream is
+// read between the smallest and largest of them.
+func (s *StreamCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]Point, error) {
+	return s.RangePointsLimit(ctx, source, from, to, 0)
+}
+
+// RangePointsLimit reads at most limit points of one or all sources within
+// [from, to]. A bounded read takes no more IDs than are still missing from
+// the index and fetches exactly those entries.
+func (s *StreamCache) RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]Point, error) {
+	sources, err := s.sources(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for _, src := range sources {
+		var count int64
+		if limit > 0 {
+			if count = limit - int64(len(points)); count <= 0 {
+				break
+			}
+		}
+		msgs, err := s.readRange(ctx, src, from, to, count)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			p, ok := streamPoint(src, msg)
+			if !ok {
+				continue
+			}
+			if (!from.IsZero() && p.Timestamp.Before(from)) || (!to.IsZero() && p.Timestamp.After(to)) {
+				continue
+			}
+			points = append(points, p)
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp.Before(points[j].Timestamp)
+	})
+	return points, nil
+}
+
+// readRange reads the entries of source holding points within [from, to],
+// at most count of them when count > 0
+func (s *StreamCache) readRange(ctx context.Context, source string, from, to time.Time, count int64) ([]redis.XMessage, error) {
+	key := StreamKey(source)
+	if from.IsZero() && to.IsZero() {
+		var msgs []redis.XMessage
+		var err error
+		if count > 0 {
+			msgs, err = s.client.XRangeN(ctx, key, "-", "+", count).Result()
+		} else {
+			msgs, err = s.client.XRange(ctx, key, "-", "+").Result()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stream: %w", err)
+		}
+		return msgs, nil
+	}
+
+	ids, err := s.client.ZRangeByScore(ctx, StreamIndexKey(source), &redis.ZRangeBy{
+		Min:   pointBound(from, "-inf"),
+		Max:   pointBound(to, "+inf"),
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream index: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if count <= 0 {
+		start, end := idRange(ids)
+		msgs, err := s.client.XRange(ctx, key, start, end).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stream: %w", err)
+		}
+		return msgs, nil
+	}
+
+	// между найденными ID могут лежать записи с другим временем, поэтому
+	// ограниченное чтение забирает ровно найденные записи
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.XMessageSliceCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.XRange(ctx, key, id, id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+	msgs := make([]redis.XMessage, 0, len(ids))
+	for _, cmd := range cmds {
+		msgs = append(msgs, cmd.Val()...)
+	}
+	return msgs, nil
+}
+
+// idRange returns the smallest and largest of entry IDs
+func idRange(ids []string) (start, end string) {
+	start, end = ids[0], ids[0]
+	for _, id := range ids[1:] {
+		if streamIDLess(id, start) {
+			start = id
+		}
+		if streamIDLess(end, id) {
+			end = id
+		}
+	}
+	return start, end
+}
+
+// streamIDLess orders stream entry IDs ("<ms>-<seq>")
+func streamIDLess(a, b string) bool {
+	ams, aseq := splitStreamID(a)
+	bms, bseq := splitStreamID(b)
+	if ams != bms {
+		return ams < bms
+	}
+	return aseq < bseq
+}
+
+func splitStreamID(id string) (ms, seq uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ = strconv.ParseUint(msPart, 10, 64)
+	seq, _ = strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
+
+func (s *StreamCache) sources(ctx context.Context, source string) ([]string, error) {
+	if source != "" {
+		return []string{source}, nil
+	}
+	sources, err := s.client.SMembers(ctx, SourcesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sources: %w", err)
+	}
+	sort.Strings(sources)
+	return sources, nil
+}
+
+func streamPoint(source string, msg redis.XMessage) (Point, bool) {
+	tsVal, _ := msg.Values[streamFieldTS].(string)
+	data, _ := msg.Values[streamFieldData].(string)
+	score, err := strconv.ParseFloat(tsVal, 64)
+	if err != nil || data == "" {
+		return Point{}, false
+	}
+	return Point{Source: source, Timestamp: scoreTime(score), Data: json.RawMessage(data)}, true
+}
+
+// streamID returns the smallest stream ID at or after t
+func streamID(t time.Time) string {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// copyLegacyPoint appends the point unless the migration already copied
+// origin into the stream of source
+func (s *StreamCache) copyLegacyPoint(ctx context.Context, source string, ts time.Time, origin string, data []byte, maxLen int64) error {
+	if err := s.ensureGroup(ctx, source); err != nil {
+		return err
+	}
+	pipe := s.client.Pipeline()
+	copyStreamPointScript.Eval(ctx, pipe, []string{StreamKey(source), StreamIndexKey(source), streamCopiedKey(source)},
+		formatScore(Score(ts)), string(data), maxLen, s.expiredID(), origin)
+	queueSource(ctx, pipe, Op{Key: source, TS: ts})
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to append point: %w", err)
+	}
+	return nil
+}
+
+// MigrateLegacy indexes streams written before the timestamp index existed
+// and moves points from the legacy key layouts and from the per-source
+// sorted sets into streams, holding the same lock as RedisCache.MigrateLegacy
+func (s *StreamCache) MigrateLegacy(ctx context.Context, defaultSource string, maxLen int64) (int, error) {
+	return s.withMigrationLock(ctx, func() (int, error) {
+		return s.migrateLegacy(ctx, defaultSource, maxLen)
+	})
+}
+
+func (s *StreamCache) migrateLegacy(ctx context.Context, defaultSource string, maxLen int64) (int, error) {
+	sources, err := s.sources(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	for _, src := range sources {
+		if err := s.indexStream(ctx, src); err != nil {
+			return 0, err
+		}
+	}
+
+	migrated, err := s.migrateLegacyInto(ctx, s, defaultSource, maxLen)
+	if err != nil {
+		return migrated, err
+	}
+
+	if sources, err = s.sources(ctx, ""); err != nil {
+		return migrated, err
+	}
+	for _, src := range sources {
+		key := PointsKey(src)
+		vals, err := s.client.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return migrated, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		for _, v := range vals {
+			member, _ := v.Member.(string)
+			if err := s.copyLegacyPoint(ctx, src, scoreTime(v.Score), key+":"+member, decodeMember(member), maxLen); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+		if len(vals) > 0 {
+			if err := s.client.Del(ctx, key).Err(); err != nil {
+				return migrated, fmt.Errorf("failed to delete %s: %w", key, err)
+			}
+		}
+	}
+
+	// все исходные записи удалены, повторять копирование больше нечего
+	for _, src := range sources {
+		if err := s.client.Del(ctx, streamCopiedKey(src)).Err(); err != nil {
+			return migrated, fmt.Errorf("failed to delete %s: %w", streamCopiedKey(src), err)
+		}
+	}
+	return migrated, nil
+}
+
+// indexStream builds the timestamp index of a stream that has none
+func (s *StreamCache) indexStream(ctx context.Context, source string) error {
+	index := StreamIndexKey(source)
+	n, err := s.client.Exists(ctx, index).Result()
+	if err != nil || n > 0 {
+		return err
+	}
+	msgs, err := s.client.XRange(ctx, StreamKey(source), "-", "+").Result()
+	if err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	var members []*redis.Z
+	for _, msg := range msgs {
+		if p, ok := streamPoint(source, msg); ok {
+			members = append(members, &redis.Z{Score: Score(p.Timestamp), Member: msg.ID})
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	if err := s.client.ZAdd(ctx, index, members...).Err(); err != nil {
+		return fmt.Errorf("failed to index stream: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/highload-service/internal/clock"
+)
+
+func TestStreamCache_AddAndRange(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t)
+	s := NewStreamCache(r, StreamOptions{})
+
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		ts := now.Add(time.Duration(i) * time.Second)
+		if err := s.AddPoint(ctx, "web-1", ts, testPoint{Timestamp: ts.Unix(), RPS: float64(i)}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddPoint(ctx, "web-2", now, testPoint{Timestamp: now.Unix()}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	pts, err := s.RangePoints(ctx, "web-1", now.Add(time.Second), now.Add(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 3 || !pts[0].Timestamp.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected 3 points from now+1s, got %+v", pts)
+	}
+
+	all, err := s.RangePoints(ctx, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 {
+		t.Fatalf("expected 6 points across sources, got %d", len(all))
+	}
+}
+
+func TestStreamCache_RangeByPointTimestamp(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t)
+	s := NewStreamCache(r, StreamOptions{})
+
+	// точка за прошлый час приходит сейчас и получает свежий ID
+	now := time.Now().Truncate(time.Second)
+	past := now.Add(-time.Hour)
+	if err := s.AddPoint(ctx, "web-1", now, testPoint{Timestamp: now.Unix(), RPS: 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddPoint(ctx, "web-1", past, testPoint{Timestamp: past.Unix(), RPS: 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	pts, err := s.RangePoints(ctx, "web-1", past.Add(-time.Second), past.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 1 || !pts[0].Timestamp.Equal(past) {
+		t.Fatalf("expected the back-filled point, got %+v", pts)
+	}
+	if pts, _ := s.RangePoints(ctx, "web-1", now, time.Time{}); len(pts) != 1 || !pts[0].Timestamp.Equal(now) {
+		t.Fatalf("expected only the current point, got %+v", pts)
+	}
+}
+
+func TestStreamCache_RangePointsLimit(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t)
+	s := NewStreamCache(r, StreamOptions{})
+
+	// между записями диапазона лежит дозагруженная точка за другое время
+	for _, ts := range []int64{100, 101, 10, 102, 103} {
+		if err := s.AddPoint(ctx, "web-1", time.Unix(ts, 0), testPoint{Timestamp: ts}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pts, err := s.RangePointsLimit(ctx, "web-1", time.Unix(100, 0), time.Unix(200, 0), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 3 || pts[0].Timestamp.Unix() != 100 || pts[2].Timestamp.Unix() != 102 {
+		t.Fatalf("expected points 100..102, got %+v", pts)
+	}
+	if pts, _ := s.RangePointsLimit(ctx, "web-1", time.Time{}, time.Time{}, 2); len(pts) != 2 {
+		t.Fatalf("expected an unbounded range to stop at the limit, got %d points", len(pts))
+	}
+}
+
+func TestStreamCache_RetentionKeepsBackfilledPoints(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t)
+	now := time.Now().Truncate(time.Second)
+	mr.SetTime(now)
+	clk := clock.NewFake(now)
+	s := NewStreamCache(r, StreamOptions{Retention: time.Hour, Clock: clk})
+
+	// точка старше срока хранения записана только что и должна находиться
+	past := now.Add(-2 * time.Hour)
+	if err := s.AddPoint(ctx, "web-1", past, testPoint{Timestamp: past.Unix()}, 0); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := s.RangePoints(ctx, "web-1", past.Add(-time.Minute), past.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 1 || !pts[0].Timestamp.Equal(past) {
+		t.Fatalf("expected the back-filled point by its timestamp, got %+v", pts)
+	}
+
+	// срок истекает по времени записи, и запись уходит из потока и индекса вместе
+	later := now.Add(2 * time.Hour)
+	mr.SetTime(later)
+	clk.Advance(2 * time.Hour)
+	if err := s.AddPoint(ctx, "web-1", later, testPoint{Timestamp: later.Unix()}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pts, _ := s.RangePoints(ctx, "web-1", time.Time{}, time.Time{}); len(pts) != 1 || !pts[0].Timestamp.Equal(later) {
+		t.Fatalf("expected only the new point after retention, got %+v", pts)
+	}
+	if n, _ := r.client.ZCard(ctx, StreamIndexKey("web-1")).Result(); n != 1 {
+		t.Fatalf("expected the index to follow the stream, got %d entries", n)
+	}
+}
+
+func TestStreamCache_MaxLenAndConsumerGroup(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t)
+	s := NewStreamCache(r, StreamOptions{ConsumerGroup: "analytics"})
+
+	for i := 0; i < 10; i++ {
+		if err := s.AddPoint(ctx, "web-1", time.Unix(int64(i), 0), testPoint{Timestamp: int64(i)}, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := r.client.XLen(ctx, StreamKey("web-1")).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected stream trimmed to 4 entries, got %d", n)
+	}
+	if n, _ := r.client.ZCard(ctx, StreamIndexKey("web-1")).Result(); n != 4 {
+		t.Fatalf("expected the index trimmed to 4 entries, got %d", n)
+	}
+
+	// группа создана до первой записи, поэтому потребитель видит все оставшиеся записи
+	streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "analytics",
+		Consumer: "worker-1",
+		Streams:  []string{StreamKey("web-1"), ">"},
+		Count:    100,
+		Block:    -1,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || len(streams[0].Messages) != 4 {
+		t.Fatalf("expected 4 messages for consumer group, got %+v", streams)
+	}
+}
+
+func TestStreamCache_MigratesSortedSets(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t)
+	for i := int64(1); i <= 3; i++ {
+		if err := r.AddPoint(ctx, "web-1", time.Unix(i, 0), testPoint{Timestamp: i}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewStreamCache(r, StreamOptions{})
+	n, err := s.MigrateLegacy(ctx, "default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 migrated points, got %d", n)
+	}
+	if mr.Exists(PointsKey("web-1")) {
+		t.Fatalf("expected sorted set to be removed after migration")
+	}
+	// перенесённые точки находятся по своему времени, а не по времени переноса
+	pts, err := s.RangePoints(ctx, "web-1", time.Unix(2, 0), time.Unix(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 2 || pts[1].Timestamp.Unix() != 3 {
+		t.Fatalf("unexpected migrated points: %+v", pts)
+	}
+}
+
+func TestStreamCache_MigrateIndexesOldStreams(t *testing.T) {
+	ctx := context.Background()
+	r, _ := newTestRedis(t)
+	s := NewStreamCache(r, StreamOptions{})
+	if err := s.AddPoint(ctx, "web-1", time.Unix(100, 0), testPoint{Timestamp: 100}, 0); err != nil {
+		t.Fatal(err)
+	}
+	// поток, записанный до появления индекса
+	r.client.Del(ctx, StreamIndexKey("web-1"))
+
+	if _, err := s.MigrateLegacy(ctx, "default", 0); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := s.RangePoints(ctx, "web-1", time.Unix(99, 0), time.Unix(101, 0))
+	if err != nil || len(pts) != 1 {
+		t.Fatalf("expected the old entry to be indexed, got %+v (%v)", pts, err)
+	}
+}
+
+func TestStreamCache_MigrateRerunAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t)
+	s := NewStreamCache(r, StreamOptions{})
+	legacy := func() {
+		mr.Set("metric:1", `{"timestamp":1}`)
+		mr.ZAdd(LegacyHistoryKey, 2, `{"timestamp":2}`)
+	}
+	legacy()
+
+	// прогон упал после копирования, но до удаления исходных записей
+	if _, err := s.migrateLegacyInto(ctx, s, "default", 0); err != nil {
+		t.Fatal(err)
+	}
+	legacy()
+	if _, err := s.MigrateLegacy(ctx, "default", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := r.client.XLen(ctx, StreamKey("default")).Result(); n != 2 {
+		t.Fatalf("expected a re-run not to duplicate points, got %d", n)
+	}
+	if mr.Exists(streamCopiedKey("default")) {
+		t.Fatal("expected the copied origins to be forgotten after a complete run")
+	}
+}
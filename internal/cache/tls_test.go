@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issue creates a certificate signed by parent, or self-signed if parent is nil
+func issue(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if !isCA {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestRedisCache_TLSWithClientCertAndACL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ca := issue(t, "test-ca", nil, true, 0)
+	server := issue(t, "redis.internal", ca, false, x509.ExtKeyUsageServerAuth)
+	client := issue(t, "metrics-service", ca, false, x509.ExtKeyUsageClientAuth)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := client.write(t, dir, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	mr := miniredis.NewMiniRedis()
+	err := mr.StartTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("failed to start TLS miniredis: %v", err)
+	}
+	defer mr.Close()
+	mr.RequireUserAuth("metrics", "s3cret")
+
+	opts := RedisOptions{
+		Addrs:    []string{mr.Addr()},
+		Username: "metrics",
+		Password: "s3cret",
+		TLS: TLSOptions{
+			CAFile:     caFile,
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			ServerName: "redis.internal",
+		},
+		Pool: PoolOptions{Size: 2, DialTimeout: time.Second},
+	}
+	c, err := NewRedisCacheWithOptions(opts)
+	if err != nil {
+		t.Fatalf("failed to connect over TLS: %v", err)
+	}
+	if err := c.AddPoint(ctx, "web-1", time.Unix(1, 0), testPoint{Timestamp: 1}, 0); err != nil {
+		t.Fatalf("AddPoint failed: %v", err)
+	}
+	c.Close()
+
+	wrongName := opts
+	wrongName.TLS.ServerName = "other.internal"
+	if _, err := NewRedisCacheWithOptions(wrongName); err == nil {
+		t.Fatalf("expected the server name mismatch to fail")
+	}
+
+	noCert := opts
+	noCert.TLS.CertFile, noCert.TLS.KeyFile = "", ""
+	if _, err := NewRedisCacheWithOptions(noCert); err == nil {
+		t.Fatalf("expected the server to require a client certificate")
+	}
+
+	wrongUser := opts
+	wrongUser.Username = "default"
+	if _, err := NewRedisCacheWithOptions(wrongUser); err == nil {
+		t.Fatalf("expected the ACL user to be checked")
+	}
+}
+
+func TestTLSOptions_Config(t *testing.T) {
+	if cfg, err := (TLSOptions{}).Config(); cfg != nil || err != nil {
+		t.Fatalf("expected TLS to be off by default, got %v (%v)", cfg, err)
+	}
+	if _, err := (TLSOptions{CertFile: "client.crt"}).Config(); err == nil {
+		t.Fatalf("expected an error for a cert without a key")
+	}
+	if _, err := (TLSOptions{CAFile: "/nonexistent/ca.pem"}).Config(); err == nil {
+		t.Fatalf("expected an error for a missing CA file")
+	}
+	cfg, err := (TLSOptions{Enabled: true, ServerName: "redis.internal"}).Config()
+	if err != nil || cfg.ServerName != "redis.internal" || cfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected config %+v (%v)", cfg, err)
+	}
+}
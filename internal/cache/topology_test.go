@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestNewRedisCacheWithOptions_Validation(t *testing.T) {
+	cases := []RedisOptions{
+		{},
+		{Mode: "ring", Addrs: []string{"localhost:6379"}},
+		{Mode: ModeSentinel, Addrs: []string{"localhost:26379"}},
+		{Mode: ModeCluster, Addrs: []string{"localhost:7000"}, DB: 1},
+	}
+	for _, opts := range cases {
+		if _, err := NewRedisCacheWithOptions(opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestRedisCache_ClusterMode(t *testing.T) {
+	ctx := context.Background()
+	// miniredis answers CLUSTER SLOTS as a single node owning every slot
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCacheWithOptions(RedisOptions{Mode: ModeCluster, Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("failed to connect in cluster mode: %v", err)
+	}
+	defer c.Close()
+	c.SetResolutions(DefaultResolutions[:1])
+
+	mr.Set("metric:1700000000", `{"timestamp":1700000000,"rps":1}`)
+	if n, err := c.MigrateLegacy(ctx, "default", 0); err != nil || n != 1 {
+		t.Fatalf("expected 1 migrated point, got %d (%v)", n, err)
+	}
+	ts := time.Unix(1700000001, 0)
+	if err := c.AddPoint(ctx, "web-1", ts, testPoint{Timestamp: ts.Unix()}, 0); err != nil {
+		t.Fatalf("AddPoint failed: %v", err)
+	}
+	if err := c.WriteBatch(ctx, []Op{{Kind: OpObserve, Key: "web-1", TS: ts, Values: map[string]float64{"rps": 1}}}); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	pts, err := c.RangePoints(ctx, "", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 2 {
+		t.Fatalf("expected 2 points, got %d (%v)", len(pts), err)
+	}
+}
+
+// startRedis runs a redis-server process (or sentinel) with the given
+// config lines and returns its address. Tests are skipped when the binary
+// is not installed.
+func startRedis(t *testing.T, sentinel bool, conf ...string) string {
+	t.Helper()
+	bin, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server is not installed")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to pick a port: %v", err)
+	}
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "redis.conf")
+	body := fmt.Sprintf("port %d\nbind 127.0.0.1\ndir %s\nsave \"\"\n", port, dir)
+	for _, line := range conf {
+		body += line + "\n"
+	}
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	args := []string{path}
+	if sentinel {
+		args = append(args, "--sentinel")
+	}
+	cmd := exec.Command(bin, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start redis-server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return addr
+}
+
+func TestRedisCache_SentinelMode(t *testing.T) {
+	ctx := context.Background()
+	master := startRedis(t, false)
+	host, port, _ := net.SplitHostPort(master)
+	sentinel := startRedis(t, true, fmt.Sprintf("sentinel monitor mymaster %s %s 1", host, port))
+
+	c, err := NewRedisCacheWithOptions(RedisOptions{
+		Mode:       ModeSentinel,
+		Addrs:      []string{sentinel},
+		MasterName: "mymaster",
+	})
+	if err != nil {
+		t.Fatalf("failed to connect through sentinel: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.AddPoint(ctx, "web-1", time.Unix(1, 0), testPoint{Timestamp: 1}, 0); err != nil {
+		t.Fatalf("AddPoint failed: %v", err)
+	}
+	direct, err := NewRedisCache(master, "", 0)
+	if err != nil {
+		t.Fatalf("failed to connect to master: %v", err)
+	}
+	defer direct.Close()
+	pts, err := direct.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 1 {
+		t.Fatalf("expected the point on the master, got %d (%v)", len(pts), err)
+	}
+}
+
+func TestRedisCache_ClusterProcesses(t *testing.T) {
+	ctx := context.Background()
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startRedis(t, false, "cluster-enabled yes", "cluster-node-timeout 2000"))
+	}
+	cli, err := exec.LookPath("redis-cli")
+	if err != nil {
+		t.Skip("redis-cli is not installed")
+	}
+	args := append([]string{"--cluster", "create"}, addrs...)
+	args = append(args, "--cluster-yes")
+	if out, err := exec.Command(cli, args...).CombinedOutput(); err != nil {
+		t.Fatalf("failed to create cluster: %v\n%s", err, out)
+	}
+
+	var c *RedisCache
+	waitFor(t, func() bool {
+		c, err = NewRedisCacheWithOptions(RedisOptions{Mode: ModeCluster, Addrs: addrs})
+		return err == nil
+	})
+	defer c.Close()
+
+	// sources hash to different slots and land on different nodes
+	for i := 0; i < 20; i++ {
+		src := fmt.Sprintf("web-%d", i)
+		if err := c.AddPoint(ctx, src, time.Unix(int64(i+1), 0), testPoint{Timestamp: int64(i + 1), Source: src}, 0); err != nil {
+			t.Fatalf("AddPoint failed: %v", err)
+		}
+	}
+	pts, err := c.RangePoints(ctx, "", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 20 {
+		t.Fatalf("expected 20 points across the cluster, got %d (%v)", len(pts), err)
+	}
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Window storage layout.
+//
+// A sliding window of detector values is the list "detector:window:{<name>}"
+// holding the newest values, oldest first. Pushes append and trim in one
+// script so concurrent replicas never observe a half-updated window. The
+// string "detector:window:{<name>}:size" records the largest size any
+// replica pushed with, and the list is never trimmed below it: a replica
+// still running with a smaller window must not cut the window of the
+// others.
+
+// Windows is implemented by caches that can keep sliding windows of values
+// shared between replicas
+type Windows interface {
+	// PushWindow appends value to the window at key, keeps the newest size
+	// values (or more, if a larger size was pushed before) and returns them
+	// oldest first, atomically
+	PushWindow(ctx context.Context, key string, value float64, size int) ([]float64, error)
+	// Window returns the values of the window at key, oldest first
+	Window(ctx context.Context, key string) ([]float64, error)
+}
+
+// WindowKey returns the list holding the window called name
+func WindowKey(name string) string {
+	return "detector:window:{" + name + "}"
+}
+
+// windowSizeKey returns the key recording the retained size of the window
+// called name; it shares the hash slot of the list
+func windowSizeKey(name string) string {
+	return WindowKey(name) + ":size"
+}
+
+// pushWindowScript appends ARGV[1] to KEYS[1], keeps the newest values up
+// to the larger of ARGV[2] and the size stored in KEYS[2], and returns the
+// window
+var pushWindowScript = redis.NewScript(`
+local size = math.max(tonumber(ARGV[2]), tonumber(redis.call('GET', KEYS[2]) or 0))
+redis.call('SET', KEYS[2], size)
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], -size, -1)
+return redis.call('LRANGE', KEYS[1], 0, -1)
+`)
+
+// PushWindow appends value to the shared window at key
+func (r *RedisCache) PushWindow(ctx context.Context, key string, value float64, size int) ([]float64, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid window size %d", size)
+	}
+	vals, err := pushWindowScript.Run(ctx, r.client, []string{WindowKey(key), windowSizeKey(key)},
+		strconv.FormatFloat(value, 'g', -1, 64), size).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to update window: %w", err)
+	}
+	return parseWindow(vals), nil
+}
+
+// Window reads the shared window at key
+func (r *RedisCache) Window(ctx context.Context, key string) ([]float64, error) {
+	vals, err := r.client.LRange(ctx, WindowKey(key), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read window: %w", err)
+	}
+	return parseWindow(vals), nil
+}
+
+func parseWindow(vals []string) []float64 {
+	out := make([]float64, 0, len(vals))
+	for _, v := range vals {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// PushWindow updates the window of the primary; windows are not buffered
+// while degraded, so callers fall back to local state
+func (f *FallbackCache) PushWindow(ctx context.Context, key string, value float64, size int) ([]float64, error) {
+	primary, _ := f.reader()
+	w, ok := primary.(Windows)
+	if !ok {
+		return nil, ErrDegraded
+	}
+	out, err := w.PushWindow(ctx, key, value, size)
+	if err != nil && !callerDone(ctx) {
+		f.markDegraded(err)
+	}
+	return out, err
+}
+
+// Window reads the window of the primary
+func (f *FallbackCache) Window(ctx context.Context, key string) ([]float64, error) {
+	primary, _ := f.reader()
+	w, ok := primary.(Windows)
+	if !ok {
+		return nil, ErrDegraded
+	}
+	out, err := w.Window(ctx, key)
+	if err != nil && !callerDone(ctx) {
+		f.markDegraded(err)
+	}
+	return out, err
+}
+
+// PushWindow bypasses the queue: the caller needs the updated window
+func (w *WriteBehindCache) PushWindow(ctx context.Context, key string, value float64, size int) ([]float64, error) {
+	ws, ok := w.inner.(Windows)
+	if !ok {
+		return nil, fmt.Errorf("windows are not supported")
+	}
+	return ws.PushWindow(ctx, key, value, size)
+}
+
+// Window reads the window of the wrapped cache
+func (w *WriteBehindCache) Window(ctx context.Context, key string) ([]float64, error) {
+	ws, ok := w.inner.(Windows)
+	if !ok {
+		return nil, fmt.Errorf("windows are not supported")
+	}
+	return ws.Window(ctx, key)
+}
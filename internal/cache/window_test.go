@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisCache_WindowSharedBetweenClients(t *testing.T) {
+	ctx := context.Background()
+	a, mr := newTestRedis(t)
+	b, err := NewRedisCache(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("failed to connect second client: %v", err)
+	}
+	defer b.Close()
+
+	for i, c := range []*RedisCache{a, b, a, b} {
+		if _, err := c.PushWindow(ctx, "rps", float64(i)+0.5, 3); err != nil {
+			t.Fatalf("PushWindow failed: %v", err)
+		}
+	}
+
+	want := []float64{1.5, 2.5, 3.5}
+	got, err := a.Window(ctx, "rps")
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected window %v, got %v (%v)", want, got, err)
+	}
+	got, _ = b.PushWindow(ctx, "rps", 4.5, 3)
+	if !reflect.DeepEqual(got, []float64{2.5, 3.5, 4.5}) {
+		t.Fatalf("unexpected window after push: %v", got)
+	}
+	if _, err := a.PushWindow(ctx, "rps", 1, 0); err == nil {
+		t.Fatalf("expected an error for an empty window size")
+	}
+}
+
+func TestRedisCache_WindowNotTrimmedBelowLargestSize(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestRedis(t)
+
+	for i := 1; i <= 5; i++ {
+		c.PushWindow(ctx, "rps", float64(i), 5)
+	}
+	// реплика со старой конфигурацией не обрезает окно остальных
+	got, err := c.PushWindow(ctx, "rps", 6, 2)
+	if err != nil || !reflect.DeepEqual(got, []float64{2, 3, 4, 5, 6}) {
+		t.Fatalf("expected the window to keep 5 values, got %v (%v)", got, err)
+	}
+}
+
+func TestFallbackCache_WindowWhileDegraded(t *testing.T) {
+	ctx := context.Background()
+	f := NewFallbackCache(func() (Cache, error) {
+		return nil, errors.New("redis down")
+	}, FallbackOptions{MinBackoff: time.Hour, MaxBackoff: time.Hour})
+	defer f.Close()
+
+	if _, err := f.PushWindow(ctx, "rps", 1, 3); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("expected ErrDegraded, got %v", err)
+	}
+}
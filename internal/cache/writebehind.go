@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+// OverflowPolicy decides what a write does when the queue is full
+type OverflowPolicy string
+
+const (
+	// PolicyBlock waits for room in the queue
+	PolicyBlock OverflowPolicy = "block"
+	// PolicyDropOldest discards the oldest queued write to make room
+	PolicyDropOldest OverflowPolicy = "drop-oldest"
+	// PolicyReject fails the write with ErrQueueFull
+	PolicyReject OverflowPolicy = "reject"
+)
+
+var (
+	// ErrQueueFull is returned by writes rejected under PolicyReject
+	ErrQueueFull = errors.New("write queue is full")
+	// ErrClosed is returned by writes after Close
+	ErrClosed = errors.New("cache is closed")
+)
+
+// ParseOverflowPolicy validates a policy name
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case PolicyBlock, PolicyDropOldest, PolicyReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// WriteBehindHooks receive queue statistics; nil hooks are skipped
+type WriteBehindHooks struct {
+	QueueDepth func(n int)
+	Flushed    func(batch int, elapsed time.Duration, err error)
+	Dropped    func(policy OverflowPolicy)
+}
+
+// WriteBehindOptions configures WriteBehindCache
+type WriteBehindOptions struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	// FlushTimeout bounds a single flush (0 = rely on the client timeouts)
+	FlushTimeout time.Duration
+	Policy       OverflowPolicy
+	Hooks        WriteBehindHooks
+	// Clock drives the FlushInterval ticker (default clock.Real)
+	Clock clock.Clock
+}
+
+// WriteBehindCache takes writes off the request path: they are queued in a
+// bounded channel and flushed to the wrapped cache in batches (one
+// pipelined round trip for Redis) when BatchSize writes are pending or
+// every FlushInterval. Reads flush the queue first so they observe every
+// write queued before them. The context of a write only bounds the time
+// spent queueing it; flushes run on their own context.
+type WriteBehindCache struct {
+	inner Cache
+	opts  WriteBehindOptions
+
+	queue   chan Op
+	flushes chan chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	closeOnce sync.Once
+	closeMu   sync.RWMutex
+	closed    bool
+}
+
+// NewWriteBehindCache wraps inner and starts the flush loop
+func NewWriteBehindCache(inner Cache, opts WriteBehindOptions) *WriteBehindCache {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 10000
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 50 * time.Millisecond
+	}
+	if opts.Policy == "" {
+		opts.Policy = PolicyBlock
+	}
+	opts.Clock = clock.Or(opts.Clock)
+
+	w := &WriteBehindCache{
+		inner:   inner,
+		opts:    opts,
+		queue:   make(chan Op, opts.QueueSize),
+		flushes: make(chan chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *WriteBehindCache) run() {
+	defer close(w.done)
+
+	ticker := w.opts.Clock.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Op, 0, w.opts.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.Background(), func() {}
+		if w.opts.FlushTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, w.opts.FlushTimeout)
+		}
+		start := time.Now()
+		err := WriteBatch(ctx, w.inner, batch)
+		cancel()
+		if err != nil {
+			slog.Warn("Failed to flush cache writes", "writes", len(batch), "error", err)
+		}
+		if w.opts.Hooks.Flushed != nil {
+			w.opts.Hooks.Flushed(len(batch), time.Since(start), err)
+		}
+		batch = batch[:0]
+		w.reportDepth()
+	}
+	// drain moves everything queued so far into batches
+	drain := func() {
+		for {
+			select {
+			case op := <-w.queue:
+				batch = append(batch, op)
+				if len(batch) >= w.opts.BatchSize {
+					flush()
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case op := <-w.queue:
+			batch = append(batch, op)
+			if len(batch) >= w.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C():
+			flush()
+		case ack := <-w.flushes:
+			drain()
+			flush()
+			close(ack)
+		case <-w.stop:
+			drain()
+			flush()
+			return
+		}
+	}
+}
+
+func (w *WriteBehindCache) reportDepth() {
+	if w.opts.Hooks.QueueDepth != nil {
+		w.opts.Hooks.QueueDepth(len(w.queue))
+	}
+}
+
+func (w *WriteBehindCache) dropped() {
+	if w.opts.Hooks.Dropped != nil {
+		w.opts.Hooks.Dropped(w.opts.Policy)
+	}
+}
+
+func (w *WriteBehindCache) enqueue(ctx context.Context, op Op) error {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	switch w.opts.Policy {
+	case PolicyReject:
+		select {
+		case w.queue <- op:
+		default:
+			w.dropped()
+			return ErrQueueFull
+		}
+	case PolicyDropOldest:
+		for {
+			select {
+			case w.queue <- op:
+				w.reportDepth()
+				return nil
+			default:
+			}
+			select {
+			case <-w.queue:
+				w.dropped()
+			default:
+			}
+		}
+	default:
+		select {
+		case w.queue <- op:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.reportDepth()
+	return nil
+}
+
+// Len returns the number of queued writes
+func (w *WriteBehindCache) Len() int {
+	return len(w.queue)
+}
+
+// Flush blocks until every write queued before the call is written or
+// ctx is done
+func (w *WriteBehindCache) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case w.flushes <- ack:
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Set queues a value with expiration
+func (w *WriteBehindCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return w.enqueue(ctx, Op{Kind: OpSet, Key: key, TTL: ttl, Data: data})
+}
+
+// Append queues a record for the log at key
+func (w *WriteBehindCache) Append(ctx context.Context, key string, score float64, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return w.enqueue(ctx, Op{Kind: OpAppend, Key: key, Score: score, MaxLen: maxLen, Data: data})
+}
+
+// AddPoint queues a point of source
+func (w *WriteBehindCache) AddPoint(ctx context.Context, source string, ts time.Time, value interface{}, maxLen int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return w.enqueue(ctx, Op{Kind: OpAddPoint, Key: source, TS: ts, MaxLen: maxLen, Data: data})
+}
+
+// Observe queues a rollup update
+func (w *WriteBehindCache) Observe(ctx context.Context, source string, ts time.Time, values map[string]float64) error {
+	return w.enqueue(ctx, Op{Kind: OpObserve, Key: source, TS: ts, Values: values})
+}
+
+// Range flushes queued writes and reads the log at key
+func (w *WriteBehindCache) Range(ctx context.Context, key string, min, max float64) ([][]byte, error) {
+	if err := w.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return w.inner.Range(ctx, key, min, max)
+}
+
+// Get flushes queued writes and reads a value
+func (w *WriteBehindCache) Get(ctx context.Context, key string, dest interface{}) error {
+	g, ok := w.inner.(Getter)
+	if !ok {
+		return fmt.Errorf("get is not supported")
+	}
+	if err := w.Flush(ctx); err != nil {
+		return err
+	}
+	return g.Get(ctx, key, dest)
+}
+
+// SetIfRevision flushes queued writes and replaces a value of the wrapped
+// cache
+func (w *WriteBehindCache) SetIfRevision(ctx context.Context, key string, revision int64, value interface{}) error {
+	rs, ok := w.inner.(RevisionSetter)
+	if !ok {
+		return errors.New("conditional set is not supported")
+	}
+	if err := w.Flush(ctx); err != nil {
+		return err
+	}
+	return rs.SetIfRevision(ctx, key, revision, value)
+}
+
+// RangePoints flushes queued writes and reads points
+func (w *WriteBehindCache) RangePoints(ctx context.Context, source string, from, to time.Time) ([]Point, error) {
+	return w.RangePointsLimit(ctx, source, from, to, 0)
+}
+
+// RangePointsLimit flushes queued writes and reads at most limit points
+func (w *WriteBehindCache) RangePointsLimit(ctx context.Context, source string, from, to time.Time, limit int64) ([]Point, error) {
+	if err := w.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return RangePointsLimit(ctx, w.inner, source, from, to, limit)
+}
+
+// RangeRollup flushes queued writes and reads rollups of the wrapped cache
+func (w *WriteBehindCache) RangeRollup(ctx context.Context, source string, res Resolution, from, to time.Time) ([]Bucket, error) {
+	r, ok := w.inner.(Rollups)
+	if !ok {
+		return nil, errors.New("rollups are not supported")
+	}
+	if err := w.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return r.RangeRollup(ctx, source, res, from, to)
+}
+
+// PruneSources prunes the sources of the wrapped cache
+func (w *WriteBehindCache) PruneSources(ctx context.Context, now, before time.Time) (int, error) {
+	p, ok := w.inner.(SourcePruner)
+	if !ok {
+		return 0, errors.New("source pruning is not supported")
+	}
+	return p.PruneSources(ctx, now, before)
+}
+
+// Degraded reports the state of the wrapped cache, if it tracks one
+func (w *WriteBehindCache) Degraded() bool {
+	if d, ok := w.inner.(interface{ Degraded() bool }); ok {
+		return d.Degraded()
+	}
+	return false
+}
+
+// Ping checks the wrapped cache
+func (w *WriteBehindCache) Ping(ctx context.Context) error {
+	if p, ok := w.inner.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Close flushes pending writes and closes the wrapped cache
+func (w *WriteBehindCache) Close() error {
+	w.closeOnce.Do(func() {
+		w.closeMu.Lock()
+		w.closed = true
+		w.closeMu.Unlock()
+		close(w.stop)
+		<-w.done
+	})
+	return w.inner.Close()
+}
@@ -0,0 +1,248 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/highload-service/internal/clock"
+)
+
+// gatedCache records batch sizes and blocks flushes until released
+type gatedCache struct {
+	*MemoryCache
+	gate chan struct{}
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func newGatedCache(open bool) *gatedCache {
+	g := &gatedCache{MemoryCache: NewMemoryCache(1000), gate: make(chan struct{})}
+	if open {
+		close(g.gate)
+	}
+	return g
+}
+
+func (g *gatedCache) WriteBatch(ctx context.Context, ops []Op) error {
+	<-g.gate
+	g.mu.Lock()
+	g.batches = append(g.batches, len(ops))
+	g.mu.Unlock()
+	for _, op := range ops {
+		if err := op.Apply(ctx, g.MemoryCache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *gatedCache) flushed() []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]int(nil), g.batches...)
+}
+
+func TestWriteBehindCache_FlushesBySizeAndInterval(t *testing.T) {
+	ctx := context.Background()
+	inner := newGatedCache(true)
+	w := NewWriteBehindCache(inner, WriteBehindOptions{
+		QueueSize:     100,
+		BatchSize:     5,
+		FlushInterval: time.Hour,
+	})
+	defer w.Close()
+
+	for i := int64(1); i <= 5; i++ {
+		if err := w.AddPoint(ctx, "web-1", time.Unix(i, 0), testPoint{Timestamp: i}, 0); err != nil {
+			t.Fatalf("AddPoint failed: %v", err)
+		}
+	}
+	waitFor(t, func() bool { return len(inner.flushed()) == 1 })
+	if b := inner.flushed(); b[0] != 5 {
+		t.Fatalf("expected a full batch of 5, got %v", b)
+	}
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	w2 := NewWriteBehindCache(inner, WriteBehindOptions{
+		QueueSize:     100,
+		BatchSize:     100,
+		FlushInterval: time.Minute,
+		Clock:         clk,
+	})
+	defer w2.Close()
+	if err := w2.AddPoint(ctx, "web-1", time.Unix(6, 0), testPoint{Timestamp: 6}, 0); err != nil {
+		t.Fatalf("AddPoint failed: %v", err)
+	}
+	waitFor(t, func() bool { return clk.Tickers() == 1 })
+	if len(inner.flushed()) != 1 {
+		t.Fatalf("expected no flush before the interval, got %v", inner.flushed())
+	}
+	clk.Advance(time.Minute)
+	waitFor(t, func() bool { return len(inner.flushed()) == 2 })
+
+	pts, err := w.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 6 {
+		t.Fatalf("expected 6 points, got %d (%v)", len(pts), err)
+	}
+}
+
+func TestWriteBehindCache_ReadsSeeQueuedWrites(t *testing.T) {
+	ctx := context.Background()
+	inner := newGatedCache(true)
+	w := NewWriteBehindCache(inner, WriteBehindOptions{BatchSize: 100, FlushInterval: time.Hour})
+	defer w.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		w.AddPoint(ctx, "web-1", time.Unix(i, 0), testPoint{Timestamp: i}, 0)
+	}
+	pts, err := w.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+	if err != nil || len(pts) != 3 {
+		t.Fatalf("expected reads to flush queued writes, got %d (%v)", len(pts), err)
+	}
+}
+
+func TestWriteBehindCache_OverflowPolicies(t *testing.T) {
+	ctx := context.Background()
+	fill := func(t *testing.T, policy OverflowPolicy) (*WriteBehindCache, *gatedCache, *int) {
+		inner := newGatedCache(false)
+		dropped := 0
+		var mu sync.Mutex
+		w := NewWriteBehindCache(inner, WriteBehindOptions{
+			QueueSize:     2,
+			BatchSize:     1,
+			FlushInterval: time.Hour,
+			Policy:        policy,
+			Hooks: WriteBehindHooks{Dropped: func(OverflowPolicy) {
+				mu.Lock()
+				dropped++
+				mu.Unlock()
+			}},
+		})
+		// the worker takes the first write and blocks on the gate, the
+		// next two fill the queue
+		w.AddPoint(ctx, "web-1", time.Unix(1, 0), testPoint{Timestamp: 1}, 0)
+		waitFor(t, func() bool { return w.Len() == 0 })
+		w.AddPoint(ctx, "web-1", time.Unix(2, 0), testPoint{Timestamp: 2}, 0)
+		w.AddPoint(ctx, "web-1", time.Unix(3, 0), testPoint{Timestamp: 3}, 0)
+		return w, inner, &dropped
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		w, inner, dropped := fill(t, PolicyReject)
+		err := w.AddPoint(ctx, "web-1", time.Unix(4, 0), testPoint{Timestamp: 4}, 0)
+		if !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("expected ErrQueueFull, got %v", err)
+		}
+		close(inner.gate)
+		w.Close()
+		if *dropped != 1 {
+			t.Fatalf("expected 1 rejected write, got %d", *dropped)
+		}
+		if n := inner.Len(); n != 3 {
+			t.Fatalf("expected 3 stored points, got %d", n)
+		}
+	})
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		w, inner, dropped := fill(t, PolicyDropOldest)
+		if err := w.AddPoint(ctx, "web-1", time.Unix(4, 0), testPoint{Timestamp: 4}, 0); err != nil {
+			t.Fatalf("drop-oldest should accept the write: %v", err)
+		}
+		close(inner.gate)
+		w.Close()
+		if *dropped != 1 {
+			t.Fatalf("expected 1 dropped write, got %d", *dropped)
+		}
+		pts, _ := inner.RangePoints(ctx, "web-1", time.Time{}, time.Time{})
+		var got []int64
+		for _, p := range pts {
+			got = append(got, p.Timestamp.Unix())
+		}
+		if len(got) != 3 || got[0] != 1 || got[1] != 3 || got[2] != 4 {
+			t.Fatalf("expected points 1,3,4 after dropping the oldest queued, got %v", got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		w, inner, _ := fill(t, PolicyBlock)
+		done := make(chan struct{})
+		go func() {
+			w.AddPoint(ctx, "web-1", time.Unix(4, 0), testPoint{Timestamp: 4}, 0)
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatalf("write should block while the queue is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(inner.gate)
+		<-done
+		w.Close()
+		if n := inner.Len(); n != 4 {
+			t.Fatalf("expected 4 stored points, got %d", n)
+		}
+	})
+}
+
+func TestWriteBehindCache_PipelinesToRedis(t *testing.T) {
+	ctx := context.Background()
+	r, mr := newTestRedis(t)
+	r.SetResolutions(DefaultResolutions[:1])
+	w := NewWriteBehindCache(r, WriteBehindOptions{BatchSize: 50, FlushInterval: time.Hour})
+
+	for i := int64(0); i < 20; i++ {
+		ts := time.Unix(1700000000+i, 0)
+		w.AddPoint(ctx, "web-1", ts, testPoint{Timestamp: ts.Unix()}, 0)
+		w.Observe(ctx, "web-1", ts, map[string]float64{"cpu": float64(i)})
+	}
+	w.Flush(ctx)
+
+	if n, _ := mr.ZMembers(PointsKey("web-1")); len(n) != 20 {
+		t.Fatalf("expected 20 points in Redis, got %d", len(n))
+	}
+	buckets, err := w.RangeRollup(ctx, "web-1", DefaultResolutions[0], time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("RangeRollup failed: %v", err)
+	}
+	var count int64
+	for _, b := range buckets {
+		count += b.Values["cpu"].Count
+	}
+	if count != 20 {
+		t.Fatalf("expected 20 observations across buckets, got %d", count)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := w.AddPoint(ctx, "web-1", time.Now(), testPoint{}, 0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestWriteBehindCache_BlockedWriteHonoursContext(t *testing.T) {
+	inner := newGatedCache(false)
+	w := NewWriteBehindCache(inner, WriteBehindOptions{QueueSize: 1, BatchSize: 1, FlushInterval: time.Hour})
+	defer func() {
+		close(inner.gate)
+		w.Close()
+	}()
+
+	ctx := context.Background()
+	w.AddPoint(ctx, "web-1", time.Unix(1, 0), testPoint{Timestamp: 1}, 0)
+	waitFor(t, func() bool { return w.Len() == 0 })
+	w.AddPoint(ctx, "web-1", time.Unix(2, 0), testPoint{Timestamp: 2}, 0)
+
+	deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := w.AddPoint(deadline, "web-1", time.Unix(3, 0), testPoint{Timestamp: 3}, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the blocked write to give up at the deadline, got %v", err)
+	}
+	if _, err := w.RangePoints(deadline, "web-1", time.Time{}, time.Time{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the read to give up waiting for the flush, got %v", err)
+	}
+}
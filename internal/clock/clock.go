@@ -0,0 +1,39 @@
+// Package clock abstracts the wall clock so that time-dependent code (rates,
+// TTLs, windows, background loops) can be tested deterministically.
+package clock
+
+import "time"
+
+// Clock tells the time and creates tickers
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C until stopped, like *time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Or returns c, or Real if c is nil
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
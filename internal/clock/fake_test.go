@@ -0,0 +1,38 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake_Advance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	tk := c.NewTicker(time.Second)
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-tk.C():
+		t.Fatal("expected no tick before the period")
+	default:
+	}
+
+	// тики, которые никто не забрал, теряются, как у time.Ticker
+	c.Advance(3 * time.Second)
+	if got := <-tk.C(); !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("expected tick at %v, got %v", start.Add(time.Second), got)
+	}
+	select {
+	case <-tk.C():
+		t.Fatal("expected missed ticks to be dropped")
+	default:
+	}
+	if got := c.Now(); !got.Equal(start.Add(3500 * time.Millisecond)) {
+		t.Fatalf("unexpected time %v", got)
+	}
+
+	tk.Stop()
+	if c.Tickers() != 0 {
+		t.Fatalf("expected stopped ticker to be removed, got %d", c.Tickers())
+	}
+}
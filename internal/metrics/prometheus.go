@@ -1,68 +1,243 @@
 package metrics
 
 import (
+	"runtime"
+	"runtime/debug"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-var (
+// Metrics holds the collectors of one service instance
+type Metrics struct {
 	// RequestTotal counts total requests
-	RequestTotal = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of HTTP requests",
-		},
-		[]string{"method", "endpoint", "status"},
-	)
+	RequestTotal *prometheus.CounterVec
 
 	// RequestDuration tracks request latency
-	RequestDuration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "HTTP request duration in seconds",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"method", "endpoint"},
-	)
+	RequestDuration *prometheus.HistogramVec
 
-	// RPSRate tracks requests per second
-	RPSRate = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "rps_rate",
-			Help: "Current requests per second rate",
-		},
-	)
+	// ResponseSize tracks the size of response bodies
+	ResponseSize *prometheus.HistogramVec
+
+	// RequestsInFlight tracks requests being served
+	RequestsInFlight *prometheus.GaugeVec
+
+	// HTTPPanics counts handler panics recovered by the server
+	HTTPPanics *prometheus.CounterVec
+
+	// RPSRate tracks ingested metrics per second over a sliding window
+	RPSRate prometheus.Gauge
 
 	// AnomalyCount counts detected anomalies
-	AnomalyCount = promauto.NewCounter(
-		prometheus.CounterOpts{
-			Name: "anomalies_detected_total",
-			Help: "Total number of anomalies detected",
-		},
-	)
+	AnomalyCount prometheus.Counter
 
-	// AnomalyRate tracks anomaly rate per minute
-	AnomalyRate = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "anomaly_rate_per_minute",
-			Help: "Current anomaly rate per minute",
-		},
-	)
+	// AnomalyRate tracks anomalies per minute over a sliding window
+	AnomalyRate prometheus.Gauge
 
 	// RollingAverageValue tracks rolling average
-	RollingAverageValue = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "rolling_average_value",
-			Help: "Current rolling average value",
-		},
-	)
+	RollingAverageValue prometheus.Gauge
+
+	// CacheDegraded is 1 while Redis is unavailable and writes are buffered in memory
+	CacheDegraded prometheus.Gauge
+
+	// CacheOperations counts cache operations by outcome (ok, error, timeout, canceled)
+	CacheOperations *prometheus.CounterVec
+
+	// CacheQueueDepth tracks writes waiting in the write-behind queue
+	CacheQueueDepth prometheus.Gauge
+
+	// CacheFlushDuration tracks how long a batch flush takes
+	CacheFlushDuration *prometheus.HistogramVec
+
+	// CacheFlushBatchSize tracks the number of writes per flush
+	CacheFlushBatchSize prometheus.Histogram
+
+	// CacheWritesDropped counts writes lost to a full queue
+	CacheWritesDropped *prometheus.CounterVec
+
+	// ShardPeers tracks the number of replicas in the shard ring
+	ShardPeers prometheus.Gauge
+
+	// ShardRebalances counts changes of the shard ring
+	ShardRebalances prometheus.Counter
+
+	// ShardForwards counts metrics forwarded to their owner by outcome (ok, error)
+	ShardForwards *prometheus.CounterVec
 
 	// CPUMetric tracks CPU usage
-	CPUMetric = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "cpu_usage_percent",
-			Help: "CPU usage percentage",
-		},
+	CPUMetric prometheus.Gauge
+
+	// BuildInfo is always 1, labelled with the version of the binary
+	BuildInfo *prometheus.GaugeVec
+
+	// Streams exports per-source statistics with a cardinality cap
+	Streams *StreamGauges
+}
+
+// NewRegistry creates a registry with the Go runtime and process collectors
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
-)
+	return reg
+}
+
+// New creates the service collectors and registers them on reg
+func New(reg prometheus.Registerer, version string) *Metrics {
+	f := promauto.With(reg)
+	m := &Metrics{
+		RequestTotal: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_total",
+				Help: "Total number of HTTP requests",
+			},
+			[]string{"method", "endpoint", "status"},
+		),
+		RequestDuration: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "HTTP request duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"method", "endpoint"},
+		),
+		ResponseSize: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_response_size_bytes",
+				Help:    "HTTP response body size in bytes",
+				Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+			},
+			[]string{"method", "endpoint"},
+		),
+		RequestsInFlight: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_requests_in_flight",
+				Help: "Number of HTTP requests being served",
+			},
+			[]string{"method", "endpoint"},
+		),
+		HTTPPanics: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_panics_total",
+				Help: "Total number of recovered handler panics",
+			},
+			[]string{"route"},
+		),
+		RPSRate: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rps_rate",
+				Help: "Ingested metrics per second over the sliding rate window",
+			},
+		),
+		AnomalyCount: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "anomalies_detected_total",
+				Help: "Total number of anomalies detected",
+			},
+		),
+		AnomalyRate: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "anomaly_rate_per_minute",
+				Help: "Anomalies per minute over the sliding rate window",
+			},
+		),
+		RollingAverageValue: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rolling_average_value",
+				Help: "Current rolling average value",
+			},
+		),
+		CacheDegraded: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "cache_degraded",
+				Help: "Whether the cache runs in degraded in-memory mode (1) or not (0)",
+			},
+		),
+		CacheOperations: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_operations_total",
+				Help: "Total number of cache operations by outcome",
+			},
+			[]string{"operation", "outcome"},
+		),
+		CacheQueueDepth: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "cache_write_queue_depth",
+				Help: "Number of cache writes waiting to be flushed",
+			},
+		),
+		CacheFlushDuration: f.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "cache_flush_duration_seconds",
+				Help:    "Cache batch flush duration in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"status"},
+		),
+		CacheFlushBatchSize: f.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "cache_flush_batch_size",
+				Help:    "Number of cache writes per flush",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+			},
+		),
+		CacheWritesDropped: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_writes_dropped_total",
+				Help: "Total number of cache writes dropped or rejected by a full queue",
+			},
+			[]string{"policy"},
+		),
+		ShardPeers: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "shard_peers",
+				Help: "Number of replicas in the shard ring",
+			},
+		),
+		ShardRebalances: f.NewCounter(
+			prometheus.CounterOpts{
+				Name: "shard_rebalances_total",
+				Help: "Total number of shard ring changes",
+			},
+		),
+		ShardForwards: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shard_forwards_total",
+				Help: "Total number of metrics forwarded to the owning replica",
+			},
+			[]string{"outcome"},
+		),
+		CPUMetric: f.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "cpu_usage_percent",
+				Help: "CPU usage percentage",
+			},
+		),
+
+		BuildInfo: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "build_info",
+				Help: "Build information of the running binary, always 1",
+			},
+			[]string{"version", "revision", "goversion"},
+		),
+	}
+	m.Streams = newStreamGauges(f)
+	m.BuildInfo.WithLabelValues(version, revision(), runtime.Version()).Set(1)
+	return m
+}
 
+// revision returns the VCS revision the binary was built from, if known
+func revision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNew_IsolatedRegistries(t *testing.T) {
+	a := New(prometheus.NewRegistry(), "v1")
+	b := New(prometheus.NewRegistry(), "v2")
+
+	a.AnomalyCount.Inc()
+	if got := testutil.ToFloat64(b.AnomalyCount); got != 0 {
+		t.Fatalf("expected instances not to share collectors, got %v", got)
+	}
+}
+
+func TestNew_BuildInfoAndRuntime(t *testing.T) {
+	reg := NewRegistry()
+	New(reg, "v1.2.3")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, f := range families {
+		found[f.GetName()] = true
+		if f.GetName() != "build_info" {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range f.GetMetric()[0].GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["version"] != "v1.2.3" || labels["goversion"] == "" || labels["revision"] == "" {
+			t.Fatalf("unexpected build_info labels %v", labels)
+		}
+	}
+	for _, name := range []string{"build_info", "go_goroutines", "process_start_time_seconds"} {
+		if !found[name] {
+			t.Errorf("expected %s to be registered", name)
+		}
+	}
+}
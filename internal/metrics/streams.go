@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// OverflowSource is the source label of streams beyond the cardinality cap
+const OverflowSource = "__overflow__"
+
+// StreamValues are the exported statistics of one stream
+type StreamValues struct {
+	RollingAverage float64
+	Mean           float64
+	StdDev         float64
+	LastZ          float64
+}
+
+// StreamGauges exports per-source, per-metric statistics. At most
+// maxSources distinct sources get their own series; further sources share
+// the OverflowSource series, so a misbehaving client sending random source
+// names cannot blow up the number of series. Series of idle sources are
+// removed by Sweep.
+type StreamGauges struct {
+	maxSources int
+
+	rollingAverage *prometheus.GaugeVec
+	mean           *prometheus.GaugeVec
+	stdDev         *prometheus.GaugeVec
+	lastZ          *prometheus.GaugeVec
+	overflow       prometheus.Counter
+
+	mu      sync.Mutex
+	sources map[string]map[string]time.Time // source -> metric -> last update
+}
+
+func newStreamGauges(f promauto.Factory) *StreamGauges {
+	labels := []string{"source", "metric"}
+	return &StreamGauges{
+		rollingAverage: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "stream_rolling_average",
+			Help: "Rolling average of a stream",
+		}, labels),
+		mean: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "stream_window_mean",
+			Help: "Mean of the anomaly detector window of a stream",
+		}, labels),
+		stdDev: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "stream_window_std_dev",
+			Help: "Standard deviation of the anomaly detector window of a stream",
+		}, labels),
+		lastZ: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "stream_last_zscore",
+			Help: "Z-score of the latest value of a stream",
+		}, labels),
+		overflow: f.NewCounter(prometheus.CounterOpts{
+			Name: "stream_series_overflow_total",
+			Help: "Total number of stream updates folded into the overflow series",
+		}),
+		sources: make(map[string]map[string]time.Time),
+	}
+}
+
+// SetLimit sets the maximum number of sources with their own series
+// (0 means unlimited)
+func (g *StreamGauges) SetLimit(maxSources int) {
+	g.mu.Lock()
+	g.maxSources = maxSources
+	g.mu.Unlock()
+}
+
+// Set updates the series of source and metric at time now
+func (g *StreamGauges) Set(source, metric string, v StreamValues, now time.Time) {
+	// серии пишутся под блокировкой, чтобы Sweep не удалил их между учётом и записью
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	metrics, ok := g.sources[source]
+	if !ok && g.maxSources > 0 && len(g.sources) >= g.maxSources && source != OverflowSource {
+		source = OverflowSource
+		metrics, ok = g.sources[source]
+		g.overflow.Inc()
+	}
+	if !ok {
+		metrics = make(map[string]time.Time)
+		g.sources[source] = metrics
+	}
+	metrics[metric] = now
+
+	g.rollingAverage.WithLabelValues(source, metric).Set(v.RollingAverage)
+	g.mean.WithLabelValues(source, metric).Set(v.Mean)
+	g.stdDev.WithLabelValues(source, metric).Set(v.StdDev)
+	g.lastZ.WithLabelValues(source, metric).Set(v.LastZ)
+}
+
+// Sweep deletes the series not updated since before, freeing their sources'
+// slots, and returns how many series were deleted
+func (g *StreamGauges) Sweep(before time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	deleted := 0
+	for source, metrics := range g.sources {
+		for metric, last := range metrics {
+			if !last.Before(before) {
+				continue
+			}
+			delete(metrics, metric)
+			for _, vec := range []*prometheus.GaugeVec{g.rollingAverage, g.mean, g.stdDev, g.lastZ} {
+				vec.DeleteLabelValues(source, metric)
+			}
+			deleted++
+		}
+		if len(metrics) == 0 {
+			delete(g.sources, source)
+		}
+	}
+	return deleted
+}
+
+// Sources returns the number of sources with their own series, including
+// the overflow series
+func (g *StreamGauges) Sources() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.sources)
+}
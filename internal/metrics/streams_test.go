@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStreamGauges_OverflowBeyondLimit(t *testing.T) {
+	m := New(prometheus.NewRegistry(), "test")
+	m.Streams.SetLimit(2)
+	now := time.Now()
+
+	for _, source := range []string{"a", "b", "c", "d"} {
+		m.Streams.Set(source, "rps", StreamValues{RollingAverage: 1}, now)
+	}
+	// уже известный источник продолжает писать в свою серию
+	m.Streams.Set("a", "cpu", StreamValues{RollingAverage: 5}, now)
+
+	if got := m.Streams.Sources(); got != 3 {
+		t.Fatalf("expected 2 sources plus overflow, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.Streams.overflow); got != 2 {
+		t.Fatalf("expected 2 overflowed updates, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.Streams.rollingAverage); got != 4 {
+		t.Fatalf("expected 4 series, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.Streams.rollingAverage.WithLabelValues("a", "cpu")); got != 5 {
+		t.Fatalf("expected a/cpu = 5, got %v", got)
+	}
+}
+
+func TestStreamGauges_SweepDeletesIdleSeries(t *testing.T) {
+	m := New(prometheus.NewRegistry(), "test")
+	m.Streams.SetLimit(1)
+	start := time.Now()
+
+	m.Streams.Set("old", "rps", StreamValues{}, start)
+	m.Streams.Set("old", "cpu", StreamValues{}, start.Add(time.Minute))
+
+	if deleted := m.Streams.Sweep(start.Add(time.Second)); deleted != 1 {
+		t.Fatalf("expected 1 idle series deleted, got %d", deleted)
+	}
+	if got := testutil.CollectAndCount(m.Streams.lastZ); got != 1 {
+		t.Fatalf("expected 1 series left, got %d", got)
+	}
+
+	m.Streams.Sweep(start.Add(time.Hour))
+	if got := testutil.CollectAndCount(m.Streams.lastZ); got != 0 {
+		t.Fatalf("expected no series left, got %d", got)
+	}
+	// освободившийся слот достаётся новому источнику
+	m.Streams.Set("new", "rps", StreamValues{}, start.Add(time.Hour))
+	if got := testutil.ToFloat64(m.Streams.overflow); got != 0 {
+		t.Fatalf("expected no overflow after sweep, got %v", got)
+	}
+}
@@ -0,0 +1,67 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Discoverer lists the current peers as host:port addresses
+type Discoverer interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed list of peers
+type StaticPeers []string
+
+// Peers returns the list
+func (s StaticPeers) Peers(ctx context.Context) ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+// Resolver is the subset of *net.Resolver used by SRVDiscovery
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SRVDiscovery finds peers through the SRV records of a DNS name, such as
+// _http._tcp.<service>.<namespace>.svc.cluster.local of a headless service.
+// Targets are resolved to IP addresses, which is how pods identify
+// themselves (POD_IP), since pods of a Deployment have no stable names.
+type SRVDiscovery struct {
+	Name     string
+	Resolver Resolver // net.DefaultResolver if nil
+}
+
+// Peers resolves the SRV records into ip:port addresses
+func (d *SRVDiscovery) Peers(ctx context.Context) ([]string, error) {
+	var res Resolver = net.DefaultResolver
+	if d.Resolver != nil {
+		res = d.Resolver
+	}
+	_, records, err := res.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV %s: %w", d.Name, err)
+	}
+
+	var peers []string
+	for _, rec := range records {
+		port := strconv.Itoa(int(rec.Port))
+		target := strings.TrimSuffix(rec.Target, ".")
+		if ip := net.ParseIP(target); ip != nil {
+			peers = append(peers, net.JoinHostPort(target, port))
+			continue
+		}
+		addrs, err := res.LookupHost(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve SRV target %s: %w", target, err)
+		}
+		for _, a := range addrs {
+			peers = append(peers, net.JoinHostPort(a, port))
+		}
+	}
+	return normalize(peers), nil
+}
@@ -0,0 +1,100 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Ring assigns keys to peers by consistent hashing. Every peer is placed on
+// the ring at several virtual points, so that adding or removing one peer
+// moves only about 1/n of the keys.
+type Ring struct {
+	vnodes int
+
+	mu     sync.RWMutex
+	points []uint64          // sorted hashes of virtual nodes
+	owners map[uint64]string // virtual node -> peer
+	peers  []string
+}
+
+// NewRing creates an empty ring with vnodes virtual nodes per peer
+func NewRing(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 100
+	}
+	return &Ring{vnodes: vnodes, owners: make(map[uint64]string)}
+}
+
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV плохо перемешивает близкие строки, добиваем финализатором splitmix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Set replaces the peers of the ring
+func (r *Ring) Set(peers []string) {
+	peers = normalize(peers)
+	points := make([]uint64, 0, len(peers)*r.vnodes)
+	owners := make(map[uint64]string, len(peers)*r.vnodes)
+	for _, p := range peers {
+		for i := 0; i < r.vnodes; i++ {
+			h := hashKey(p + "#" + strconv.Itoa(i))
+			if _, taken := owners[h]; taken {
+				continue
+			}
+			owners[h] = p
+			points = append(points, h)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	r.mu.Lock()
+	r.points, r.owners, r.peers = points, owners, peers
+	r.mu.Unlock()
+}
+
+// Owner returns the peer owning key, or "" if the ring is empty
+func (r *Ring) Owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Peers returns the sorted peers of the ring
+func (r *Ring) Peers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.peers...)
+}
+
+// normalize sorts peers and drops empty and duplicate entries
+func normalize(peers []string) []string {
+	out := make([]string, 0, len(peers))
+	seen := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,62 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_EmptyAndSingle(t *testing.T) {
+	r := NewRing(10)
+	if got := r.Owner("web-1"); got != "" {
+		t.Fatalf("expected no owner on an empty ring, got %q", got)
+	}
+	r.Set([]string{"a:8080"})
+	if got := r.Owner("web-1"); got != "a:8080" {
+		t.Fatalf("expected the only peer to own every key, got %q", got)
+	}
+}
+
+func TestRing_BalancedAndStable(t *testing.T) {
+	peers := []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}
+	r := NewRing(100)
+	r.Set(peers)
+
+	// порядок пиров не влияет на владельцев
+	reordered := NewRing(100)
+	reordered.Set([]string{peers[2], peers[0], peers[1], peers[0]})
+
+	const keys = 3000
+	counts := map[string]int{}
+	before := map[string]string{}
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprintf("source-%d", i)
+		owner := r.Owner(k)
+		if owner != reordered.Owner(k) {
+			t.Fatalf("owner of %s depends on peer order", k)
+		}
+		counts[owner]++
+		before[k] = owner
+	}
+	for _, p := range peers {
+		if counts[p] < keys/3/2 || counts[p] > keys/3*2 {
+			t.Fatalf("unbalanced ring: %v", counts)
+		}
+	}
+
+	// новый пир забирает ключи только себе, остальные остаются на месте
+	r.Set(append(peers, "10.0.0.4:8080"))
+	moved := 0
+	for k, owner := range before {
+		now := r.Owner(k)
+		if now == owner {
+			continue
+		}
+		if now != "10.0.0.4:8080" {
+			t.Fatalf("key %s moved between old peers: %s -> %s", k, owner, now)
+		}
+		moved++
+	}
+	if moved < keys/4/2 || moved > keys/4*2 {
+		t.Fatalf("expected about a quarter of keys to move, moved %d of %d", moved, keys)
+	}
+}
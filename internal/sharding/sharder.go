@@ -0,0 +1,146 @@
+package sharding
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Hooks observe peer changes, e.g. to export metrics
+type Hooks struct {
+	// Rebalanced is called after the ring changed, with the new peers and the
+	// peers that joined and left
+	Rebalanced func(peers, joined, left []string)
+	// DiscoveryFailed is called when the peers could not be refreshed; the
+	// last known ring stays in use
+	DiscoveryFailed func(err error)
+}
+
+// Options configures a Sharder
+type Options struct {
+	VirtualNodes    int           // virtual nodes per peer (default 100)
+	RefreshInterval time.Duration // how often to rediscover peers (default 10s)
+	RefreshTimeout  time.Duration // deadline of one discovery (default 5s)
+	Hooks           Hooks
+}
+
+// Sharder decides which replica owns a key. It keeps a consistent-hash ring
+// of the peers reported by a Discoverer and refreshes it in the background,
+// so ownership rebalances as replicas join or leave.
+type Sharder struct {
+	self string
+	disc Discoverer
+	opts Options
+	ring *Ring
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewSharder creates a Sharder for the replica reachable at self, performs
+// the first discovery and starts the refresh loop
+func NewSharder(self string, disc Discoverer, opts Options) *Sharder {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 10 * time.Second
+	}
+	if opts.RefreshTimeout <= 0 {
+		opts.RefreshTimeout = 5 * time.Second
+	}
+
+	s := &Sharder{
+		self: self,
+		disc: disc,
+		opts: opts,
+		ring: NewRing(opts.VirtualNodes),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.Refresh(context.Background())
+	go s.run()
+	return s
+}
+
+// Self returns the address of this replica
+func (s *Sharder) Self() string {
+	return s.self
+}
+
+// Peers returns the peers of the current ring
+func (s *Sharder) Peers() []string {
+	return s.ring.Peers()
+}
+
+// Owner returns the peer owning key and whether it is this replica. With
+// no known peers every key is local.
+func (s *Sharder) Owner(key string) (peer string, local bool) {
+	peer = s.ring.Owner(key)
+	return peer, peer == "" || peer == s.self
+}
+
+// Refresh rediscovers peers and rebuilds the ring if they changed
+func (s *Sharder) Refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.RefreshTimeout)
+	defer cancel()
+
+	peers, err := s.disc.Peers(ctx)
+	if err != nil {
+		slog.Warn("Peer discovery failed, keeping known peers", "peers", len(s.ring.Peers()), "error", err)
+		if s.opts.Hooks.DiscoveryFailed != nil {
+			s.opts.Hooks.DiscoveryFailed(err)
+		}
+		return
+	}
+	peers = normalize(peers)
+
+	joined, left := diff(s.ring.Peers(), peers)
+	if len(joined) == 0 && len(left) == 0 {
+		return
+	}
+	s.ring.Set(peers)
+	slog.Info("Shard ring rebalanced", "peers", len(peers), "joined", joined, "left", left)
+	if s.opts.Hooks.Rebalanced != nil {
+		s.opts.Hooks.Rebalanced(peers, joined, left)
+	}
+}
+
+func (s *Sharder) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Refresh(context.Background())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the refresh loop
+func (s *Sharder) Close() {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// diff returns the entries of next missing from prev and vice versa; both
+// must be sorted
+func diff(prev, next []string) (joined, left []string) {
+	i, j := 0, 0
+	for i < len(prev) || j < len(next) {
+		switch {
+		case j == len(next) || (i < len(prev) && prev[i] < next[j]):
+			left = append(left, prev[i])
+			i++
+		case i == len(prev) || next[j] < prev[i]:
+			joined = append(joined, next[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return joined, left
+}
@@ -0,0 +1,109 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePeers struct {
+	mu    sync.Mutex
+	peers []string
+	err   error
+}
+
+func (f *fakePeers) set(peers []string, err error) {
+	f.mu.Lock()
+	f.peers, f.err = peers, err
+	f.mu.Unlock()
+}
+
+func (f *fakePeers) Peers(ctx context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.peers...), f.err
+}
+
+func TestSharder_RebalancesOnPeerChanges(t *testing.T) {
+	disc := &fakePeers{}
+	disc.set([]string{"b:1", "a:1"}, nil)
+
+	var joined, left [][]string
+	s := NewSharder("a:1", disc, Options{
+		RefreshInterval: time.Hour,
+		Hooks: Hooks{Rebalanced: func(peers, j, l []string) {
+			joined = append(joined, j)
+			left = append(left, l)
+		}},
+	})
+	defer s.Close()
+
+	if !reflect.DeepEqual(s.Peers(), []string{"a:1", "b:1"}) {
+		t.Fatalf("unexpected peers %v", s.Peers())
+	}
+	local := 0
+	for _, k := range []string{"web-1", "web-2", "web-3", "web-4", "web-5", "web-6"} {
+		if _, ok := s.Owner(k); ok {
+			local++
+		}
+	}
+	if local == 0 || local == 6 {
+		t.Fatalf("expected the keys to be split between two peers, %d are local", local)
+	}
+
+	// сбой обнаружения не сбрасывает кольцо
+	disc.set(nil, errors.New("dns timeout"))
+	s.Refresh(context.Background())
+	if len(s.Peers()) != 2 {
+		t.Fatalf("expected the last known peers to be kept, got %v", s.Peers())
+	}
+
+	disc.set([]string{"a:1"}, nil)
+	s.Refresh(context.Background())
+	for _, k := range []string{"web-1", "web-2", "web-3", "web-4", "web-5", "web-6"} {
+		if owner, ok := s.Owner(k); !ok {
+			t.Fatalf("expected every key to be local after b left, %s is on %s", k, owner)
+		}
+	}
+	if len(joined) != 2 || !reflect.DeepEqual(left[1], []string{"b:1"}) {
+		t.Fatalf("unexpected rebalance history: joined %v, left %v", joined, left)
+	}
+}
+
+type fakeResolver struct{}
+
+func (fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", []*net.SRV{
+		{Target: "10-0-0-2.metrics-analyzer-headless.default.svc.cluster.local.", Port: 8080},
+		{Target: "10.0.0.1", Port: 8080},
+	}, nil
+}
+
+func (fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if host != "10-0-0-2.metrics-analyzer-headless.default.svc.cluster.local" {
+		return nil, errors.New("no such host")
+	}
+	return []string{"10.0.0.2"}, nil
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	d := &SRVDiscovery{Name: "_http._tcp.metrics-analyzer-headless", Resolver: fakeResolver{}}
+	peers, err := d.Peers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:8080", "10.0.0.2:8080"}; !reflect.DeepEqual(peers, want) {
+		t.Fatalf("expected %v, got %v", want, peers)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	joined, left := diff([]string{"a", "c", "d"}, []string{"b", "c", "e"})
+	if !reflect.DeepEqual(joined, []string{"b", "e"}) || !reflect.DeepEqual(left, []string{"a", "d"}) {
+		t.Fatalf("unexpected diff: joined %v, left %v", joined, left)
+	}
+}
@@ -6,6 +6,7 @@ echo "== Applying Kubernetes manifests =="
 echo "[1/7] ConfigMaps and Secrets"
 kubectl apply -f k8s/configmaps/app-config.yaml
 kubectl apply -f k8s/configmaps/redis-secret.yaml
+scripts/create-secrets.sh
 
 echo "[2/7] Redis"
 kubectl apply -f k8s/deployments/redis-deployment.yaml
@@ -14,6 +15,7 @@ kubectl apply -f k8s/services/redis-service.yaml
 echo "[3/7] Go service"
 kubectl apply -f k8s/deployments/metrics-analyzer-deployment.yaml
 kubectl apply -f k8s/services/metrics-analyzer-service.yaml
+kubectl apply -f k8s/services/metrics-analyzer-headless.yaml
 
 echo "[4/7] HPA"
 kubectl apply -f k8s/hpa/metrics-analyzer-hpa.yaml
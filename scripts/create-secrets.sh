@@ -0,0 +1,21 @@
+#!/bin/bash
+# Creates the secrets of the service unless they already exist. Values are
+# taken from ADMIN_TOKEN and SHARD_SECRET or generated; they are never stored
+# in the repository.
+set -e
+
+create_secret() {
+  local name=$1 key=$2 value=$3
+  if kubectl get secret "$name" >/dev/null 2>&1; then
+    echo "Secret $name already exists"
+    return
+  fi
+  kubectl create secret generic "$name" --from-literal="$key=${value:-$(openssl rand -hex 32)}"
+  if [ -z "$value" ]; then
+    echo "Generated $name, read it with:"
+    echo "  kubectl get secret $name -o jsonpath='{.data.$key}' | base64 -d"
+  fi
+}
+
+create_secret metrics-analyzer-admin token "$ADMIN_TOKEN"
+create_secret metrics-analyzer-shard secret "$SHARD_SECRET"
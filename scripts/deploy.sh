@@ -6,6 +6,7 @@ echo "Deploying to Kubernetes..."
 
 # Apply secrets first
 kubectl apply -f k8s/configmaps/redis-secret.yaml
+scripts/create-secrets.sh
 
 # Apply configmaps
 kubectl apply -f k8s/configmaps/app-config.yaml
@@ -21,6 +22,7 @@ kubectl wait --for=condition=available --timeout=300s deployment/redis
 # Deploy Go service
 kubectl apply -f k8s/deployments/metrics-analyzer-deployment.yaml
 kubectl apply -f k8s/services/metrics-analyzer-service.yaml
+kubectl apply -f k8s/services/metrics-analyzer-headless.yaml
 
 # Wait for Go service to be ready
 echo "Waiting for Go service to be ready..."